@@ -7,6 +7,7 @@ import (
   "encoding/json"
   "fmt"
   "io/ioutil"
+  "sort"
   "strings"
 )
 
@@ -87,6 +88,20 @@ func (svr *fakeserver)handle_api_object (w http.ResponseWriter, r *http.Request)
     return
   }
 
+  /* A GET on the collection itself lists every object, ordered by id */
+  if id == "" && r.Method == "GET" {
+    ids := make([]string, 0)
+    for id := range svr.objects { ids = append(ids, id) }
+    sort.Strings(ids)
+
+    list := make([]map[string]interface{}, 0)
+    for _, id := range ids { list = append(list, svr.objects[id]) }
+    if svr.debug { log.Printf("fakeserver.go: Returning list of %d objects.\n", len(list)) }
+    b, _ := json.Marshal(list)
+    w.Write(b)
+    return
+  }
+
   if r.Method == "DELETE" {
     /* Get rid of this one */
     delete(svr.objects, id)
@@ -2,87 +2,1587 @@ package restapi
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/jmespath/go-jmespath"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+/* Matches the region in AWS host names such as
+   abc123.execute-api.eu-west-1.amazonaws.com */
+var aws_region_host_regexp = regexp.MustCompile(`\.([a-z]{2}(?:-gov)?-[a-z]+-[0-9]+)\.amazonaws\.com(?:\.cn)?$`)
+
+/* HMAC algorithms supported for response signatures */
+var response_signature_algorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+/* Matches a leading "sha256=" style prefix on a signature */
+var signature_prefix_regexp = regexp.MustCompile(`^[A-Za-z0-9-]+=`)
+
+/* Response headers commonly used to report API quota */
+var rate_limit_headers = []string{
+	"X-RateLimit-Limit",
+	"X-RateLimit-Remaining",
+	"X-RateLimit-Reset",
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+}
+
+type api_client_opt struct {
+	uri                          string
+	path_variables               map[string]string
+	insecure                     bool
+	username                     string
+	password                     string
+	auth_header                  string
+	auth_hosts                   []string
+	max_redirects                int
+	redirect_body_path           string
+	host_overrides               map[string]string
+	expect_continue_timeout      int
+	share_connections            bool
+	max_conns_per_host           int
+	timeout                      int
+	timeout_retry_factor         float64
+	timeout_max                  int
+	id_attribute                 string
+	id_case                      string
+	id_fallback_attribute        string
+	id_body_field                string
+	id_from_location             bool
+	id_changed                   string
+	gone_codes                   []int
+	created_codes                []int
+	updated_codes                []int
+	trailing_slash               string
+	query_array_style            string
+	self_link_path               string
+	copy_keys                    []string
+	copy_keys_array_strategy     map[string]string
+	copy_keys_empty_as_absent    []string
+	computed_keys                []string
+	sensitive_fields             []string
+	write_returns_object         bool
+	create_returns_object        bool
+	retry_max_attempts           int
+	retry_max_elapsed            int
+	retry_wait_min               int
+	retry_wait_max               int
+	retry_after_headers          map[string]string
+	retry_after_429_only         bool
+	http2_retries                int
+	tls_handshake_retries        int
+	partial_json_retries         int
+	strict_content_length        bool
+	empty_response_retries       int
+	prior_state_header           string
+	prior_state_field            string
+	verify_create                string
+	create_match_field           string
+	merge_server_defaults        bool
+	duplicate_keys               string
+	response_content_type        string
+	error_message_path           string
+	success_expression           string
+	envelope_status_path         string
+	envelope_success_value       string
+	envelope_data_path           string
+	envelope_error_path          string
+	object_unwrap_path           string
+	list_unwrap_path             string
+	strip_xssi_prefix            bool
+	response_strip_prefix        string
+	response_strip_suffix        string
+	response_signature_header    string
+	response_signature_algorithm string
+	response_signature_secret    string
+	body_encoding                string
+	canonical_json               bool
+	preserve_key_order           bool
+	minimal_headers              bool
+	null_fields                  string
+	normalize_unicode            bool
+	body_form_field              string
+	aws_sign                     bool
+	aws_region                   string
+	aws_region_from_host         bool
+	aws_credential_chain         []string
+	aws_profile                  string
+	token_url                    string
+	token_request_body           string
+	token_response_path          string
+	token_expires_in_path        string
+	token_refresh_skew           int
+	token_header_prefix          string
+	token_exchange               []token_step
+	cookie_jar                   bool
+	expose_cookies               bool
+	expose_rate_limit            bool
+	log_error_bodies             bool
+	log_body_limit               int
+	log_requests                 bool
+	hooks                        request_hooks
+	cache_ttl                    int
+	max_body_size                int
+	preflight                    bool
+	preflight_path               string
+	preflight_headers            map[string]string
+	debug                        bool
+}
+
 type api_client struct {
-	http_client           *http.Client
-	uri                   string
-	insecure              bool
-	username              string
-	password              string
-	auth_header           string
-	redirects             int
-	timeout               int
-	id_attribute          string
-	copy_keys             []string
-	write_returns_object  bool
-	create_returns_object bool
-	debug                 bool
+	http_client                  *http.Client
+	token_client                 *http.Client
+	uri                          string
+	path_variables               map[string]string
+	insecure                     bool
+	username                     string
+	password                     string
+	auth_header                  string
+	auth_hosts                   []string
+	max_redirects                int
+	redirect_body_path           string
+	host_overrides               map[string]string
+	expect_continue_timeout      int
+	share_connections            bool
+	max_conns_per_host           int
+	timeout                      int
+	timeout_retry_factor         float64
+	timeout_max                  int
+	id_attribute                 string
+	id_case                      string
+	id_fallback_attribute        string
+	id_body_field                string
+	id_from_location             bool
+	id_changed                   string
+	gone_codes                   []int
+	created_codes                []int
+	updated_codes                []int
+	trailing_slash               string
+	query_array_style            string
+	self_link_path               string
+	copy_keys                    []string
+	copy_keys_array_strategy     map[string]string
+	copy_keys_empty_as_absent    []string
+	computed_keys                []string
+	sensitive_fields             []string
+	write_returns_object         bool
+	create_returns_object        bool
+	retry_max_attempts           int
+	retry_max_elapsed            int
+	retry_wait_min               int
+	retry_wait_max               int
+	retry_after_headers          map[string]string
+	retry_after_429_only         bool
+	http2_retries                int
+	tls_handshake_retries        int
+	partial_json_retries         int
+	strict_content_length        bool
+	empty_response_retries       int
+	prior_state_header           string
+	prior_state_field            string
+	verify_create                string
+	create_match_field           string
+	merge_server_defaults        bool
+	duplicate_keys               string
+	response_content_type        string
+	error_message_path           string
+	success_expression           string
+	envelope_status_path         string
+	envelope_success_value       string
+	envelope_data_path           string
+	envelope_error_path          string
+	object_unwrap_path           string
+	list_unwrap_path             string
+	strip_xssi_prefix            bool
+	response_strip_prefix        string
+	response_strip_suffix        string
+	response_signature_header    string
+	response_signature_algorithm string
+	response_signature_secret    string
+	body_encoding                string
+	canonical_json               bool
+	preserve_key_order           bool
+	minimal_headers              bool
+	null_fields                  string
+	normalize_unicode            bool
+	body_form_field              string
+	aws_sign                     bool
+	aws_region                   string
+	aws_region_from_host         bool
+	aws_credential_chain         []string
+	aws_profile                  string
+	token_url                    string
+	token_request_body           string
+	token_response_path          string
+	token_expires_in_path        string
+	token_refresh_skew           int
+	token_header_prefix          string
+	token_exchange               []token_step
+	token                        string
+	token_generation             int
+	token_expiry                 time.Time
+	token_mutex                  sync.Mutex
+	cookie_jar                   bool
+	expose_cookies               bool
+	expose_rate_limit            bool
+	rate_limit                   map[string]string
+	rate_limit_mutex             sync.Mutex
+	log_error_bodies             bool
+	log_body_limit               int
+	hooks                        request_hooks
+	cache_ttl                    int
+	max_body_size                int
+	preflight                    bool
+	preflight_path               string
+	preflight_headers            map[string]string
+	cache                        map[string]cached_response
+	cache_mutex                  sync.Mutex
+	debug                        bool
 }
 
 // Make a new api client for RESTful calls
-func NewAPIClient(i_uri string, i_insecure bool, i_username string, i_password string, i_auth_header string, i_timeout int, i_id_attribute string, i_copy_keys []string, i_wro bool, i_cro bool, i_debug bool) *api_client {
-	if i_debug {
+func NewAPIClient(opt *api_client_opt) *api_client {
+	if opt.debug {
 		log.Printf("api_client.go: Constructing debug api_client\n")
 	}
 
 	/* Sane default */
-	if i_id_attribute == "" {
-		i_id_attribute = "id"
+	if opt.id_attribute == "" {
+		opt.id_attribute = "id"
+	}
+	if opt.max_redirects <= 0 {
+		opt.max_redirects = 10
+	}
+	if len(opt.gone_codes) == 0 {
+		opt.gone_codes = []int{404, 410}
+	}
+	if len(opt.created_codes) == 0 {
+		opt.created_codes = []int{201}
+	}
+	if len(opt.updated_codes) == 0 {
+		opt.updated_codes = []int{200, 204}
+	}
+	if opt.hooks == nil {
+		if opt.log_requests {
+			opt.hooks = log_request_hooks{}
+		} else {
+			opt.hooks = no_request_hooks{}
+		}
 	}
 
 	/* Remove any trailing slashes since we will append
 	   to this URL with our own root-prefixed location */
-	if strings.HasSuffix(i_uri, "/") {
-		i_uri = i_uri[:len(i_uri)-1]
+	if strings.HasSuffix(opt.uri, "/") {
+		opt.uri = opt.uri[:len(opt.uri)-1]
 	}
 
-	/* Disable TLS verification if requested */
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: i_insecure},
+	var tr *http.Transport
+	if opt.share_connections {
+		tr = shared_transport(opt)
+	} else {
+		tr = new_transport(opt)
+	}
+
+	/* With escalation, each attempt gets its own timeout (see
+	   attempt_timeout) and the client only enforces the cap */
+	timeout := opt.timeout
+	if opt.timeout > 0 && opt.timeout_retry_factor > 1 {
+		timeout = opt.timeout_max
 	}
 
 	client := api_client{
 		http_client: &http.Client{
-			Timeout:   time.Second * time.Duration(i_timeout),
+			Timeout:   time.Second * time.Duration(timeout),
 			Transport: tr,
 		},
-		uri:                   i_uri,
-		insecure:              i_insecure,
-		username:              i_username,
-		password:              i_password,
-		auth_header:           i_auth_header,
-		id_attribute:          i_id_attribute,
-		copy_keys:             i_copy_keys,
-		write_returns_object:  i_wro,
-		create_returns_object: i_cro,
-		redirects:             5,
-		debug:                 i_debug,
+		uri:                          opt.uri,
+		path_variables:               opt.path_variables,
+		insecure:                     opt.insecure,
+		username:                     opt.username,
+		password:                     opt.password,
+		auth_header:                  opt.auth_header,
+		auth_hosts:                   opt.auth_hosts,
+		max_redirects:                opt.max_redirects,
+		redirect_body_path:           opt.redirect_body_path,
+		host_overrides:               opt.host_overrides,
+		expect_continue_timeout:      opt.expect_continue_timeout,
+		share_connections:            opt.share_connections,
+		max_conns_per_host:           opt.max_conns_per_host,
+		timeout:                      opt.timeout,
+		timeout_retry_factor:         opt.timeout_retry_factor,
+		timeout_max:                  opt.timeout_max,
+		id_attribute:                 opt.id_attribute,
+		id_case:                      opt.id_case,
+		id_fallback_attribute:        opt.id_fallback_attribute,
+		id_body_field:                opt.id_body_field,
+		id_from_location:             opt.id_from_location,
+		id_changed:                   opt.id_changed,
+		gone_codes:                   opt.gone_codes,
+		created_codes:                opt.created_codes,
+		updated_codes:                opt.updated_codes,
+		trailing_slash:               opt.trailing_slash,
+		query_array_style:            opt.query_array_style,
+		self_link_path:               opt.self_link_path,
+		copy_keys:                    opt.copy_keys,
+		copy_keys_array_strategy:     opt.copy_keys_array_strategy,
+		copy_keys_empty_as_absent:    opt.copy_keys_empty_as_absent,
+		computed_keys:                opt.computed_keys,
+		sensitive_fields:             opt.sensitive_fields,
+		write_returns_object:         opt.write_returns_object,
+		create_returns_object:        opt.create_returns_object,
+		retry_max_attempts:           opt.retry_max_attempts,
+		retry_max_elapsed:            opt.retry_max_elapsed,
+		retry_wait_min:               opt.retry_wait_min,
+		retry_wait_max:               opt.retry_wait_max,
+		retry_after_headers:          opt.retry_after_headers,
+		retry_after_429_only:         opt.retry_after_429_only,
+		http2_retries:                opt.http2_retries,
+		tls_handshake_retries:        opt.tls_handshake_retries,
+		partial_json_retries:         opt.partial_json_retries,
+		strict_content_length:        opt.strict_content_length,
+		empty_response_retries:       opt.empty_response_retries,
+		prior_state_header:           opt.prior_state_header,
+		prior_state_field:            opt.prior_state_field,
+		verify_create:                opt.verify_create,
+		create_match_field:           opt.create_match_field,
+		merge_server_defaults:        opt.merge_server_defaults,
+		duplicate_keys:               opt.duplicate_keys,
+		response_content_type:        opt.response_content_type,
+		error_message_path:           opt.error_message_path,
+		success_expression:           opt.success_expression,
+		envelope_status_path:         opt.envelope_status_path,
+		envelope_success_value:       opt.envelope_success_value,
+		envelope_data_path:           opt.envelope_data_path,
+		envelope_error_path:          opt.envelope_error_path,
+		object_unwrap_path:           opt.object_unwrap_path,
+		list_unwrap_path:             opt.list_unwrap_path,
+		strip_xssi_prefix:            opt.strip_xssi_prefix,
+		response_strip_prefix:        opt.response_strip_prefix,
+		response_strip_suffix:        opt.response_strip_suffix,
+		response_signature_header:    opt.response_signature_header,
+		response_signature_algorithm: opt.response_signature_algorithm,
+		response_signature_secret:    opt.response_signature_secret,
+		body_encoding:                opt.body_encoding,
+		canonical_json:               opt.canonical_json,
+		preserve_key_order:           opt.preserve_key_order,
+		minimal_headers:              opt.minimal_headers,
+		null_fields:                  opt.null_fields,
+		normalize_unicode:            opt.normalize_unicode,
+		body_form_field:              opt.body_form_field,
+		aws_sign:                     opt.aws_sign,
+		aws_region:                   opt.aws_region,
+		aws_region_from_host:         opt.aws_region_from_host,
+		aws_credential_chain:         opt.aws_credential_chain,
+		aws_profile:                  opt.aws_profile,
+		token_url:                    opt.token_url,
+		token_request_body:           opt.token_request_body,
+		token_response_path:          opt.token_response_path,
+		token_expires_in_path:        opt.token_expires_in_path,
+		token_refresh_skew:           opt.token_refresh_skew,
+		token_header_prefix:          opt.token_header_prefix,
+		token_exchange:               opt.token_exchange,
+		cookie_jar:                   opt.cookie_jar,
+		expose_cookies:               opt.expose_cookies,
+		expose_rate_limit:            opt.expose_rate_limit,
+		rate_limit:                   make(map[string]string),
+		log_error_bodies:             opt.log_error_bodies,
+		log_body_limit:               opt.log_body_limit,
+		hooks:                        opt.hooks,
+		cache_ttl:                    opt.cache_ttl,
+		max_body_size:                opt.max_body_size,
+		preflight:                    opt.preflight,
+		preflight_path:               opt.preflight_path,
+		preflight_headers:            opt.preflight_headers,
+		cache:                        make(map[string]cached_response),
+		debug:                        opt.debug,
+	}
+
+	/* Credentials only go to the base URI's host unless
+	   told otherwise */
+	if len(client.auth_hosts) == 0 {
+		if u, err := url.Parse(opt.uri); err == nil {
+			client.auth_hosts = []string{u.Hostname()}
+		}
+	}
+
+	/* Go keeps the Authorization header when redirected to the
+	   same host or a subdomain of it, and copies an AWS signature
+	   that is only good for the URL it was made for. So each hop
+	   starts without credentials, and gets them again (signed
+	   for where it goes) only if its host may have them */
+	client.http_client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= client.max_redirects {
+			return errors.New(fmt.Sprintf("stopped after %d redirects", len(via)))
+		}
+		for _, name := range credential_headers {
+			req.Header.Del(name)
+		}
+		if !client.sends_auth_to(req.URL.Hostname()) {
+			if client.debug {
+				log.Printf("api_client.go: Not sending credentials on the redirect to %s, which is not in auth_hosts\n", req.URL.Host)
+			}
+			return nil
+		}
+
+		var body io.ReadSeeker
+		if req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+			rc, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			body = bytes.NewReader(b)
+		}
+		_, err := client.apply_credentials(req, body)
+		return err
+	}
+
+	/* Token requests share the connections but not the
+	   redirect handling above, which would add the API's own
+	   credentials to them (getting a token to do so, while the
+	   token being fetched holds token_mutex) */
+	client.token_client = &http.Client{
+		Timeout:   client.http_client.Timeout,
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= client.max_redirects {
+				return errors.New(fmt.Sprintf("stopped after %d redirects", len(via)))
+			}
+			return nil
+		},
+	}
+
+	/* Session based APIs set a cookie (on login or on any
+	   response) that must be sent back with later requests */
+	if opt.cookie_jar {
+		client.http_client.Jar, _ = cookiejar.New(nil)
 	}
 	return &client
 }
 
+/* Whether the Authorization header (or an AWS signature)
+   may be sent to host */
+func (client *api_client) sends_auth_to(host string) bool {
+	for _, allowed := range client.auth_hosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func new_transport(opt *api_client_opt) *http.Transport {
+	/* Disable TLS verification if requested */
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: opt.insecure},
+		/* Zero means no limit */
+		MaxConnsPerHost: opt.max_conns_per_host,
+		/* Otherwise Go sends Accept-Encoding: gzip */
+		DisableCompression: opt.minimal_headers,
+		/* How long to wait for the server's go-ahead to send
+		   the body when asking with Expect: 100-continue */
+		ExpectContinueTimeout: time.Duration(opt.expect_continue_timeout) * time.Second,
+	}
+
+	/* Like /etc/hosts for just this provider. Only where the
+	   connection goes changes - the request (and so the TLS
+	   server name that is verified) keeps the original host */
+	if len(opt.host_overrides) > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		tr.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil {
+				if override, ok := opt.host_overrides[host]; ok {
+					if _, _, err := net.SplitHostPort(override); err != nil {
+						override = net.JoinHostPort(override, port)
+					}
+					if opt.debug {
+						log.Printf("api_client.go: Connecting to %s instead of %s\n", override, addr)
+					}
+					addr = override
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return tr
+}
+
+/* Transports (and so their pools of connections) shared by
+   clients with share_connections set, keyed by every setting
+   that goes into a transport */
+var shared_transports = make(map[string]*http.Transport)
+var shared_transports_mutex sync.Mutex
+
+func shared_transport(opt *api_client_opt) *http.Transport {
+	key := fmt.Sprintf("%t|%d|%t|%d|%v", opt.insecure, opt.max_conns_per_host, opt.minimal_headers, opt.expect_continue_timeout, opt.host_overrides)
+
+	shared_transports_mutex.Lock()
+	defer shared_transports_mutex.Unlock()
+	tr, ok := shared_transports[key]
+	if !ok {
+		tr = new_transport(opt)
+		shared_transports[key] = tr
+	}
+	return tr
+}
+
+/* For APIs that return ids in a different case than they
+   accept, bring every id to one case so it matches in state */
+func (client *api_client) normalize_id(id string) string {
+	switch client.id_case {
+	case "lower":
+		return strings.ToLower(id)
+	case "upper":
+		return strings.ToUpper(id)
+	}
+	return id
+}
+
+/* Open a connection to the API ahead of the first request,
+   which can then skip the dial and TLS handshake. The HEAD
+   carries no credentials and its response does not matter */
+func (client *api_client) warm_connection() {
+	start := time.Now()
+	req, err := http.NewRequest("HEAD", client.uri+"/", nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = client.http_client.Do(req)
+		if err == nil {
+			/* Reading to the end lets the connection be reused */
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("api_client.go: WARNING: Unable to warm up a connection to '%s': %s\n", client.uri, err)
+	} else if client.debug {
+		log.Printf("api_client.go: Warmed up a connection to '%s' in %s\n", client.uri, time.Since(start))
+	}
+}
+
 /* Helper function that handles sending/receiving and handling
-   of HTTP data in and out.
-   TODO: Handle redirects */
+   of HTTP data in and out */
 func (client *api_client) send_request(method string, path string, data string) (string, error) {
+	body, _, err := client.send_request_full(method, path, data, nil)
+	return body, err
+}
+
+/* Same as send_request, but also hands back the final HTTP
+   response for callers that need its status or headers, and
+   sends any extra headers given. The response body has
+   already been read and closed.
+   Requests that fail in a way that may pass (see
+   should_retry) are sent again, backing off between
+   attempts, until retry_max_attempts retries or
+   retry_max_elapsed seconds - whichever comes first */
+func (client *api_client) send_request_full(method string, path string, data string, headers map[string]string) (string, *http.Response, error) {
+	return client.send_request_checked(method, path, data, headers, nil)
+}
+
+/* Same as send_request_full, but before_retry (if not nil)
+   is called before the request is sent again after a failure.
+   If it returns true, the request is not retried and the
+   failure is returned */
+func (client *api_client) send_request_checked(method string, path string, data string, headers map[string]string, before_retry func() bool) (string, *http.Response, error) {
+	/* Better to say so here than have the server turn it away
+	   after it has all been sent (or not say why) */
+	if client.max_body_size > 0 && len(data) > client.max_body_size {
+		return "", nil, errors.New(fmt.Sprintf("The body of the %s to '%s' is %d bytes, which is more than max_body_size (%d bytes). It was not sent.", method, path, len(data), client.max_body_size))
+	}
+
+	if client.cache_ttl > 0 && method != "GET" && method != "HEAD" && method != "OPTIONS" {
+		defer client.invalidate_cache(path)
+	}
+
+	if client.preflight && (method == "POST" || method == "PUT" || method == "PATCH" || method == "DELETE") {
+		if err := client.send_preflight(method, path); err != nil {
+			return "", nil, err
+		}
+	}
+
+	start := time.Now()
+	http2_retries := 0
+	tls_retries := 0
+	json_retries := 0
+	for attempt := 1; ; attempt++ {
+		body, resp, err := client.send_request_hooked(method, path, data, headers, attempt)
+
+		/* The connection went away under the request rather than
+		   the server turning it down, so send it again right away
+		   on a new connection. This does not count as an attempt */
+		if err != nil && http2_retries < client.http2_retries && is_http2_connection_error(method, err) {
+			http2_retries++
+			log.Printf("api_client.go: WARNING: %s to '%s' failed with an HTTP/2 connection error - retrying on a new connection: %s\n", method, path, err)
+			client.http_client.CloseIdleConnections()
+			attempt--
+			continue
+		}
+
+		/* The request never got as far as the server, which is
+		   often busy with a certificate rotation or restarting
+		   behind a load balancer. This does not count either */
+		if err != nil && resp == nil && tls_retries < client.tls_handshake_retries && is_tls_handshake_error(err) {
+			tls_retries++
+			wait := client.retry_wait(tls_retries)
+			log.Printf("api_client.go: WARNING: %s to '%s' failed during the TLS handshake - retrying in %s: %s\n", method, path, wait, err)
+			time.Sleep(wait)
+			attempt--
+			continue
+		}
+
+		/* The request did what it should, but a proxy cut the
+		   response short. This does not count as an attempt */
+		if err == nil && client.partial_json_retries > 0 {
+			if json_err := partial_json_error(resp, body, client.response_content_type == "force_json"); json_err != nil {
+				if json_retries >= client.partial_json_retries {
+					return body, resp, errors.New(fmt.Sprintf("The response to the %s to '%s' is still not valid JSON after %d retries (it may have been cut short on the way): %s", method, path, json_retries, json_err))
+				}
+				json_retries++
+				wait := client.retry_wait(json_retries)
+				log.Printf("api_client.go: WARNING: The response to the %s to '%s' is not valid JSON (it may have been cut short on the way) - retrying in %s: %s\n", method, path, wait, json_err)
+				time.Sleep(wait)
+				if before_retry != nil && before_retry() {
+					return body, resp, err
+				}
+				attempt--
+				continue
+			}
+		}
+
+		if err == nil || !client.should_retry(resp, err) {
+			return body, resp, err
+		}
+
+		/* A busy or down for maintenance server may say when to
+		   come back, as well as a rate limited one */
+		wait := client.retry_wait(attempt)
+		if resp != nil && (resp.StatusCode == 429 || !client.retry_after_429_only) {
+			if after, ok := client.retry_after(resp); ok {
+				wait = after
+			}
+		}
+		if client.retry_max_attempts > 0 && attempt > client.retry_max_attempts {
+			return body, resp, errors.New(fmt.Sprintf("%s (gave up after %d attempts)", err, attempt))
+		}
+		if client.retry_max_elapsed > 0 && time.Since(start)+wait > time.Duration(client.retry_max_elapsed)*time.Second {
+			return body, resp, errors.New(fmt.Sprintf("%s (gave up after %d attempts in %s)", err, attempt, time.Since(start).Round(time.Second)))
+		}
+
+		log.Printf("api_client.go: WARNING: %s to '%s' failed (attempt %d) - retrying in %s: %s\n", method, path, attempt, wait, err)
+		time.Sleep(wait)
+		if before_retry != nil && before_retry() {
+			return body, resp, err
+		}
+	}
+}
+
+/* Add query parameters to a path that may already have some.
+   A parameter with more than one value is repeated (id=1&id=2)
+   or, with query_array_style comma, sent once with its values
+   joined (id=1,2). Commas in the values themselves are escaped,
+   so they cannot be mistaken for separators */
+func (client *api_client) add_query(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, 0, len(query))
+	for _, name := range names {
+		values := make([]string, len(query[name]))
+		for i, value := range query[name] {
+			values[i] = url.QueryEscape(value)
+		}
+		if client.query_array_style == "comma" {
+			params = append(params, url.QueryEscape(name)+"="+strings.Join(values, ","))
+			continue
+		}
+		for _, value := range values {
+			params = append(params, url.QueryEscape(name)+"="+value)
+		}
+	}
+
+	if strings.Contains(path, "?") {
+		return path + "&" + strings.Join(params, "&")
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+/* Whether a response code means the object no longer
+   exists, so it can be removed from state */
+func (client *api_client) is_gone(status int) bool {
+	for _, code := range client.gone_codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+/* What a response code to a create or update says was
+   done: "created", "updated", or "" when it is in neither
+   created_codes nor updated_codes */
+func (client *api_client) write_result(status int) string {
+	for _, code := range client.created_codes {
+		if code == status {
+			return "created"
+		}
+	}
+	for _, code := range client.updated_codes {
+		if code == status {
+			return "updated"
+		}
+	}
+	return ""
+}
+
+/* Replace {name} placeholders in path with the provider's
+   path_variables. {id} is left for the object's id. Anything
+   else left unresolved is an error that says what the path
+   is for and which variables are set */
+func (client *api_client) fill_path_variables(path string, what string) (string, error) {
+	var missing []string
+	resolved := path_param_regexp.ReplaceAllStringFunc(path, func(match string) string {
+		name := match[1 : len(match)-1]
+		if name == "id" {
+			return match
+		}
+		if value, ok := client.path_variables[name]; ok {
+			return value
+		}
+		missing = append(missing, match)
+		return match
+	})
+	if len(missing) > 0 {
+		return "", errors.New(fmt.Sprintf("Unable to resolve parameter(s) %s in %s '%s'. Each must be one of the provider's path_variables (%s).", strings.Join(missing, ", "), what, path, client.path_variable_names()))
+	}
+	return resolved, nil
+}
+
+/* The names of the provider's path_variables, for errors */
+func (client *api_client) path_variable_names() string {
+	if len(client.path_variables) == 0 {
+		return "none are set"
+	}
+	names := make([]string, 0, len(client.path_variables))
+	for name := range client.path_variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "set: " + strings.Join(names, ", ")
+}
+
+/* For APIs that must be asked before a change: send an
+   OPTIONS to preflight_path ({path} is the path of the change,
+   and the default) with preflight_headers ({method} is the
+   method of the change). It must succeed, and if it says which
+   methods are allowed, method must be one of them */
+func (client *api_client) send_preflight(method string, path string) error {
+	preflight_path := path
+	if client.preflight_path != "" {
+		preflight_path = strings.Replace(client.preflight_path, "{path}", path, -1)
+	}
+	headers := make(map[string]string)
+	for name, value := range client.preflight_headers {
+		headers[name] = strings.Replace(value, "{method}", method, -1)
+	}
+
+	_, resp, err := client.send_request_full("OPTIONS", preflight_path, "", headers)
+	if err != nil {
+		return errors.New(fmt.Sprintf("The preflight OPTIONS to '%s' before the %s to '%s' failed: %s", preflight_path, method, path, err))
+	}
+
+	for _, name := range []string{"Access-Control-Allow-Methods", "Allow"} {
+		allowed := resp.Header.Get(name)
+		if allowed == "" {
+			continue
+		}
+		for _, m := range strings.Split(allowed, ",") {
+			if strings.EqualFold(strings.TrimSpace(m), method) || strings.TrimSpace(m) == "*" {
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("The preflight OPTIONS to '%s' does not allow %s (%s: %s)", preflight_path, method, name, allowed))
+	}
+	return nil
+}
+
+/* Turn a link from the API (absolute, or relative to the
+   server root or to uri) into a path to send requests to.
+   Links to anywhere other than under uri cannot be followed */
+func (client *api_client) path_from_link(link string) (string, error) {
+	base, err := url.Parse(client.uri)
+	if err != nil {
+		return "", err
+	}
+	/* Relative links are relative to all of uri, so it must
+	   end with a slash for the last segment to be kept */
+	base.Path += "/"
+	target, err := base.Parse(link)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid link '%s': %s", link, err))
+	}
+
+	base_path := strings.TrimRight(base.EscapedPath(), "/")
+	path := target.EscapedPath()
+	if !strings.EqualFold(target.Host, base.Host) || !strings.HasPrefix(path, base_path+"/") {
+		return "", errors.New(fmt.Sprintf("The link '%s' is not under the provider's uri '%s'", link, client.uri))
+	}
+
+	path = path[len(base_path):]
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+	return path, nil
+}
+
+/* Whether a failed request is worth sending again: it never
+   got a response, or the server said it is too busy or
+   briefly unable to answer. Only when retries are enabled */
+func (client *api_client) should_retry(resp *http.Response, err error) bool {
+	if client.retry_max_attempts <= 0 && client.retry_max_elapsed <= 0 {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	if client.strict_content_length && is_incomplete_response(err) {
+		return true
+	}
+	switch resp.StatusCode {
+	case 429, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+/* Whether the body read is as long as the response's
+   Content-Length says. Responses that have no body whatever
+   the header says, and those the transport decompressed (which
+   drops the header), cannot be checked */
+func check_content_length(method string, resp *http.Response, body []byte) error {
+	declared := resp.Header.Get("Content-Length")
+	if declared == "" || resp.Uncompressed || method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 {
+		return nil
+	}
+	length, err := strconv.ParseInt(declared, 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("The response has an invalid Content-Length '%s' (the response is incomplete)", declared))
+	}
+	if int64(len(body)) != length {
+		return errors.New(fmt.Sprintf("The response has %d bytes but its Content-Length is %d (the response is incomplete)", len(body), length))
+	}
+	return nil
+}
+
+/* Decompress a body sent with Content-Encoding gzip or
+   deflate. Go only does this itself for gzip, and only when it
+   asked for it, which it does not with minimal_headers or when
+   Accept-Encoding is set by hand. Decoded responses then look
+   like ones Go decoded */
+func decode_content(resp *http.Response, body []byte) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if resp.Uncompressed || len(body) == 0 || (encoding != "gzip" && encoding != "x-gzip" && encoding != "deflate") {
+		return body, nil
+	}
+
+	var reader io.ReadCloser
+	var err error
+	if encoding == "deflate" {
+		/* Properly zlib wrapped, but some servers send it raw */
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	} else {
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return body, errors.New(fmt.Sprintf("the body is not valid %s: %s", encoding, err))
+	}
+	defer reader.Close()
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return body, errors.New(fmt.Sprintf("the body is not valid %s: %s", encoding, err))
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return decoded, nil
+}
+
+/* Whether a response says it is in body_encoding:
+   application/json or any +json type such as
+   application/hal+json, or with yaml, a YAML type */
+func (client *api_client) is_expected_content_type(resp *http.Response) bool {
+	media_type, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if client.body_encoding == "yaml" {
+		return media_type == "application/yaml" || media_type == "application/x-yaml" || media_type == "text/yaml" || strings.HasSuffix(media_type, "+yaml")
+	}
+	return media_type == "application/json" || strings.HasSuffix(media_type, "+json")
+}
+
+/* A body that was cut short, or does not match its length */
+func is_incomplete_response(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "(the response is incomplete)")
+}
+
+/* Why a successful response that should be JSON (it says it
+   is, looks like it, or force says every response is) cannot
+   be parsed, or nil. Empty bodies are left to
+   empty_response_retries */
+func partial_json_error(resp *http.Response, body string, force bool) error {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" {
+		return nil
+	}
+	if !force && !strings.Contains(resp.Header.Get("Content-Type"), "json") && trimmed[0] != '{' && trimmed[0] != '[' {
+		return nil
+	}
+	var parsed interface{}
+	return json.Unmarshal([]byte(trimmed), &parsed)
+}
+
+/* HTTP/2 errors that mean the connection (or just the
+   stream) was torn down by the server, such as a GOAWAY
+   while draining connections or a stream reset under load */
+var http2_connection_errors = []string{
+	"http2: server sent GOAWAY",
+	"http2: client connection lost",
+	"stream error: stream ID",
+}
+
+/* Whether a request that failed with err can safely be sent
+   again on a new connection. Any of the errors above may
+   come after the server has acted on the request, so only
+   methods that can be repeated are retried for them. Others
+   (a POST that would create a second object) are only
+   retried when the server refused the stream, which means it
+   did not process the request */
+func is_http2_connection_error(method string, err error) bool {
+	if strings.Contains(err.Error(), "REFUSED_STREAM") {
+		return true
+	}
+	if !is_idempotent(method) {
+		return false
+	}
+	for _, message := range http2_connection_errors {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Methods that have the same effect however many times they
+   are sent */
+func is_idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+/* Prefixed to the error of a request whose TLS handshake
+   failed (see send_request_attempt), since the same error (a
+   reset, say) after the request was sent means something else */
+const tls_handshake_failed = "TLS handshake failed: "
+
+/* TLS handshakes the server (or something in front of it)
+   broke off or did not finish in time. A handshake the server
+   refused with an alert (such as bad_certificate or
+   protocol_version), or that failed because the certificate
+   cannot be trusted, will fail the same way again */
+var tls_handshake_errors = []string{
+	"timeout",
+	"deadline exceeded",
+	"connection reset by peer",
+	"EOF",
+}
+
+func is_tls_handshake_error(err error) bool {
+	message := err.Error()
+	if strings.Contains(message, "TLS handshake timeout") {
+		return true
+	}
+	if !strings.Contains(message, tls_handshake_failed) || strings.Contains(message, "remote error: tls:") {
+		return false
+	}
+	for _, cause := range tls_handshake_errors {
+		if strings.Contains(message, cause) {
+			return true
+		}
+	}
+	return false
+}
+
+/* How retry_after_headers can be read: a number of seconds
+   or milliseconds to wait, or when to try again as a Unix time
+   in seconds or milliseconds */
+var retry_after_formats = []string{"seconds", "milliseconds", "epoch", "epoch_ms"}
+
+/* How long the server asked to be left alone for, from the
+   first of retry_after_headers it sent (in order of name),
+   then a standard Retry-After of seconds or an HTTP date */
+func (client *api_client) retry_after(resp *http.Response) (time.Duration, bool) {
+	names := make([]string, 0)
+	for name := range client.retry_after_headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		val := strings.TrimSpace(resp.Header.Get(name))
+		if val == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			log.Printf("api_client.go: WARNING: Ignoring %s header '%s' that is not a number\n", name, val)
+			continue
+		}
+		var wait time.Duration
+		switch client.retry_after_headers[name] {
+		case "seconds":
+			wait = time.Duration(n * float64(time.Second))
+		case "milliseconds":
+			wait = time.Duration(n * float64(time.Millisecond))
+		case "epoch":
+			wait = time.Until(time.Unix(0, int64(n*float64(time.Second))))
+		case "epoch_ms":
+			wait = time.Until(time.Unix(0, int64(n*float64(time.Millisecond))))
+		default:
+			continue
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	if val := strings.TrimSpace(resp.Header.Get("Retry-After")); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if when, err := http.ParseTime(val); err == nil {
+			wait := time.Until(when)
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, true
+		}
+	}
+	return 0, false
+}
+
+/* Exponential backoff from retry_wait_min, capped at
+   retry_wait_max */
+func (client *api_client) retry_wait(attempt int) time.Duration {
+	wait := time.Duration(client.retry_wait_min) * time.Second
+	max := time.Duration(client.retry_wait_max) * time.Second
+	for i := 1; i < attempt && (max <= 0 || wait < max); i++ {
+		wait *= 2
+	}
+	if max > 0 && wait > max {
+		wait = max
+	}
+	return wait
+}
+
+/* How long the given attempt at a request may take when
+   timeout_retry_factor is set: timeout, multiplied by the
+   factor for each retry before it, capped at timeout_max.
+   Zero means the client's own timeout applies */
+func (client *api_client) attempt_timeout(attempt int) time.Duration {
+	if client.timeout <= 0 || client.timeout_retry_factor <= 1 {
+		return 0
+	}
+	timeout := float64(client.timeout)
+	max := float64(client.timeout_max)
+	for i := 1; i < attempt && (max <= 0 || timeout < max); i++ {
+		timeout *= client.timeout_retry_factor
+	}
+	if max > 0 && timeout > max {
+		timeout = max
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+/* One attempt at a request, which may take more than one
+   round trip to refresh an expired token. A timeout (if not
+   zero) covers the whole attempt, reading the body included */
+func (client *api_client) send_request_attempt(method string, path string, data string, headers map[string]string, timeout time.Duration) (ret_body string, ret_resp *http.Response, ret_err error) {
 	full_uri := client.uri + path
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	/* Note a failed TLS handshake, so its error can be told apart
+	   from the same error once the request was on its way */
+	var handshake_err atomic.Value
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				handshake_err.Store(err.Error())
+			}
+		},
+	})
+	token_refreshed := false
+	body_redirects := 0
+
+	/* Without debug, still show what the server said when a
+	   request fails. Secrets in the body are masked */
+	response_body := ""
+	if client.log_error_bodies && !client.debug {
+		defer func() {
+			if ret_err != nil && ret_resp != nil {
+				log.Printf("api_client.go: %s to '%s' failed with response code %d. BODY:\n%s\n", method, path, ret_resp.StatusCode, client.log_body(redact_body(response_body)))
+			}
+		}()
+	}
+
+	if client.debug {
+		log.Printf("api_client.go: method='%s', path='%s', full uri (derived)='%s', data='%s'\n", method, path, full_uri, client.log_body(data))
+	}
+
+	req, token_generation, err := client.build_request(method, full_uri, data, headers)
+	if err != nil {
+		return "", nil, err
+	}
+
+	/* 3xx redirects are followed by the http client (see
+	   CheckRedirect). Each time round is a token refresh or a
+	   redirect in the body, which are limited in their own ways */
+	for {
+		resp, err := client.http_client.Do(req.WithContext(ctx))
+
+		if err != nil {
+			if handshake_err.Load() != nil {
+				err = errors.New(tls_handshake_failed + err.Error())
+			}
+			//log.Printf("api_client.go: Error detected: %s\n", err)
+			return "", nil, err
+		}
+
+		/* Read the body to the end and close it before anything
+		   else, whatever the response, so that no path (errors
+		   and retries included) keeps the connection from going
+		   back to the pool.
+		   ReadAll reads chunked responses (no Content-Length) to
+		   the final chunk. The client's timeout covers reading the
+		   whole body, so a body that trickles in past the timeout
+		   fails here rather than being returned truncated */
+		bodyBytes, err2 := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if client.debug {
+			log.Printf("api_client.go: Response code: %d\n", resp.StatusCode)
+			log.Printf("api_client.go: Response headers:\n")
+			for name, headers := range resp.Header {
+				for _, h := range headers {
+					log.Printf("api_client.go:   %v: %v", name, h)
+				}
+			}
+		}
+
+		client.record_rate_limit(resp.Header)
+
+		if err2 != nil {
+			return "", resp, errors.New(fmt.Sprintf("Error reading response body after %d bytes (the response is incomplete): %s", len(bodyBytes), err2))
+		}
+		if client.strict_content_length {
+			if err := check_content_length(method, resp, bodyBytes); err != nil {
+				return "", resp, err
+			}
+		}
+		/* Error responses too, so their messages are readable */
+		if bodyBytes, err2 = decode_content(resp, bodyBytes); err2 != nil {
+			return "", resp, errors.New(fmt.Sprintf("Unable to decode the response (HTTP %d): %s", resp.StatusCode, err2))
+		}
+		body := client.strip_response(string(bodyBytes))
+		response_body = body
+
+		failed := resp.StatusCode == 404 || resp.StatusCode < 200 || resp.StatusCode >= 303
+		if client.success_expression != "" {
+			succeeded, err := client.meets_success_expression(resp, body)
+			if err != nil {
+				return "", resp, err
+			}
+			failed = !succeeded
+		}
+
+		if resp.StatusCode == 401 && client.token_url != "" && !token_refreshed {
+			/* The token has probably expired. Get a new one (or the one
+			   another request already got) and try once more */
+			if client.debug {
+				log.Printf("api_client.go: Received 401 - refreshing token and retrying\n")
+			}
+			token_refreshed = true
+			if err := client.refresh_token(token_generation); err != nil {
+				return "", resp, err
+			}
+			if req, token_generation, err = client.build_request(method, full_uri, data, headers); err != nil {
+				return "", resp, err
+			}
+		} else if failed {
+			if message, ok := client.error_message(body); ok {
+				return "", resp, errors.New(fmt.Sprintf("%s (HTTP %d)", message, resp.StatusCode))
+			}
+			if problem, ok := problem_message(resp, bodyBytes, client.response_content_type == "force_json"); ok {
+				return "", resp, errors.New(fmt.Sprintf("Unexpected response code '%d': %s", resp.StatusCode, problem))
+			}
+			if client.success_expression != "" {
+				return "", resp, errors.New(fmt.Sprintf("The response (HTTP %d) does not meet success_expression: %s", resp.StatusCode, body))
+			}
+			return "", resp, errors.New(fmt.Sprintf("Unexpected response code '%d': %s", resp.StatusCode, body))
+		} else {
+			if client.debug {
+				log.Printf("api_client.go: BODY:\n%s\n", client.log_body(body))
+			}
+			/* A proxy's HTML page sent with a 200 is not the object */
+			if client.response_content_type == "strict" && strings.TrimSpace(body) != "" && !client.is_expected_content_type(resp) {
+				want := "JSON"
+				if client.body_encoding == "yaml" {
+					want = "YAML"
+				}
+				return "", resp, errors.New(fmt.Sprintf("The response to %s '%s' has a Content-Type of '%s', not %s (response_content_type is strict). If the API labels its JSON wrongly, use force_json instead: %s", method, path, resp.Header.Get("Content-Type"), want, client.log_body(body)))
+			}
+			/* Must see the exact bytes the server signed */
+			if err := client.verify_response_signature(resp.Header, bodyBytes); err != nil {
+				return "", resp, err
+			}
+			if client.body_encoding == "yaml" && strings.TrimSpace(body) != "" {
+				if body, err = yaml_to_json(body); err != nil {
+					return "", resp, errors.New(fmt.Sprintf("Unable to parse response as YAML: %s", err))
+				}
+			}
+			if client.duplicate_keys != "" {
+				if key, found := find_duplicate_key(body); found {
+					if client.duplicate_keys == "error" {
+						return "", resp, errors.New(fmt.Sprintf("The response to %s '%s' has the key '%s' more than once, so it cannot be trusted", method, path, key))
+					}
+					log.Printf("api_client.go: WARNING: The response to %s '%s' has the key '%s' more than once. Only the last one is used\n", method, path, key)
+				}
+			}
+			/* Some APIs ask to be sent elsewhere in the body of a
+			   success rather than with a 3xx */
+			if location := client.body_redirect(body); location != "" {
+				if body_redirects >= client.max_redirects {
+					return "", resp, errors.New(fmt.Sprintf("stopped after %d redirects (redirect_body_path)", body_redirects))
+				}
+				next, err := req.URL.Parse(location)
+				if err != nil {
+					return "", resp, errors.New(fmt.Sprintf("The response to %s '%s' redirects to '%s', which is not a valid URL: %s", method, path, location, err))
+				}
+				if client.debug {
+					log.Printf("api_client.go: Response body redirects to %s\n", next)
+				}
+				body_redirects++
+				full_uri = next.String()
+				if req, token_generation, err = client.build_request(method, full_uri, data, headers); err != nil {
+					return "", resp, err
+				}
+				continue
+			}
+			body, err = client.unwrap_envelope(body)
+			return body, resp, err
+		}
+	}
+}
+
+/* Where the body of a successful response says to go
+   instead, at redirect_body_path. "" if it does not redirect */
+func (client *api_client) body_redirect(body string) string {
+	if client.redirect_body_path == "" {
+		return ""
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+		return ""
+	}
+	location, _ := get_path(decoded, client.redirect_body_path)
+	s, _ := location.(string)
+	return s
+}
+
+/* Decode a response. With preserve_key_order, objects are
+   decoded as *ordered_map so that parts of the response that
+   are encoded again keep the order the API sent */
+func (client *api_client) decode_json(body string) (interface{}, error) {
+	if client.preserve_key_order {
+		return decode_ordered(body)
+	}
+	var parsed interface{}
+	err := json.Unmarshal([]byte(body), &parsed)
+	return parsed, err
+}
+
+/* Evaluate success_expression (JMESPath) against an object
+   with the response's status, headers (lower case names, first
+   value only) and body (parsed if it is JSON, otherwise the
+   text). The response is a success if the result is truthy,
+   as JMESPath sees it: anything but false, null and empty
+   strings, arrays and objects */
+func (client *api_client) meets_success_expression(resp *http.Response, body string) (bool, error) {
+	headers := make(map[string]interface{})
+	for name, values := range resp.Header {
+		headers[strings.ToLower(name)] = values[0]
+	}
+	var parsed interface{} = body
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err == nil {
+		parsed = value
+	}
+
+	result, err := jmespath.Search(client.success_expression, map[string]interface{}{
+		"status":  float64(resp.StatusCode),
+		"headers": headers,
+		"body":    parsed,
+	})
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Invalid success_expression '%s': %s", client.success_expression, err))
+	}
+	if client.debug {
+		log.Printf("api_client.go: success_expression evaluated to %v\n", result)
+	}
+
+	switch v := result.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		return v != "", nil
+	case []interface{}:
+		return len(v) > 0, nil
+	case map[string]interface{}:
+		return len(v) > 0, nil
+	}
+	return true, nil
+}
+
+/* A JSON body with its sensitive_fields masked. Anything
+   else, and JSON without any of them, is returned as it is */
+func (client *api_client) mask_body(body string) string {
+	if len(client.sensitive_fields) == 0 {
+		return body
+	}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return body
+	}
+	value, masked := mask_paths(value, client.sensitive_fields)
+	if !masked {
+		return body
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(value)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+/* A copy of decoded JSON with its sensitive_fields masked */
+func (client *api_client) mask_value(value interface{}) interface{} {
+	value, _ = mask_paths(value, client.sensitive_fields)
+	return value
+}
+
+/* A body as it should be logged: cut short after
+   log_body_limit bytes (without splitting a character), and
+   saying so, when there is a limit */
+func (client *api_client) log_body(body string) string {
+	body = client.mask_body(body)
+	if client.log_body_limit <= 0 || len(body) <= client.log_body_limit {
+		return body
+	}
+	cut := client.log_body_limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (truncated, %d of %d bytes shown)", body[:cut], cut, len(body))
+}
+
+/* Some APIs wrap JSON in something that keeps it from being
+   parsed, such as the )]}' prefix used to protect against
+   XSSI. Strip that before the body is used */
+func (client *api_client) strip_response(body string) string {
+	if client.strip_xssi_prefix && strings.HasPrefix(body, ")]}'") {
+		body = strings.TrimPrefix(strings.TrimPrefix(body, ")]}'"), ",")
+		body = strings.TrimLeft(body, "\r\n")
+	}
+	if client.response_strip_prefix != "" {
+		body = strings.TrimPrefix(body, client.response_strip_prefix)
+	}
+	if client.response_strip_suffix != "" {
+		body = strings.TrimSuffix(strings.TrimRight(body, "\r\n"), client.response_strip_suffix)
+	}
+	return body
+}
+
+/* The human readable message at error_message_path in an
+   error response. A message that is not a string (such as a
+   list of errors) is given as JSON */
+func (client *api_client) error_message(body string) (string, bool) {
+	if client.error_message_path == "" {
+		return "", false
+	}
+	if client.body_encoding == "yaml" {
+		var err error
+		if body, err = yaml_to_json(body); err != nil {
+			return "", false
+		}
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return "", false
+	}
+	val, ok := get_path(parsed, client.error_message_path)
+	if !ok || val == nil {
+		return "", false
+	}
+	if message, ok := val.(string); ok {
+		return message, message != ""
+	}
+	b, _ := json.Marshal(val)
+	return string(b), true
+}
+
+/* Errors sent as RFC 7807 application/problem+json are
+   summarized as "<title>: <detail> (status <n>)" instead of
+   the raw body. With any_type, a problem is found in the body
+   whatever its Content-Type says. False if the response is not
+   a problem */
+func problem_message(resp *http.Response, body []byte, any_type bool) (string, bool) {
+	media_type, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !any_type && (err != nil || media_type != "application/problem+json") {
+		return "", false
+	}
+
+	var problem struct {
+		Title  string      `json:"title"`
+		Detail string      `json:"detail"`
+		Status json.Number `json:"status"`
+	}
+	if err := json.Unmarshal(body, &problem); err != nil || (problem.Title == "" && problem.Detail == "") {
+		return "", false
+	}
+
+	message := problem.Title
+	if problem.Detail != "" {
+		if message != "" {
+			message += ": "
+		}
+		message += problem.Detail
+	}
+	status := problem.Status.String()
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	return fmt.Sprintf("%s (status %s)", message, status), true
+}
+
+/* Used when the caller needs the object back in the response.
+   Eventually consistent APIs may briefly answer with success
+   and an empty body, so resend the request (up to
+   empty_response_retries times, backing off as retry_wait
+   says) until there is a body.
+   before_retry is as for send_request_checked */
+func (client *api_client) send_request_expecting_body(method string, path string, data string, headers map[string]string, before_retry func() bool) (string, *http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		body, resp, err := client.send_request_checked(method, path, data, headers, before_retry)
+		if err != nil || strings.TrimSpace(body) != "" || attempt >= client.empty_response_retries {
+			return body, resp, err
+		}
+		wait := client.retry_wait(attempt + 1)
+		if client.debug {
+			log.Printf("api_client.go: %s to '%s' returned an empty body - retrying in %s (%d of %d)\n", method, path, wait, attempt+1, client.empty_response_retries)
+		}
+		time.Sleep(wait)
+		if before_retry != nil && before_retry() {
+			return body, resp, err
+		}
+	}
+}
+
+/* Build a fully authenticated and signed request. Since the
+   request body can only be read once, this is called again
+   whenever a request must be resent. The token generation
+   used for the Authorization header is also returned so a
+   401 can tell refresh_token which token went stale */
+func (client *api_client) build_request(method string, full_uri string, data string, headers map[string]string) (*http.Request, int, error) {
 	var req *http.Request
 	var err error
+	token_generation := 0
 
-	if client.debug {
-		log.Printf("api_client.go: method='%s', path='%s', full uri (derived)='%s', data='%s'\n", method, path, full_uri, data)
+	/* Whatever is sent here is also what gets signed */
+	if client.canonical_json && data != "" && client.body_encoding != "yaml" && client.body_form_field == "" {
+		if canonical, err := canonical_json(data); err == nil {
+			data = canonical
+		} else if client.debug {
+			log.Printf("api_client.go: Not canonicalizing body that is not valid JSON: %s\n", err)
+		}
 	}
 
 	buffer := bytes.NewReader([]byte(data))
@@ -92,29 +1592,72 @@ func (client *api_client) send_request(method string, path string, data string)
 	} else {
 		req, err = http.NewRequest(method, full_uri, buffer)
 
-		if err == nil {
-			req.Header.Set("Content-Type", "application/json")
+		if err == nil && !client.minimal_headers {
+			if client.body_form_field != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else if client.body_encoding == "yaml" {
+				req.Header.Set("Content-Type", "application/yaml")
+			} else {
+				req.Header.Set("Content-Type", "application/json")
+			}
 		}
 	}
 
 	if err != nil {
 		log.Fatal(err)
-		return "", err
+		return nil, 0, err
 	}
 
-	if client.debug {
-		log.Printf("api_client.go: Sending HTTP request to %s...\n", req.URL)
+	/* Every header is set before the request is signed, so the
+	   signature covers the request exactly as it is sent:
+	   first the content headers and those ours or the caller's,
+	   then credentials, and only then the signature */
+
+	/* Let the server turn the request down before the body is sent */
+	if data != "" && client.expect_continue_timeout > 0 {
+		req.Header.Set("Expect", "100-continue")
 	}
 
-	/* Allow for tokens or other pre-created secrets */
-	if client.auth_header != "" {
-		req.Header.Set("Authorization", client.auth_header)
-	} else if client.username != "" && client.password != "" {
-		/* ... and fall back to basic auth if configured */
-		req.SetBasicAuth(client.username, client.password)
+	/* Go adds a User-Agent of its own unless it is set to empty */
+	if client.minimal_headers {
+		req.Header.Set("User-Agent", "")
+	}
+
+	/* Add drench-specific account header */
+	if account := os.Getenv("DRENCH_ACCOUNT"); account != "" || !client.minimal_headers {
+		req.Header.Set("x-drench-account", account)
+	}
+
+	for name, value := range headers {
+		/* Go sends req.Host, never a Host header */
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	/* A templated path can point the request somewhere else
+	   entirely, so only the allowed hosts get credentials */
+	if client.sends_auth_to(req.URL.Hostname()) {
+		/* The signer sets the body it is given on the request, and
+		   Go will not follow a 307 or 308 for a request with a body
+		   it cannot send again, so a request with none is signed
+		   without one */
+		var signed_body io.ReadSeeker
+		if data != "" {
+			signed_body = buffer
+		}
+		if token_generation, err = client.apply_credentials(req, signed_body); err != nil {
+			return nil, 0, err
+		}
+	} else if client.debug {
+		log.Printf("api_client.go: Not sending credentials to %s, which is not in auth_hosts\n", req.URL.Host)
 	}
 
+	/* Logged last, so this is what is sent */
 	if client.debug {
+		log.Printf("api_client.go: Sending HTTP request to %s...\n", req.URL)
 		log.Printf("api_client.go: Request headers:\n")
 		for name, headers := range req.Header {
 			for _, h := range headers {
@@ -125,60 +1668,311 @@ func (client *api_client) send_request(method string, path string, data string)
 		log.Printf("api_client.go: BODY:\n")
 		body := "<none>"
 		if req.Body != nil {
-			body = string(data)
+			body = client.log_body(string(data))
 		}
 		log.Printf("%s\n", body)
 	}
 
-	/* Add drench-specific account header */
-	req.Header.Set("x-drench-account", os.Getenv("DRENCH_ACCOUNT"))
+	return req, token_generation, nil
+}
 
-	/* Sign request for aws api gateway */
-	_, err = v4.NewSigner(credentials.NewSharedCredentials("", "")).Sign( // searches default paths when passed empty strings
-		req, buffer, "execute-api", "us-east-1", time.Now()) //FIXME make region and service dynamic
-	if err != nil {
-		return "", err
-	}
+/* The headers that carry credentials or an AWS signature */
+var credential_headers = []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"}
 
-	for num_redirects := client.redirects; num_redirects >= 0; num_redirects-- {
-		resp, err := client.http_client.Do(req)
+/* Add credentials for the request's URL, once every other
+   header is set: a token, authorization_header or BASIC auth,
+   and then an AWS signature over the request (body is what is
+   sent, or nil). Returns the generation of the token used */
+func (client *api_client) apply_credentials(req *http.Request, body io.ReadSeeker) (int, error) {
+	token_generation := 0
 
+	/* Allow for tokens or other pre-created secrets */
+	if client.token_url != "" {
+		/* A token from the token endpoint takes precedence over all */
+		var token string
+		var err error
+		token, token_generation, err = client.get_token()
 		if err != nil {
-			//log.Printf("api_client.go: Error detected: %s\n", err)
-			return "", err
+			return 0, err
 		}
+		req.Header.Set("Authorization", client.token_header_prefix+token)
+	} else if client.auth_header != "" {
+		req.Header.Set("Authorization", client.auth_header)
+	} else if client.username != "" && client.password != "" {
+		/* ... and fall back to basic auth if configured */
+		req.SetBasicAuth(client.username, client.password)
+	}
 
-		if client.debug {
-			log.Printf("api_client.go: Response code: %d\n", resp.StatusCode)
-			log.Printf("api_client.go: Response headers:\n")
-			for name, headers := range resp.Header {
-				for _, h := range headers {
-					log.Printf("api_client.go:   %v: %v", name, h)
+	/* Sign request for aws api gateway. Note that this replaces
+	   any Authorization header set above */
+	if client.aws_sign {
+		creds, err := client.aws_credentials()
+		if err != nil {
+			return 0, err
+		}
+		_, err = v4.NewSigner(creds).Sign(
+			req, body, "execute-api", client.signing_region(req.URL.Hostname()), time.Now()) //FIXME make service dynamic
+		if err != nil {
+			return 0, err
+		}
+	}
+	return token_generation, nil
+}
+
+/* Where AWS credentials can come from, for aws_credential_chain */
+var aws_credential_sources = []string{"env", "shared", "ec2_role"}
+
+/* The credentials to sign requests with: the first of the
+   sources in aws_credential_chain that has any, in that
+   order. Without a chain, only the shared credentials file
+   is used (the default paths, and the profile named by
+   aws_profile or else AWS_PROFILE) */
+func (client *api_client) aws_credentials() (*credentials.Credentials, error) {
+	chain := client.aws_credential_chain
+	if len(chain) == 0 {
+		chain = []string{"shared"}
+	}
+
+	providers := make([]credentials.Provider, 0)
+	for _, source := range chain {
+		switch source {
+		case "env":
+			providers = append(providers, &credentials.EnvProvider{})
+		case "shared":
+			/* Searches the default paths when passed an empty string */
+			providers = append(providers, &credentials.SharedCredentialsProvider{Profile: client.aws_profile})
+		case "ec2_role":
+			sess, err := session.NewSession()
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess)})
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown AWS credential source '%s' in aws_credential_chain. Use one of: %s", source, strings.Join(aws_credential_sources, ", ")))
+		}
+	}
+
+	if len(providers) == 1 {
+		return credentials.NewCredentials(providers[0]), nil
+	}
+	return credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true}), nil
+}
+
+/* The region to sign a request to host for. Regional API
+   Gateway hosts (<id>.execute-api.<region>.amazonaws.com)
+   name it, otherwise the configured region is used */
+func (client *api_client) signing_region(host string) string {
+	if client.aws_region_from_host {
+		if m := aws_region_host_regexp.FindStringSubmatch(host); m != nil {
+			return m[1]
+		}
+	}
+	if client.aws_region != "" {
+		return client.aws_region
+	}
+	return "us-east-1"
+}
+
+/* Some APIs always respond with success and report the real
+   result in an envelope such as {"status": "...", "data": ...}.
+   If an envelope is configured, fail when the status does not
+   match the success value and hand back only the data */
+func (client *api_client) unwrap_envelope(body string) (string, error) {
+	if client.envelope_status_path == "" && client.envelope_data_path == "" {
+		return body, nil
+	}
+
+	envelope, err := client.decode_json(body)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to parse response envelope as JSON: %s", err))
+	}
+
+	if client.envelope_status_path != "" {
+		status, ok := get_path(envelope, client.envelope_status_path)
+		if !ok || fmt.Sprintf("%v", status) != client.envelope_success_value {
+			message := body
+			if client.envelope_error_path != "" {
+				if val, ok := get_path(envelope, client.envelope_error_path); ok {
+					message = fmt.Sprintf("%v", val)
 				}
 			}
+			return "", errors.New(fmt.Sprintf("API reported failure (%s='%v'): %s", client.envelope_status_path, status, message))
 		}
+	}
 
-		bodyBytes, err2 := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	if client.envelope_data_path == "" {
+		return body, nil
+	}
 
-		if err2 != nil {
-			return "", err2
+	data, ok := get_path(envelope, client.envelope_data_path)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Response envelope does not contain data at '%s'", client.envelope_data_path))
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	if client.debug {
+		log.Printf("api_client.go: Unwrapped data from response envelope:\n%s\n", client.log_body(string(b)))
+	}
+	return string(b), nil
+}
+
+/* Some APIs wrap one object differently from a list of
+   them, such as {"widget": {...}} and {"widgets": [...]}.
+   Hand back the object at object_unwrap_path in a response
+   about one object (list_unwrap_path is the default
+   results_key for lists) */
+func (client *api_client) unwrap_object(body string) (string, error) {
+	if client.object_unwrap_path == "" {
+		return body, nil
+	}
+
+	parsed, err := client.decode_json(body)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to parse response as JSON to find the object at '%s': %s", client.object_unwrap_path, err))
+	}
+	object, ok := get_path(parsed, client.object_unwrap_path)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("The response does not contain an object at '%s': %s", client.object_unwrap_path, body))
+	}
+	b, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/* Remember the most recent rate limit information the API
+   sent. The quota belongs to the API rather than to any one
+   object, so this is kept on the client */
+func (client *api_client) record_rate_limit(header http.Header) {
+	client.rate_limit_mutex.Lock()
+	defer client.rate_limit_mutex.Unlock()
+
+	for _, name := range rate_limit_headers {
+		if val := header.Get(name); val != "" {
+			if client.debug {
+				log.Printf("api_client.go: Rate limit %s: %s\n", name, val)
+			}
+			client.rate_limit[strings.ToLower(name)] = val
 		}
-		body := string(bodyBytes)
+	}
+}
 
-		if resp.StatusCode == 301 || resp.StatusCode == 302 {
-			//Redirecting... decrement num_redirects and proceed to the next loop
-			//uri = URI.parse(rsp['Location'])
-		} else if resp.StatusCode == 404 || resp.StatusCode < 200 || resp.StatusCode >= 303 {
-			return "", errors.New(fmt.Sprintf("Unexpected response code '%d': %s", resp.StatusCode, body))
-		} else {
+/* A copy of the rate limit information last sent by the API */
+func (client *api_client) get_rate_limit() map[string]string {
+	client.rate_limit_mutex.Lock()
+	defer client.rate_limit_mutex.Unlock()
+
+	rate_limit := make(map[string]string)
+	for k, v := range client.rate_limit {
+		rate_limit[k] = v
+	}
+	return rate_limit
+}
+
+/* A response kept for cache_ttl seconds */
+type cached_response struct {
+	body    string
+	expires time.Time
+}
+
+/* Same as send_request, but with cache_ttl set, a response
+   to the same request within cache_ttl seconds is used again
+   rather than asking the API. Only for reads that need not
+   see changes made since (such as by data sources), since
+   requests that change objects only clear what they touch */
+func (client *api_client) send_request_cached(method string, path string, data string) (string, error) {
+	if client.cache_ttl <= 0 {
+		return client.send_request(method, path, data)
+	}
+
+	key := method + " " + path + "\n" + data
+	client.cache_mutex.Lock()
+	cached, ok := client.cache[key]
+	client.cache_mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if client.debug {
+			log.Printf("api_client.go: Using cached response to %s '%s'\n", method, path)
+		}
+		return cached.body, nil
+	}
+
+	body, err := client.send_request(method, path, data)
+	if err == nil {
+		client.cache_mutex.Lock()
+		client.cache[key] = cached_response{body: body, expires: time.Now().Add(time.Duration(client.cache_ttl) * time.Second)}
+		client.cache_mutex.Unlock()
+	}
+	return body, err
+}
+
+/* Forget cached responses for path, anything under it and
+   anything it is under, such as the collection an object is
+   created in or deleted from */
+func (client *api_client) invalidate_cache(path string) {
+	changed := strings.TrimRight(strings.SplitN(path, "?", 2)[0], "/")
+
+	client.cache_mutex.Lock()
+	defer client.cache_mutex.Unlock()
+	for key := range client.cache {
+		cached_path := strings.SplitN(key, " ", 2)[1]
+		cached_path = strings.TrimRight(strings.SplitN(strings.SplitN(cached_path, "\n", 2)[0], "?", 2)[0], "/")
+		if cached_path == changed || strings.HasPrefix(cached_path, changed+"/") || strings.HasPrefix(changed, cached_path+"/") {
 			if client.debug {
-				log.Printf("api_client.go: BODY:\n%s\n", body)
+				log.Printf("api_client.go: Clearing cached response for '%s' after a change to '%s'\n", cached_path, path)
 			}
-			return body, nil
+			delete(client.cache, key)
+		}
+	}
+}
+
+/* The cookies the cookie jar would send to the API */
+func (client *api_client) get_cookies() map[string]string {
+	cookies := make(map[string]string)
+	if client.http_client.Jar == nil {
+		return cookies
+	}
+	if u, err := url.Parse(client.uri + "/"); err == nil {
+		for _, c := range client.http_client.Jar.Cookies(u) {
+			cookies[c.Name] = c.Value
 		}
+	}
+	return cookies
+}
 
-	} //End loop through redirect attempts
+/* For APIs that sign their responses, compute the HMAC of the
+   raw response body and compare it to the one the server sent.
+   The header may hold the signature as hex or base64, with or
+   without an "algorithm=" prefix */
+func (client *api_client) verify_response_signature(header http.Header, body []byte) error {
+	if client.response_signature_header == "" {
+		return nil
+	}
 
-	return "", errors.New("Error - too many redirects!")
+	new_hash, ok := response_signature_algorithms[client.response_signature_algorithm]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unsupported response signature algorithm '%s'", client.response_signature_algorithm))
+	}
+
+	sent := header.Get(client.response_signature_header)
+	if sent == "" {
+		return errors.New(fmt.Sprintf("Response signature verification failed: the response has no %s header", client.response_signature_header))
+	}
+	if prefix := signature_prefix_regexp.FindString(sent); prefix != "" && strings.Trim(sent[len(prefix):], "=") != "" {
+		sent = sent[len(prefix):]
+	}
+
+	mac := hmac.New(new_hash, []byte(client.response_signature_secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	if decoded, err := hex.DecodeString(sent); err == nil && hmac.Equal(decoded, expected) {
+		return nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(sent); err == nil && hmac.Equal(decoded, expected) {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Response signature verification failed: the %s header does not match the %s signature of the response body", client.response_signature_header, client.response_signature_algorithm))
 }
@@ -1,13 +1,38 @@
 package restapi
 
 import (
+  "bytes"
+  "compress/gzip"
+  "compress/zlib"
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/tls"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/aws/aws-sdk-go/aws/signer/v4"
+  "io/ioutil"
   "log"
   "testing"
+  "net"
   "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "reflect"
+  "strings"
+  "sync"
+  "sync/atomic"
   "time"
 )
 
 var api_client_server *http.Server
+var token_requests int32
+var empty_requests int32
+var flaky_requests int32
+var counted_requests int32
+var token_authorization atomic.Value
 
 func TestAPIClient(t *testing.T) {
   debug := false
@@ -16,7 +41,13 @@ func TestAPIClient(t *testing.T) {
   setup_api_client_server()
 
   /* Notice the intentional trailing / */
-  client := NewAPIClient ("http://127.0.0.1:8080/", false, "", "", "", 2, "id", make([]string, 0), false, false, debug)
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    id_attribute: "id",
+    copy_keys: make([]string, 0),
+    debug: debug,
+  })
 
   var res string
   var err error
@@ -38,10 +69,1961 @@ func TestAPIClient(t *testing.T) {
   if debug { log.Println("client_test.go: Done") }
 }
 
-func setup_api_client_server () {
+func TestAPIClientEnvelope(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    envelope_status_path: "status",
+    envelope_success_value: "success",
+    envelope_data_path: "data",
+    envelope_error_path: "error.message",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing envelope data is unwrapped on success\n")
+  res, err := client.send_request("GET", "/envelope/ok", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"id":"1"}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected '{\"id\":\"1\"}'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing envelope failure returns the error message\n")
+  _, err = client.send_request("GET", "/envelope/error", "")
+  if err == nil { t.Fatalf("api_client_test.go: Envelope reporting an error did not fail the request") }
+  if !strings.Contains(err.Error(), "no such thing") {
+    t.Fatalf("api_client_test.go: Expected error to contain the envelope's message but got '%s'\n", err)
+  }
+}
+
+func TestAPIClientTokenRefresh(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    token_url: "http://127.0.0.1:8080/token",
+    token_response_path: "access_token",
+    token_header_prefix: "Bearer ",
+    debug: debug,
+  })
+
+  /* Pretend an earlier token was obtained and has since expired */
+  client.token = "expired"
+  client.token_generation = 1
+  atomic.StoreInt32(&token_requests, 0)
+
+  log.Printf("api_client_test.go: Testing a burst of 401s refreshes the token once\n")
+  var wg sync.WaitGroup
+  errs := make(chan error, 20)
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      res, err := client.send_request("GET", "/protected", "")
+      if err == nil && res != "It works!" { err = fmt.Errorf("got back '%s' but expected 'It works!'", res) }
+      errs <- err
+    }()
+  }
+  wg.Wait()
+  close(errs)
+
+  for err := range errs {
+    if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  }
+  if n := atomic.LoadInt32(&token_requests); n != 1 {
+    t.Fatalf("api_client_test.go: Expected the token endpoint to be called once but it was called %d times\n", n)
+  }
+}
+
+func TestAPIClientTokenRedirect(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    token_url: "http://127.0.0.1:8080/redirect?to=/token",
+    token_response_path: "access_token",
+    token_header_prefix: "Bearer ",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing a token endpoint that redirects on the API host\n")
+  done := make(chan error, 1)
+  go func() {
+    res, err := client.send_request("GET", "/protected", "")
+    if err == nil && res != "It works!" { err = fmt.Errorf("got back '%s' but expected 'It works!'", res) }
+    done <- err
+  }()
+  select {
+  case err := <-done:
+    if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("api_client_test.go: The request hung getting a token through a redirect\n")
+  }
+  if auth := token_authorization.Load(); auth != "" {
+    t.Fatalf("api_client_test.go: Expected the token request to have no Authorization header but it had '%v'\n", auth)
+  }
+}
+
+func TestAPIClientChunked(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing chunked responses are fully read\n")
+  res, err := client.send_request("GET", "/chunked", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "chunk0chunk1chunk2chunk3chunk4" {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected all five chunks\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing timeout applies to the whole chunked body\n")
+  res, err = client.send_request("GET", "/chunked/slow", "")
+  if err == nil { t.Fatalf("api_client_test.go: Timeout did not trigger on slow chunked response. Got back '%s'", res) }
+}
+
+func TestAPIClientResponseSignature(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    response_signature_header: "X-Signature",
+    response_signature_algorithm: "hmac-sha256",
+    response_signature_secret: "secret",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing correctly signed responses are accepted\n")
+  res, err := client.send_request("GET", "/signed", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"id": "1"}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected the raw signed body\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing incorrectly signed responses are rejected\n")
+  _, err = client.send_request("GET", "/signed/bad", "")
+  if err == nil { t.Fatalf("api_client_test.go: Response with a bad signature was accepted") }
+}
+
+func TestAPIClientMinimalHeaders(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    minimal_headers: true,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing minimal_headers sends no default headers\n")
+  res, err := client.send_request("POST", "/headers", `{"id": "1"}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  for _, name := range []string{"Content-Type", "User-Agent", "Accept-Encoding", "X-Drench-Account"} {
+    if strings.Contains(res, name) {
+      t.Fatalf("api_client_test.go: Expected no %s header but the server got: %s\n", name, res)
+    }
+  }
+}
+
+func TestAPIClientEmptyResponseRetries(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    empty_response_retries: 2,
+    retry_wait_min: 0,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing empty responses are retried\n")
+  atomic.StoreInt32(&empty_requests, 0)
+  res, _, err := client.send_request_expecting_body("POST", "/empty", `{"id": "1"}`, nil, nil)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"id": "1"}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected the body sent on the last attempt\n", res)
+  }
+  if n := atomic.LoadInt32(&empty_requests); n != 3 {
+    t.Fatalf("api_client_test.go: Expected 3 attempts but there were %d\n", n)
+  }
+}
+
+func TestAPIClientBodyFormField(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    body_form_field: "payload",
+    debug: debug,
+  })
+  o, err := NewAPIObject(client, &api_object_opt{
+    path: "/form",
+    id: "1",
+    data: `{ "id": "1", "name": "a & b=c", "size": 3, "enabled": true, "owner": null, "spec": { "tags": ["x", "y"], "limits": { "cpu": 1.5 } } }`,
+  })
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+
+  log.Printf("api_client_test.go: Testing bodies are sent percent-encoded in body_form_field\n")
+  res, err := client.send_request("POST", "/form", o.request_body())
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  parts := strings.SplitN(res, "\n", 2)
+  if parts[0] != "application/x-www-form-urlencoded" {
+    t.Fatalf("api_client_test.go: Expected a Content-Type of application/x-www-form-urlencoded but the server got '%s'\n", parts[0])
+  }
+  expected := `{"enabled":true,"id":"1","name":"a \u0026 b=c","owner":null,"size":3,"spec":{"limits":{"cpu":1.5},"tags":["x","y"]}}`
+  if len(parts) != 2 || parts[1] != expected {
+    t.Fatalf("api_client_test.go: Expected the server to get the field '%s' but got '%s'\n", expected, res)
+  }
+}
+
+func TestAPIClientRateLimit(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    expose_rate_limit: true,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing rate limit headers are captured, even malformed ones\n")
+  res, err := client.send_request("GET", "/ratelimit", "")
+  if err != nil || res != "It works!" {
+    t.Fatalf("api_client_test.go: Expected 'It works!' but got '%s': %v\n", res, err)
+  }
+  expected := map[string]string{
+    "x-ratelimit-limit":     "100",
+    "x-ratelimit-remaining": "99",
+    "ratelimit-reset":       "soon",
+  }
+  if got := client.get_rate_limit(); !reflect.DeepEqual(got, expected) {
+    t.Fatalf("api_client_test.go: Expected the rate limit %v but got %v\n", expected, got)
+  }
+
+  log.Printf("api_client_test.go: Testing a response without rate limit headers keeps what was captured\n")
+  if _, err = client.send_request("GET", "/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if got := client.get_rate_limit(); !reflect.DeepEqual(got, expected) {
+    t.Fatalf("api_client_test.go: Expected the rate limit %v to be kept but got %v\n", expected, got)
+  }
+
+  /* The copy handed out is the caller's own */
+  client.get_rate_limit()["x-ratelimit-limit"] = "0"
+  if got := client.get_rate_limit()["x-ratelimit-limit"]; got != "100" {
+    t.Fatalf("api_client_test.go: Expected changing the copy to leave the rate limit alone but got '%s'\n", got)
+  }
+}
+
+func TestAPIClientYAML(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    body_encoding: "yaml",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing YAML responses are converted to JSON\n")
+  res, err := client.send_request("POST", "/yaml", "id: \"1\"\n")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"id":"1","spec":{"size":3}}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected the YAML response as JSON\n", res)
+  }
+}
+
+func TestAPIClientTokenExchange(t *testing.T) {
+  var idp_requests, session_requests int32
   serverMux := http.NewServeMux()
-  serverMux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
-    w.Write([]byte("It works!"))
+  serverMux.HandleFunc("/idp", func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&idp_requests, 1)
+    w.Write([]byte(`{"access_token": "idp-token", "tenant_id": 42}`))
+  })
+  serverMux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&session_requests, 1)
+    body, _ := ioutil.ReadAll(r.Body)
+    if string(body) != `{"subject_token": "idp-token", "tenant": "42"}` || r.Header.Get("X-Tenant") != "42" {
+      http.Error(w, "bad exchange: " + string(body), http.StatusBadRequest)
+      return
+    }
+    w.Write([]byte(`{"session": {"token": "session-token", "ttl": 3600}}`))
+  })
+  serverMux.HandleFunc("/api/things/1", func(w http.ResponseWriter, r *http.Request) {
+    if r.Header.Get("Authorization") != "Bearer session-token" {
+      http.Error(w, "wrong token: " + r.Header.Get("Authorization"), http.StatusUnauthorized)
+      return
+    }
+    w.Write([]byte(`{"id": "1"}`))
+  })
+  svr := &http.Server{Addr: "127.0.0.1:8108", Handler: serverMux}
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  log.Printf("api_client_test.go: Testing a token from token_url is exchanged for the API's own\n")
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8108/",
+    timeout: 2,
+    token_url: "http://127.0.0.1:8108/idp",
+    token_response_path: "access_token",
+    token_header_prefix: "Bearer ",
+    token_exchange: []token_step{{
+      url: "http://127.0.0.1:8108/session",
+      body: `{"subject_token": "{token}", "tenant": "{response.tenant_id}"}`,
+      headers: map[string]string{"X-Tenant": "{response.tenant_id}"},
+      response_path: "session.token",
+      expires_in_path: "session.ttl",
+    }},
+    debug: false,
+  })
+  for i := 0; i < 3; i++ {
+    if _, err := client.send_request("GET", "/api/things/1", ""); err != nil {
+      t.Fatalf("api_client_test.go: Request with the exchanged token failed: %s\n", err)
+    }
+  }
+  if atomic.LoadInt32(&idp_requests) != 1 || atomic.LoadInt32(&session_requests) != 1 {
+    t.Fatalf("api_client_test.go: Expected the exchanged token to be kept, but the steps were sent %d and %d times\n", idp_requests, session_requests)
+  }
+  if client.token_expiry.Before(time.Now().Add(59 * time.Minute)) {
+    t.Fatalf("api_client_test.go: Expected the token to expire as the last step says, but it expires at %s\n", client.token_expiry)
+  }
+
+  client.token_exchange[0].body = `{"subject_token": "{token}", "tenant": "{response.missing}"}`
+  if _, _, err := client.fetch_token(); err == nil || !strings.Contains(err.Error(), "Step 2 of 2") || !strings.Contains(err.Error(), "{response.missing}") {
+    t.Fatalf("api_client_test.go: Expected an error naming the step and the missing value but got: %v\n", err)
+  }
+}
+
+func TestAPIClientTokenTemplate(t *testing.T) {
+  token := `a"b\c`
+  response := map[string]interface{}{"tenant": `x"y\z`, "big": float64(1e21)}
+  template := `{"subject_token": "{token}", "tenant": "{response.tenant}"}`
+
+  /* A quote or backslash cannot break a JSON body */
+  body, err := fill_token_template(template, token, response, true)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if body != `{"subject_token": "a\"b\\c", "tenant": "x\"y\\z"}` {
+    t.Fatalf("api_client_test.go: Expected the values to be JSON escaped in the body but got %s\n", body)
+  }
+  var parsed map[string]interface{}
+  if err := json.Unmarshal([]byte(body), &parsed); err != nil || parsed["subject_token"] != token || parsed["tenant"] != response["tenant"] {
+    t.Fatalf("api_client_test.go: Expected the body to decode to the values filled in but got %v (%v)\n", parsed, err)
+  }
+
+  /* Headers get the values as they are, numbers without exponents */
+  header, err := fill_token_template("Bearer {token} {response.tenant} {response.big}", token, response, false)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if header != `Bearer a"b\c x"y\z 1000000000000000000000` {
+    t.Fatalf("api_client_test.go: Expected the values as they are in the header but got %s\n", header)
+  }
+}
+
+func TestAPIClientTokenRefreshSkew(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    token_url: "http://127.0.0.1:8080/token",
+    token_response_path: "access_token",
+    token_expires_in_path: "expires_in",
+    token_refresh_skew: 60,
+    token_header_prefix: "Bearer ",
+    debug: debug,
+  })
+
+  /* A token that is still valid but expires within the skew */
+  client.token = "valid"
+  client.token_generation = 1
+  client.token_expiry = time.Now().Add(30 * time.Second)
+  atomic.StoreInt32(&token_requests, 0)
+
+  log.Printf("api_client_test.go: Testing tokens about to expire are refreshed early\n")
+  if _, err := client.send_request("GET", "/protected", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if n := atomic.LoadInt32(&token_requests); n != 1 {
+    t.Fatalf("api_client_test.go: Expected the token to be refreshed once but the endpoint was called %d times\n", n)
+  }
+  if client.token_expiry.Before(time.Now().Add(time.Hour)) {
+    t.Fatalf("api_client_test.go: Expected the new token's expiry to come from expires_in but it is %s\n", client.token_expiry)
+  }
+
+  /* The new token is good for an hour so is not refreshed again */
+  if _, err := client.send_request("GET", "/protected", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if n := atomic.LoadInt32(&token_requests); n != 1 {
+    t.Fatalf("api_client_test.go: Expected no further refresh but the endpoint was called %d times\n", n)
+  }
+}
+
+func TestAPIClientHostOverrides(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://api.example.invalid:8080/",
+    timeout: 2,
+    host_overrides: map[string]string{"api.example.invalid": "127.0.0.1"},
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing host_overrides connects to the given address\n")
+  res, err := client.send_request("GET", "/ok", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "It works!" {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected 'It works!'\n", res)
+  }
+}
+
+func TestAPIClientExpectContinue(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    expect_continue_timeout: 1,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing expect_continue_timeout sends the body once the server asks for it\n")
+  res, err := client.send_request("POST", "/upload", `{"id": "1"}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `100-continue {"id": "1"}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected the Expect header and body\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing expect_continue_timeout lets the server reject the body\n")
+  _, err = client.send_request("POST", "/upload/reject", strings.Repeat("x", 1024 * 1024))
+  if err == nil || !strings.Contains(err.Error(), "413") {
+    t.Fatalf("api_client_test.go: Expected a 413 error but got: %v\n", err)
+  }
+}
+
+func TestAPIClientLogErrorBodies(t *testing.T) {
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  var buf bytes.Buffer
+  log.SetOutput(&buf)
+  defer log.SetOutput(os.Stderr)
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    log_error_bodies: true,
+  })
+
+  if _, err := client.send_request("GET", "/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if strings.Contains(buf.String(), "BODY") {
+    t.Fatalf("api_client_test.go: Expected nothing to be logged for a successful request but got: %s\n", buf.String())
+  }
+
+  if _, err := client.send_request("GET", "/fail", ""); err == nil { t.Fatalf("api_client_test.go: Expected /fail to return an error") }
+  logged := buf.String()
+  if !strings.Contains(logged, "failed with response code 400") || !strings.Contains(logged, `"reason": "bad name"`) {
+    t.Fatalf("api_client_test.go: Expected the failed response body to be logged but got: %s\n", logged)
+  }
+  if strings.Contains(logged, "hunter2") || !strings.Contains(logged, `"api_token": "<redacted>"`) {
+    t.Fatalf("api_client_test.go: Expected the token in the body to be redacted but got: %s\n", logged)
+  }
+}
+
+func TestAPIClientLogBodyLimit(t *testing.T) {
+  client := NewAPIClient(&api_client_opt{uri: "http://127.0.0.1:8080/"})
+  body := "héllo world!"
+
+  log.Printf("api_client_test.go: Testing bodies are logged in full without log_body_limit\n")
+  if res := client.log_body(body); res != body {
+    t.Fatalf("api_client_test.go: Expected the whole body but got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing log_body_limit truncates without splitting a character\n")
+  client.log_body_limit = 2
+  if res := client.log_body(body); res != "h... (truncated, 1 of 13 bytes shown)" {
+    t.Fatalf("api_client_test.go: Expected the body to be truncated after 'h' but got '%s'\n", res)
+  }
+  client.log_body_limit = 13
+  if res := client.log_body(body); res != body {
+    t.Fatalf("api_client_test.go: Expected a body within the limit to be logged in full but got '%s'\n", res)
+  }
+}
+
+func TestAPIClientDuplicateKeys(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  opt := &api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    debug: debug,
+  }
+
+  log.Printf("api_client_test.go: Testing duplicate keys are accepted by default\n")
+  if _, err := NewAPIClient(opt).send_request("GET", "/duplicate", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+
+  log.Printf("api_client_test.go: Testing duplicate_keys=error rejects duplicate keys\n")
+  opt.duplicate_keys = "error"
+  _, err := NewAPIClient(opt).send_request("GET", "/duplicate", "")
+  if err == nil || !strings.Contains(err.Error(), "'items.1.id'") {
+    t.Fatalf("api_client_test.go: Expected an error naming items.1.id but got: %v\n", err)
+  }
+  if _, err := NewAPIClient(opt).send_request("GET", "/envelope/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+}
+
+func TestAPIClientProblemDetails(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing problem+json errors are summarized\n")
+  _, err := client.send_request("GET", "/problem", "")
+  if err == nil || err.Error() != "Unexpected response code '422': Invalid name: name must not be empty (status 422)" {
+    t.Fatalf("api_client_test.go: Expected a summary of the problem but got: %v\n", err)
+  }
+
+  log.Printf("api_client_test.go: Testing other errors still show the body\n")
+  _, err = client.send_request("GET", "/fail", "")
+  if err == nil || !strings.Contains(err.Error(), `"reason": "bad name"`) {
+    t.Fatalf("api_client_test.go: Expected the raw body in the error but got: %v\n", err)
+  }
+}
+
+func TestAPIClientCanonicalJSON(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    canonical_json: true,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing canonical_json sends a canonical body\n")
+  res, err := client.send_request("POST", "/upload", "{ \"name\": \"<a & b>\",\n  \"count\": 1.50, \"id\": \"1\" }")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != ` {"count":1.50,"id":"1","name":"<a & b>"}` {
+    t.Fatalf("api_client_test.go: Expected a canonical body but the server got '%s'\n", res)
+  }
+}
+
+func TestAPIClientPreserveKeyOrder(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  opt := &api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    envelope_data_path: "data",
+    debug: debug,
+  }
+  client := NewAPIClient(opt)
+
+  log.Printf("api_client_test.go: Testing unwrapped data has sorted keys by default\n")
+  res, err := client.send_request("GET", "/envelope/ordered", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"alpha":{"a":[1,{"x":null,"y":true}],"b":"2"},"zeta":1}` {
+    t.Fatalf("api_client_test.go: Expected sorted keys but got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing preserve_key_order keeps the order of keys\n")
+  opt.preserve_key_order = true
+  client = NewAPIClient(opt)
+  res, err = client.send_request("GET", "/envelope/ordered", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"zeta":1,"alpha":{"b":"2","a":[1,{"y":true,"x":null}]}}` {
+    t.Fatalf("api_client_test.go: Expected the order the API sent but got '%s'\n", res)
+  }
+}
+
+func TestAPIClientSigningRegion(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://abc123.execute-api.eu-west-1.amazonaws.com:8080/",
+    timeout: 2,
+    aws_sign: true,
+    aws_region: "us-west-2",
+    aws_region_from_host: true,
+    host_overrides: map[string]string{"abc123.execute-api.eu-west-1.amazonaws.com": "127.0.0.1"},
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing aws_region_from_host signs for the region in the host\n")
+  res, err := client.send_request("GET", "/authorization", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if !strings.Contains(res, "/eu-west-1/execute-api/") {
+    t.Fatalf("api_client_test.go: Expected a signature for eu-west-1 but got '%s'\n", res)
+  }
+
+  for host, region := range map[string]string{
+    "abc123.execute-api.us-gov-west-1.amazonaws.com": "us-gov-west-1",
+    "abc123.execute-api.cn-north-1.amazonaws.com.cn": "cn-north-1",
+    "api.example.com": "us-west-2",
+  } {
+    if r := client.signing_region(host); r != region {
+      t.Fatalf("api_client_test.go: Expected region '%s' for '%s' but got '%s'\n", region, host, r)
+    }
+  }
+}
+
+func TestAPIClientSignedHeaders(t *testing.T) {
+  var client *api_client
+  svr := &http.Server{
+    Addr: "127.0.0.1:8109",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      /* Sign the request again as it arrived, with only the
+         headers the signature says it covers */
+      auth := r.Header.Get("Authorization")
+      signed := ""
+      if i := strings.Index(auth, "SignedHeaders="); i >= 0 {
+        signed = strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0]
+      }
+      body, _ := ioutil.ReadAll(r.Body)
+      check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+      for _, name := range strings.Split(signed, ";") {
+        if name != "host" && name != "x-amz-date" { check.Header[http.CanonicalHeaderKey(name)] = r.Header[http.CanonicalHeaderKey(name)] }
+      }
+      signed_at, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+      creds, _ := client.aws_credentials()
+      v4.NewSigner(creds).Sign(check, bytes.NewReader(body), "execute-api", "us-east-1", signed_at)
+      if check.Header.Get("Authorization") != auth {
+        http.Error(w, "signature does not match: " + signed, http.StatusForbidden)
+        return
+      }
+      w.Write([]byte(signed))
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  client = NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8109/",
+    timeout: 2,
+    aws_sign: true,
+    aws_region: "us-east-1",
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing the AWS signature covers custom headers\n")
+  res, _, err := client.send_request_full("PUT", "/things/1", `{"name": "widget"}`, map[string]string{"X-Custom": "1", "If-Match": "abc"})
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  for _, name := range []string{"content-type", "if-match", "x-custom", "x-drench-account"} {
+    if !strings.Contains(";" + res + ";", ";" + name + ";") {
+      t.Fatalf("api_client_test.go: Expected %s to be signed but the signed headers are '%s'\n", name, res)
+    }
+  }
+}
+
+func TestAPIClientRedirectSigning(t *testing.T) {
+  var client *api_client
+  svr := &http.Server{
+    Addr: "127.0.0.1:8111",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      body, _ := ioutil.ReadAll(r.Body)
+      if to := r.URL.Query().Get("to"); to != "" {
+        http.Redirect(w, r, to, http.StatusTemporaryRedirect)
+        return
+      }
+      auth := r.Header.Get("Authorization")
+      if auth == "" && r.Header.Get("X-Amz-Date") == "" {
+        w.Write([]byte("unsigned"))
+        return
+      }
+      /* The signature must be good for the URL it arrived at */
+      signed := ""
+      if i := strings.Index(auth, "SignedHeaders="); i >= 0 {
+        signed = strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0]
+      }
+      check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+      for _, name := range strings.Split(signed, ";") {
+        if name != "host" && name != "x-amz-date" { check.Header[http.CanonicalHeaderKey(name)] = r.Header[http.CanonicalHeaderKey(name)] }
+      }
+      signed_at, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+      creds, _ := client.aws_credentials()
+      v4.NewSigner(creds).Sign(check, bytes.NewReader(body), "execute-api", "us-east-1", signed_at)
+      if check.Header.Get("Authorization") != auth {
+        w.Write([]byte("bad signature"))
+        return
+      }
+      w.Write([]byte("signed " + string(body)))
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  overrides := map[string]string{"api.example.invalid": "127.0.0.1", "signed.example.invalid": "127.0.0.1", "plain.example.invalid": "127.0.0.1"}
+  client = NewAPIClient(&api_client_opt{
+    uri: "http://api.example.invalid:8111/",
+    timeout: 2,
+    aws_sign: true,
+    aws_region: "us-east-1",
+    auth_hosts: []string{"api.example.invalid", "signed.example.invalid"},
+    host_overrides: overrides,
+    max_redirects: 2,
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing a redirect to a host outside auth_hosts carries no signature\n")
+  res, err := client.send_request("PUT", "/things/1?to=http://plain.example.invalid:8111/things/1", `{"name": "widget"}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "unsigned" {
+    t.Fatalf("api_client_test.go: Expected no signature after the redirect but the server got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing a redirect to a host in auth_hosts is signed for the new URL\n")
+  res, err = client.send_request("PUT", "/things/1?to=http://signed.example.invalid:8111/other/2", `{"name": "widget"}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `signed {"name": "widget"}` {
+    t.Fatalf("api_client_test.go: Expected a good signature after the redirect but the server got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing max_redirects stops a chain of redirects\n")
+  chain := "/a?to=" + url.QueryEscape("http://signed.example.invalid:8111/b?to=" + url.QueryEscape("http://signed.example.invalid:8111/c?to=http://signed.example.invalid:8111/d"))
+  if _, err = client.send_request("GET", chain, ""); err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+    t.Fatalf("api_client_test.go: Expected to stop after 2 redirects but got: %v\n", err)
+  }
+}
+
+func TestAPIClientRedirectBody(t *testing.T) {
+  svr := &http.Server{
+    Addr: "127.0.0.1:8113",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      body, _ := ioutil.ReadAll(r.Body)
+      switch r.URL.Path {
+      case "/old":
+        w.Write([]byte(`{"redirect": "/v2/new?from=old"}`))
+      case "/v2/new":
+        w.Write([]byte(`{"method": "` + r.Method + `", "query": "` + r.URL.RawQuery + `", "body": ` + string(body) + `, "auth": "` + r.Header.Get("Authorization") + `"}`))
+      case "/away":
+        w.Write([]byte(`{"redirect": "http://plain.example.invalid:8113/v2/new"}`))
+      case "/loop":
+        w.Write([]byte(`{"redirect": "loop"}`))
+      }
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  opt := &api_client_opt{
+    uri: "http://api.example.invalid:8113",
+    timeout: 2,
+    auth_header: "Bearer secret",
+    host_overrides: map[string]string{"api.example.invalid": "127.0.0.1", "plain.example.invalid": "127.0.0.1"},
+    redirect_body_path: "redirect",
+    max_redirects: 3,
+    debug: false,
+  }
+  client := NewAPIClient(opt)
+
+  log.Printf("api_client_test.go: Testing a redirect in the body of a 200 is followed\n")
+  res, err := client.send_request("PUT", "/old", `{"name": "widget"}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"method": "PUT", "query": "from=old", "body": {"name": "widget"}, "auth": "Bearer secret"}` {
+    t.Fatalf("api_client_test.go: Expected the same request at the new location but got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing credentials are not sent when the body redirects to another host\n")
+  res, err = client.send_request("POST", "/away", `{}`)
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if !strings.Contains(res, `"auth": ""`) {
+    t.Fatalf("api_client_test.go: Expected no Authorization header at the other host but got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing redirects in the body stop at max_redirects\n")
+  if _, err = client.send_request("GET", "/loop", ""); err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+    t.Fatalf("api_client_test.go: Expected to stop after 3 redirects but got: %v\n", err)
+  }
+
+  log.Printf("api_client_test.go: Testing the body is returned as it is without redirect_body_path\n")
+  opt.redirect_body_path = ""
+  res, err = NewAPIClient(opt).send_request("GET", "/old", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"redirect": "/v2/new?from=old"}` {
+    t.Fatalf("api_client_test.go: Expected the redirect body itself but got '%s'\n", res)
+  }
+}
+
+func TestAPIClientResponseContentType(t *testing.T) {
+  svr := &http.Server{
+    Addr: "127.0.0.1:8116",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      switch r.URL.Path {
+      case "/json":
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+      case "/hal":
+        w.Header().Set("Content-Type", "application/hal+json")
+      case "/text":
+        w.Header().Set("Content-Type", "text/plain")
+      case "/html":
+        w.Header().Set("Content-Type", "text/html")
+        w.Write([]byte(`<html>Please log in</html>`))
+        return
+      case "/problem":
+        w.Header().Set("Content-Type", "text/plain")
+        w.WriteHeader(http.StatusBadRequest)
+        w.Write([]byte(`{"title": "Invalid widget", "detail": "name is required", "status": 400}`))
+        return
+      }
+      w.Write([]byte(`{"id": "1"}`))
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  for _, test := range []struct {
+    mode string
+    path string
+    err  string
+  }{
+    {"", "/json", ""},
+    {"", "/text", ""},
+    {"", "/html", ""},
+    {"", "/problem", `Unexpected response code '400': {"title"`},
+    {"strict", "/json", ""},
+    {"strict", "/hal", ""},
+    {"strict", "/text", "has a Content-Type of 'text/plain', not JSON"},
+    {"strict", "/html", "has a Content-Type of 'text/html', not JSON"},
+    {"force_json", "/text", ""},
+    {"force_json", "/html", "still not valid JSON"},
+    {"force_json", "/problem", "Invalid widget: name is required (status 400)"},
+  } {
+    client := NewAPIClient(&api_client_opt{
+      uri: "http://127.0.0.1:8116",
+      timeout: 2,
+      retry_wait_min: 0,
+      partial_json_retries: 1,
+      response_content_type: test.mode,
+      debug: false,
+    })
+    _, err := client.send_request("GET", test.path, "")
+    if (test.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), test.err)) {
+      t.Fatalf("api_client_test.go: Expected an error with '%s' for %s with response_content_type '%s' but got: %v\n", test.err, test.path, test.mode, err)
+    }
+  }
+}
+
+func TestAPIClientCompressedResponses(t *testing.T) {
+  svr := &http.Server{
+    Addr: "127.0.0.1:8110",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      var buf bytes.Buffer
+      encoding := strings.TrimPrefix(r.URL.Path, "/")
+      if encoding == "gzip" {
+        zw := gzip.NewWriter(&buf)
+        zw.Write([]byte(`{"error": "name is required"}`))
+        zw.Close()
+      } else {
+        zw := zlib.NewWriter(&buf)
+        zw.Write([]byte(`{"error": "name is required"}`))
+        zw.Close()
+      }
+      /* Compressed whether asked for or not */
+      w.Header().Set("Content-Encoding", encoding)
+      if r.Method == "POST" { w.WriteHeader(http.StatusBadRequest) }
+      w.Write(buf.Bytes())
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  /* Without Accept-Encoding, Go leaves the body alone */
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8110/",
+    timeout: 2,
+    minimal_headers: true,
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing compressed error and success responses are decoded\n")
+  for _, encoding := range []string{"gzip", "deflate"} {
+    _, err := client.send_request("POST", "/" + encoding, `{}`)
+    if err == nil || !strings.Contains(err.Error(), `{"error": "name is required"}`) {
+      t.Fatalf("api_client_test.go: Expected the decoded %s body in the error but got: %v\n", encoding, err)
+    }
+    body, err := client.send_request("GET", "/" + encoding, "")
+    if err != nil || body != `{"error": "name is required"}` {
+      t.Fatalf("api_client_test.go: Expected the decoded %s body but got '%s': %v\n", encoding, body, err)
+    }
+  }
+}
+
+func TestAPIClientErrorMessagePath(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    error_message_path: "reason",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing error_message_path extracts the message\n")
+  _, err := client.send_request("GET", "/fail", "")
+  if err == nil || err.Error() != "bad name (HTTP 400)" {
+    t.Fatalf("api_client_test.go: Expected 'bad name (HTTP 400)' but got: %v\n", err)
+  }
+
+  log.Printf("api_client_test.go: Testing error_message_path falls back to the body\n")
+  client.error_message_path = "error.detail"
+  _, err = client.send_request("GET", "/fail", "")
+  if err == nil || !strings.Contains(err.Error(), `"reason": "bad name"`) {
+    t.Fatalf("api_client_test.go: Expected the raw body in the error but got: %v\n", err)
+  }
+}
+
+func TestAPIClientSuccessExpression(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    success_expression: "status == `200` && body.status == 'success'",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing success_expression accepts a response that meets it\n")
+  if _, err := client.send_request("GET", "/envelope/ok", ""); err != nil {
+    t.Fatalf("api_client_test.go: Expected success but got: %s", err)
+  }
+
+  log.Printf("api_client_test.go: Testing success_expression fails a 200 that does not meet it\n")
+  _, err := client.send_request("GET", "/envelope/error", "")
+  if err == nil || !strings.Contains(err.Error(), "does not meet success_expression") {
+    t.Fatalf("api_client_test.go: Expected the response to fail success_expression but got: %v", err)
+  }
+
+  log.Printf("api_client_test.go: Testing success_expression can accept an error status\n")
+  client.success_expression = "contains(['application/problem+json; charset=utf-8'], headers.\"content-type\")"
+  if _, err := client.send_request("GET", "/problem", ""); err != nil {
+    t.Fatalf("api_client_test.go: Expected the 422 to be a success but got: %s", err)
+  }
+}
+
+func TestAPIClientHTTP2ConnectionErrors(t *testing.T) {
+  log.Printf("api_client_test.go: Testing HTTP/2 connection errors are recognized\n")
+  for _, message := range []string{
+    `Get "https://api.example.com/things": http2: server sent GOAWAY and closed the connection; LastStreamID=7, ErrCode=NO_ERROR, debug=""`,
+    `Put "https://api.example.com/things/1": stream error: stream ID 3; INTERNAL_ERROR; received from peer`,
+    `Error reading response body after 512 bytes (the response is incomplete): stream error: stream ID 5; INTERNAL_ERROR`,
+  } {
+    if !is_http2_connection_error("GET", errors.New(message)) {
+      t.Fatalf("api_client_test.go: Expected '%s' to be an HTTP/2 connection error\n", message)
+    }
+  }
+  if is_http2_connection_error("GET", errors.New("Unexpected response code '500': INTERNAL_ERROR")) {
+    t.Fatalf("api_client_test.go: Expected an error response not to be an HTTP/2 connection error\n")
+  }
+
+  log.Printf("api_client_test.go: Testing a POST the server may have processed is not retried\n")
+  for _, message := range []string{
+    `Post "https://api.example.com/things": http2: server sent GOAWAY and closed the connection; LastStreamID=7, ErrCode=NO_ERROR, debug=""`,
+    `Post "https://api.example.com/things": stream error: stream ID 3; INTERNAL_ERROR; received from peer`,
+  } {
+    if is_http2_connection_error("POST", errors.New(message)) {
+      t.Fatalf("api_client_test.go: Expected '%s' not to be retried for a POST\n", message)
+    }
+  }
+  if !is_http2_connection_error("POST", errors.New(`Post "https://api.example.com/things": stream error: stream ID 3; REFUSED_STREAM`)) {
+    t.Fatalf("api_client_test.go: Expected a refused stream to be retried for a POST\n")
+  }
+}
+
+func TestAPIClientTLSHandshakeErrors(t *testing.T) {
+  log.Printf("api_client_test.go: Testing TLS handshake errors are recognized\n")
+  for _, message := range []string{
+    `Get "https://api.example.com/things": net/http: TLS handshake timeout`,
+    `TLS handshake failed: Post "https://api.example.com/things": EOF`,
+    `TLS handshake failed: Get "https://api.example.com/things": read tcp 10.0.0.1:50000->10.0.0.2:443: read: connection reset by peer`,
+  } {
+    if !is_tls_handshake_error(errors.New(message)) {
+      t.Fatalf("api_client_test.go: Expected '%s' to be a TLS handshake error\n", message)
+    }
+  }
+  for _, message := range []string{
+    `TLS handshake failed: Get "https://api.example.com/things": x509: certificate signed by unknown authority`,
+    `TLS handshake failed: Get "https://api.example.com/things": remote error: tls: bad certificate`,
+    `TLS handshake failed: Get "https://api.example.com/things": remote error: tls: protocol version not supported`,
+    `Get "https://api.example.com/things": read tcp 10.0.0.1:50000->10.0.0.2:443: read: connection reset by peer`,
+  } {
+    if is_tls_handshake_error(errors.New(message)) {
+      t.Fatalf("api_client_test.go: Expected '%s' not to be a TLS handshake error that is retried\n", message)
+    }
+  }
+
+  log.Printf("api_client_test.go: Testing a bad_certificate alert fails without retries\n")
+  svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("It works!"))
+  }))
+  /* Before TLS 1.3, a missing client certificate is refused
+     with a bad_certificate alert during the handshake */
+  svr.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MaxVersion: tls.VersionTLS12}
+  svr.StartTLS()
+  defer svr.Close()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: svr.URL,
+    insecure: true,
+    timeout: 2,
+    tls_handshake_retries: 3,
+    retry_wait_min: 1,
+  })
+  start := time.Now()
+  _, err := client.send_request("GET", "/", "")
+  if err == nil || !strings.Contains(err.Error(), "bad certificate") {
+    t.Fatalf("api_client_test.go: Expected the handshake to fail with a bad certificate alert but got: %v\n", err)
+  }
+  if elapsed := time.Since(start); elapsed > 900 * time.Millisecond {
+    t.Fatalf("api_client_test.go: Expected the request to fail without retries but it took %s\n", elapsed)
+  }
+}
+
+func TestAPIClientCache(t *testing.T) {
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    cache_ttl: 1,
+    debug: false,
+  })
+  get := func(path string) string {
+    res, err := client.send_request_cached("GET", path, "")
+    if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+    return res
+  }
+
+  log.Printf("api_client_test.go: Testing identical reads use the cached response\n")
+  collection, object := get("/counted/things"), get("/counted/things/1")
+  if get("/counted/things") != collection || get("/counted/things/1") != object {
+    t.Fatalf("api_client_test.go: Expected the same responses from the cache\n")
+  }
+  if get("/counted/things?page=2") == collection {
+    t.Fatalf("api_client_test.go: Expected a different query not to use the cache\n")
+  }
+  if res, _ := client.send_request("GET", "/counted/things", ""); res == collection {
+    t.Fatalf("api_client_test.go: Expected send_request not to use the cache\n")
+  }
+  other := get("/counted/others")
+
+  log.Printf("api_client_test.go: Testing a change clears the cache for its path\n")
+  client.send_request("POST", "/counted/things", "{}")
+  if get("/counted/things") == collection || get("/counted/things/1") == object {
+    t.Fatalf("api_client_test.go: Expected a POST to clear cached responses for the collection and its objects\n")
+  }
+  if get("/counted/others") != other {
+    t.Fatalf("api_client_test.go: Expected a POST not to clear cached responses for other paths\n")
+  }
+
+  log.Printf("api_client_test.go: Testing cached responses expire\n")
+  time.Sleep(1100 * time.Millisecond)
+  if get("/counted/others") == other {
+    t.Fatalf("api_client_test.go: Expected the cached response to expire after cache_ttl\n")
+  }
+}
+
+func TestAPIClientMaxBodySize(t *testing.T) {
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    max_body_size: 10,
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing bodies over max_body_size are not sent\n")
+  before := atomic.LoadInt32(&counted_requests)
+  _, err := client.send_request("POST", "/counted/things", `{"name": "too long"}`)
+  if err == nil || !strings.Contains(err.Error(), "20 bytes") {
+    t.Fatalf("api_client_test.go: Expected an error giving the size of the body but got: %v\n", err)
+  }
+  if atomic.LoadInt32(&counted_requests) != before {
+    t.Fatalf("api_client_test.go: Expected a body over max_body_size not to be sent\n")
+  }
+  if _, err = client.send_request("POST", "/counted/things", `{"a": 1}`); err != nil {
+    t.Fatalf("api_client_test.go: Expected a body under max_body_size to be sent but got: %s\n", err)
+  }
+}
+
+func TestAPIClientAWSCredentialChain(t *testing.T) {
+  file, err := ioutil.TempFile("", "credentials")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  defer os.Remove(file.Name())
+  file.WriteString("[default]\naws_access_key_id = SHARED\naws_secret_access_key = secret\n[other]\naws_access_key_id = OTHER\naws_secret_access_key = secret\n")
+  file.Close()
+
+  for name, value := range map[string]string{"AWS_SHARED_CREDENTIALS_FILE": file.Name(), "AWS_ACCESS_KEY_ID": "ENV", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_PROFILE": ""} {
+    defer os.Setenv(name, os.Getenv(name))
+    os.Setenv(name, value)
+  }
+
+  log.Printf("api_client_test.go: Testing AWS credentials come from the first source in aws_credential_chain that has them\n")
+  for _, test := range []struct {
+    chain    []string
+    profile  string
+    expected string
+  }{
+    {nil, "", "SHARED"},
+    {[]string{"env", "shared"}, "", "ENV"},
+    {[]string{"shared", "env"}, "other", "OTHER"},
+    {[]string{"shared", "env"}, "missing", "ENV"},
+  } {
+    client := NewAPIClient(&api_client_opt{uri: "http://127.0.0.1:8080/", aws_credential_chain: test.chain, aws_profile: test.profile})
+    creds, err := client.aws_credentials()
+    if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+    value, err := creds.Get()
+    if err != nil { t.Fatalf("api_client_test.go: %v (profile %s): %s", test.chain, test.profile, err) }
+    if value.AccessKeyID != test.expected {
+      t.Fatalf("api_client_test.go: Expected %v (profile %s) to give the credentials '%s' but got '%s'\n", test.chain, test.profile, test.expected, value.AccessKeyID)
+    }
+  }
+
+  client := NewAPIClient(&api_client_opt{uri: "http://127.0.0.1:8080/", aws_credential_chain: []string{"shared", "web_identity"}})
+  if _, err = client.aws_credentials(); err == nil || !strings.Contains(err.Error(), "web_identity") {
+    t.Fatalf("api_client_test.go: Expected an error for an unknown credential source but got: %v\n", err)
+  }
+}
+
+func TestAPIClientWarmConnection(t *testing.T) {
+  var connections, heads int32
+  svr := &http.Server{
+    Addr: "127.0.0.1:8100",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if r.Method == "HEAD" { atomic.AddInt32(&heads, 1) }
+      w.Write([]byte("It works!"))
+    }),
+    ConnState: func(conn net.Conn, state http.ConnState) {
+      if state == http.StateNew { atomic.AddInt32(&connections, 1) }
+    },
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8100/",
+    timeout: 2,
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing the warmed up connection is used by the first request\n")
+  client.warm_connection()
+  if atomic.LoadInt32(&heads) != 1 {
+    t.Fatalf("api_client_test.go: Expected a HEAD to warm up the connection\n")
+  }
+  if _, err := client.send_request("GET", "/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if n := atomic.LoadInt32(&connections); n != 1 {
+    t.Fatalf("api_client_test.go: Expected the request to reuse the warmed up connection but %d were opened\n", n)
+  }
+}
+
+func TestAPIClientPreflight(t *testing.T) {
+  var preflights, changes int32
+  serverMux := http.NewServeMux()
+  serverMux.HandleFunc("/things/", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "OPTIONS" {
+      atomic.AddInt32(&preflights, 1)
+      if r.Header.Get("Access-Control-Request-Method") == "" {
+        http.Error(w, "No preflight method", http.StatusBadRequest)
+        return
+      }
+      w.Header().Set("Access-Control-Allow-Methods", "GET, PUT")
+      return
+    }
+    atomic.AddInt32(&changes, 1)
+  })
+  svr := &http.Server{Addr: "127.0.0.1:8101", Handler: serverMux}
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8101/",
+    timeout: 2,
+    preflight: true,
+    preflight_headers: map[string]string{"Access-Control-Request-Method": "{method}"},
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing changes are preceded by a preflight OPTIONS\n")
+  if _, err := client.send_request("PUT", "/things/1", "{}"); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if _, err := client.send_request("GET", "/things/1", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if atomic.LoadInt32(&preflights) != 1 || atomic.LoadInt32(&changes) != 2 {
+    t.Fatalf("api_client_test.go: Expected one preflight (for the PUT only) but got %d\n", atomic.LoadInt32(&preflights))
+  }
+
+  log.Printf("api_client_test.go: Testing a method the preflight does not allow is not sent\n")
+  _, err := client.send_request("DELETE", "/things/1", "")
+  if err == nil || !strings.Contains(err.Error(), "does not allow DELETE") {
+    t.Fatalf("api_client_test.go: Expected the preflight to refuse the DELETE but got: %v\n", err)
+  }
+  if atomic.LoadInt32(&changes) != 2 {
+    t.Fatalf("api_client_test.go: Expected the DELETE not to be sent\n")
+  }
+}
+
+func TestAPIClientRetryAfter(t *testing.T) {
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    retry_after_headers: map[string]string{"X-Retry-After-Ms": "milliseconds", "X-RateLimit-Reset": "epoch"},
+  })
+
+  log.Printf("api_client_test.go: Testing how long to wait is read from retry_after_headers and Retry-After\n")
+  in_a_minute := time.Now().Add(time.Minute)
+  for _, test := range []struct {
+    headers map[string]string
+    min     time.Duration
+    max     time.Duration
+  }{
+    {map[string]string{"Retry-After": "7"}, 7 * time.Second, 7 * time.Second},
+    {map[string]string{"Retry-After": in_a_minute.UTC().Format(http.TimeFormat)}, 58 * time.Second, time.Minute},
+    {map[string]string{"X-Retry-After-Ms": "1500", "Retry-After": "7"}, 1500 * time.Millisecond, 1500 * time.Millisecond},
+    {map[string]string{"X-RateLimit-Reset": fmt.Sprintf("%d", in_a_minute.Unix())}, 58 * time.Second, time.Minute},
+    {map[string]string{"X-RateLimit-Reset": "1000"}, 0, 0},
+  } {
+    resp := &http.Response{Header: http.Header{}}
+    for name, value := range test.headers { resp.Header.Set(name, value) }
+    wait, ok := client.retry_after(resp)
+    if !ok || wait < test.min || wait > test.max {
+      t.Fatalf("api_client_test.go: Expected %v to wait between %s and %s but got %s (%t)\n", test.headers, test.min, test.max, wait, ok)
+    }
+  }
+  if _, ok := client.retry_after(&http.Response{Header: http.Header{}}); ok {
+    t.Fatalf("api_client_test.go: Expected no wait from a response without retry headers\n")
+  }
+}
+
+func TestAPIClientRetryAfterUnavailable(t *testing.T) {
+  var requests int32
+  svr := &http.Server{
+    Addr: "127.0.0.1:8102",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      /* Down for maintenance for a moment */
+      if atomic.AddInt32(&requests, 1) == 1 {
+        w.Header().Set("Retry-After", "1")
+        http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+        return
+      }
+      w.Write([]byte("It works!"))
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  log.Printf("api_client_test.go: Testing Retry-After is honored on a 503\n")
+  for _, only_429 := range []bool{false, true} {
+    atomic.StoreInt32(&requests, 0)
+    client := NewAPIClient(&api_client_opt{
+      uri: "http://127.0.0.1:8102/",
+      timeout: 2,
+      retry_max_attempts: 1,
+      retry_wait_min: 0,
+      retry_after_429_only: only_429,
+      debug: false,
+    })
+    start := time.Now()
+    if _, err := client.send_request("GET", "/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+    waited := time.Since(start) >= time.Second
+    if waited == only_429 {
+      t.Fatalf("api_client_test.go: Expected Retry-After on a 503 to be honored only without retry_after_429_only (retry_after_429_only=%t, waited %s)\n", only_429, time.Since(start))
+    }
+  }
+}
+
+func TestAPIClientPartialJSON(t *testing.T) {
+  var requests int32
+  svr := &http.Server{
+    Addr: "127.0.0.1:8106",
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.Header().Set("Content-Type", "application/json")
+      /* The first two responses are cut short */
+      if atomic.AddInt32(&requests, 1) <= 2 {
+        w.Write([]byte(`{"id": "1", "na`))
+        return
+      }
+      w.Write([]byte(`{"id": "1", "name": "widget"}`))
+    }),
+  }
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  log.Printf("api_client_test.go: Testing truncated JSON responses are retried with partial_json_retries\n")
+  for _, test := range []struct {
+    retries  int
+    requests int32
+    err      string
+  }{
+    {0, 1, ""},
+    {1, 2, "still not valid JSON after 1 retries"},
+    {2, 3, ""},
+  } {
+    atomic.StoreInt32(&requests, 0)
+    client := NewAPIClient(&api_client_opt{
+      uri: "http://127.0.0.1:8106/",
+      timeout: 2,
+      retry_wait_min: 0,
+      partial_json_retries: test.retries,
+      debug: false,
+    })
+    body, err := client.send_request("GET", "/api/things/1", "")
+    if test.err == "" && test.retries > 0 && (err != nil || body != `{"id": "1", "name": "widget"}`) {
+      t.Fatalf("api_client_test.go: Expected the whole object after %d retries but got '%s': %v\n", test.retries, body, err)
+    }
+    if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+      t.Fatalf("api_client_test.go: Expected an error with '%s' but got: %v\n", test.err, err)
+    }
+    if got := atomic.LoadInt32(&requests); got != test.requests {
+      t.Fatalf("api_client_test.go: Expected %d requests with partial_json_retries=%d but got %d\n", test.requests, test.retries, got)
+    }
+  }
+
+  if partial_json_error(&http.Response{Header: http.Header{}}, "It works!", false) != nil {
+    t.Fatalf("api_client_test.go: Expected a response that is not JSON to be left alone\n")
+  }
+  if partial_json_error(&http.Response{Header: http.Header{}}, "It works!", true) == nil {
+    t.Fatalf("api_client_test.go: Expected a response that is not JSON to be an error when forced\n")
+  }
+}
+
+func TestAPIClientStrictContentLength(t *testing.T) {
+  listener, err := net.Listen("tcp", "127.0.0.1:8107")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  defer listener.Close()
+  var requests int32
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil { return }
+      buf := make([]byte, 4096)
+      conn.Read(buf)
+      /* The first response is cut short by a "proxy" */
+      if atomic.AddInt32(&requests, 1) == 1 {
+        conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n{\"id\": \"1\"}"))
+      } else {
+        conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\n{\"id\": \"1\"}"))
+      }
+      conn.Close()
+    }
+  }()
+
+  log.Printf("api_client_test.go: Testing incomplete responses are retried with strict_content_length\n")
+  for _, strict := range []bool{false, true} {
+    atomic.StoreInt32(&requests, 0)
+    client := NewAPIClient(&api_client_opt{
+      uri: "http://127.0.0.1:8107/",
+      timeout: 2,
+      retry_max_attempts: 1,
+      retry_wait_min: 0,
+      strict_content_length: strict,
+      debug: false,
+    })
+    body, err := client.send_request("GET", "/api/things/1", "")
+    if strict && (err != nil || body != `{"id": "1"}`) {
+      t.Fatalf("api_client_test.go: Expected the incomplete response to be retried but got '%s': %v\n", body, err)
+    }
+    if !strict && !is_incomplete_response(err) {
+      t.Fatalf("api_client_test.go: Expected an incomplete response error without strict_content_length but got: %v\n", err)
+    }
+  }
+
+  /* Go itself never returns more than Content-Length, so check a longer body directly */
+  resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Length": []string{"5"}}}
+  if err := check_content_length("GET", resp, []byte(`{"id": "1"}`)); !is_incomplete_response(err) {
+    t.Fatalf("api_client_test.go: Expected a body longer than its Content-Length to be an error but got: %v\n", err)
+  }
+  if err := check_content_length("HEAD", resp, []byte{}); err != nil {
+    t.Fatalf("api_client_test.go: Expected a HEAD response not to be checked but got: %v\n", err)
+  }
+}
+
+func TestAPIClientQueryArrayStyle(t *testing.T) {
+  query := url.Values{"id": []string{"1", "2"}, "name": []string{"a,b"}}
+  for style, want := range map[string]string{
+    "":       "/things?x=y&id=1&id=2&name=a%2Cb",
+    "repeat": "/things?x=y&id=1&id=2&name=a%2Cb",
+    "comma":  "/things?x=y&id=1,2&name=a%2Cb",
+  } {
+    client := NewAPIClient(&api_client_opt{ uri: "http://127.0.0.1:8080/", query_array_style: style })
+    if got := client.add_query("/things?x=y", query); got != want {
+      t.Fatalf("api_client_test.go: Expected '%s' with query_array_style '%s' but got '%s'\n", want, style, got)
+    }
+
+    /* An array in an object's data, from a query_params placeholder */
+    o, _ := NewAPIObject(client, &api_object_opt{
+      path: "/things",
+      id: "1",
+      data: `{ "ids": [1, 2], "name": "a,b" }`,
+      query_params: map[string]string{"id": "{ids}", "name": "{name}"},
+    })
+    path, err := o.add_query_params("/things?x=y")
+    if err != nil || path != want {
+      t.Fatalf("api_client_test.go: Expected '%s' from query_params with query_array_style '%s' but got '%s': %v\n", want, style, path, err)
+    }
+  }
+}
+
+func TestAPIClientConcurrentReads(t *testing.T) {
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 5,
+    token_url: "http://127.0.0.1:8080/token",
+    token_response_path: "access_token",
+    token_header_prefix: "Bearer ",
+    cookie_jar: true,
+    expose_rate_limit: true,
+    cache_ttl: 60,
+    retry_max_attempts: 2,
+    debug: false,
+  })
+  atomic.StoreInt32(&token_requests, 0)
+
+  /* Run with -race to check the client's shared state (the
+     token, cache, rate limit and cookies) is safe to share */
+  log.Printf("api_client_test.go: Testing many concurrent reads each get their own result\n")
+  const count = 50
+  results := make([]string, count)
+  errs := make([]error, count)
+  var wg sync.WaitGroup
+  for i := 0; i < count; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      path := fmt.Sprintf("/protected/%d", i%25)
+      if i%2 == 0 {
+        results[i], errs[i] = client.send_request("GET", path, "")
+      } else {
+        results[i], errs[i] = client.send_request_cached("GET", path, "")
+      }
+      client.get_rate_limit()
+      client.get_cookies()
+    }(i)
+  }
+  wg.Wait()
+
+  for i := 0; i < count; i++ {
+    expected := fmt.Sprintf("/protected/%d", i%25)
+    if errs[i] != nil || results[i] != expected {
+      t.Fatalf("api_client_test.go: Expected read %d to get '%s' but got '%s': %v\n", i, expected, results[i], errs[i])
+    }
+  }
+  if n := atomic.LoadInt32(&token_requests); n != 1 {
+    t.Fatalf("api_client_test.go: Expected the concurrent reads to share one token but %d were requested\n", n)
+  }
+}
+
+type recording_hooks struct {
+  mutex sync.Mutex
+  calls []string
+}
+
+func (h *recording_hooks) before_request(info *request_info) {
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+  info.context["seen"] = true
+  h.calls = append(h.calls, fmt.Sprintf("before %s %s %d", info.method, info.path, info.attempt))
+}
+
+func (h *recording_hooks) after_request(info *request_info) {
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+  h.calls = append(h.calls, fmt.Sprintf("after %s %s %d %d %t", info.method, info.path, info.attempt, info.status, info.context["seen"] == true && info.duration > 0))
+}
+
+func TestAPIClientRequestHooks(t *testing.T) {
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  hooks := &recording_hooks{}
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    retry_max_attempts: 3,
+    hooks: hooks,
+    debug: false,
+  })
+
+  log.Printf("api_client_test.go: Testing hooks are called around every attempt\n")
+  atomic.StoreInt32(&flaky_requests, 0)
+  if _, err := client.send_request("GET", "/flaky", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  expected := []string{
+    "before GET /flaky 1", "after GET /flaky 1 503 true",
+    "before GET /flaky 2", "after GET /flaky 2 503 true",
+    "before GET /flaky 3", "after GET /flaky 3 200 true",
+  }
+  if strings.Join(hooks.calls, "\n") != strings.Join(expected, "\n") {
+    t.Fatalf("api_client_test.go: Expected hook calls:\n%s\nbut got:\n%s\n", strings.Join(expected, "\n"), strings.Join(hooks.calls, "\n"))
+  }
+
+  /* The default hooks do nothing, and must not get in the way */
+  client = NewAPIClient(&api_client_opt{uri: "http://127.0.0.1:8080/", timeout: 2, log_requests: true})
+  if _, err := client.send_request("GET", "/ok", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+}
+
+func TestAPIClientPathFromLink(t *testing.T) {
+  client := NewAPIClient(&api_client_opt{uri: "https://api.example.com/v1/"})
+
+  log.Printf("api_client_test.go: Testing links are turned into paths under uri\n")
+  for link, expected := range map[string]string{
+    "https://api.example.com/v1/widgets/1": "/widgets/1",
+    "https://API.example.com/v1/widgets/1?view=full": "/widgets/1?view=full",
+    "/v1/widgets/a%2Fb": "/widgets/a%2Fb",
+    "widgets/1": "/widgets/1",
+  } {
+    path, err := client.path_from_link(link)
+    if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+    if path != expected {
+      t.Fatalf("api_client_test.go: Expected '%s' to be the path '%s' but got '%s'\n", link, expected, path)
+    }
+  }
+
+  log.Printf("api_client_test.go: Testing links elsewhere are refused\n")
+  for _, link := range []string{"https://evil.example.com/v1/widgets/1", "/v2/widgets/1", "/v1"} {
+    if path, err := client.path_from_link(link); err == nil {
+      t.Fatalf("api_client_test.go: Expected an error for the link '%s' but got the path '%s'\n", link, path)
+    }
+  }
+}
+
+func TestAPIClientShareConnections(t *testing.T) {
+  opt := &api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    share_connections: true,
+  }
+  a := NewAPIClient(opt)
+  b := NewAPIClient(&api_client_opt{uri: "http://127.0.0.1:8080/api", timeout: 5, share_connections: true})
+  if a.http_client.Transport != b.http_client.Transport {
+    t.Fatalf("api_client_test.go: Expected clients with the same connection settings to share a transport\n")
+  }
+
+  opt.insecure = true
+  if NewAPIClient(opt).http_client.Transport == a.http_client.Transport {
+    t.Fatalf("api_client_test.go: Expected clients with different TLS settings not to share a transport\n")
+  }
+  opt.insecure = false
+  opt.share_connections = false
+  if NewAPIClient(opt).http_client.Transport == a.http_client.Transport {
+    t.Fatalf("api_client_test.go: Expected a client without share_connections to have its own transport\n")
+  }
+}
+
+func TestAPIClientConnectionReuse(t *testing.T) {
+  var connections int32
+  serverMux := http.NewServeMux()
+  serverMux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(strings.Repeat("x", 64 * 1024)))
+  })
+  serverMux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, strings.Repeat("no", 64 * 1024), http.StatusBadRequest)
+  })
+  serverMux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+    http.Redirect(w, r, "/ok", http.StatusFound)
+  })
+  svr := &http.Server{Addr: "127.0.0.1:8090", Handler: serverMux, ConnState: func(c net.Conn, state http.ConnState) {
+    if state == http.StateNew { atomic.AddInt32(&connections, 1) }
+  }}
+  go svr.ListenAndServe()
+  defer svr.Close()
+  time.Sleep(1 * time.Second)
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8090/",
+    timeout: 2,
+  })
+
+  log.Printf("api_client_test.go: Testing the connection is reused after successes, errors and redirects\n")
+  for _, path := range []string{"/ok", "/fail", "/moved", "/missing", "/ok"} {
+    client.send_request("GET", path, "")
+  }
+  if n := atomic.LoadInt32(&connections); n != 1 {
+    t.Fatalf("api_client_test.go: Expected every request to reuse one connection but %d were opened\n", n)
+  }
+}
+
+func TestAPIClientStripResponse(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    strip_xssi_prefix: true,
+    response_strip_suffix: "-- served by api-7",
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing the XSSI prefix and a suffix are stripped\n")
+  res, err := client.send_request("GET", "/xssi", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != `{"id": "1"}` {
+    t.Fatalf("api_client_test.go: Got back '%s' but expected '{\"id\": \"1\"}'\n", res)
+  }
+}
+
+func TestAPIClientCookieJar(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    cookie_jar: true,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing cookie_jar keeps and sends the session cookie\n")
+  if _, err := client.send_request("POST", "/login", ""); err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  res, err := client.send_request("GET", "/session", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "abc123" {
+    t.Fatalf("api_client_test.go: Expected the session cookie to be sent but the server got '%s'\n", res)
+  }
+  if cookies := client.get_cookies(); cookies["session"] != "abc123" {
+    t.Fatalf("api_client_test.go: Expected the session cookie to be kept but got %v\n", cookies)
+  }
+}
+
+func TestAPIClientAuthHosts(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  /* Go itself keeps the header on redirects to a subdomain */
+  overrides := map[string]string{"api.example.invalid": "127.0.0.1", "other.api.example.invalid": "127.0.0.1"}
+  client := NewAPIClient(&api_client_opt{
+    uri: "http://api.example.invalid:8080/",
+    timeout: 2,
+    auth_header: "Bearer secret",
+    host_overrides: overrides,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing the Authorization header is sent to the host of the uri\n")
+  res, err := client.send_request("GET", "/authorization", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "Bearer secret" {
+    t.Fatalf("api_client_test.go: Expected the Authorization header to be sent but the server got '%s'\n", res)
+  }
+
+  log.Printf("api_client_test.go: Testing the Authorization header is dropped on a redirect to another host\n")
+  res, err = client.send_request("GET", "/redirect?to=http://other.api.example.invalid:8080/authorization", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "" {
+    t.Fatalf("api_client_test.go: Expected no Authorization header after the redirect but the server got '%s'\n", res)
+  }
+
+  client = NewAPIClient(&api_client_opt{
+    uri: "http://api.example.invalid:8080/",
+    timeout: 2,
+    auth_header: "Bearer secret",
+    auth_hosts: []string{"other.api.example.invalid"},
+    host_overrides: overrides,
+    debug: debug,
+  })
+
+  log.Printf("api_client_test.go: Testing the Authorization header is not sent to hosts outside auth_hosts\n")
+  res, err = client.send_request("GET", "/authorization", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "" {
+    t.Fatalf("api_client_test.go: Expected no Authorization header but the server got '%s'\n", res)
+  }
+}
+
+func TestAPIClientRetries(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  opt := &api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 2,
+    retry_max_attempts: 3,
+    retry_wait_min: 0,
+    debug: debug,
+  }
+
+  log.Printf("api_client_test.go: Testing a request is retried until it works\n")
+  atomic.StoreInt32(&flaky_requests, 0)
+  res, err := NewAPIClient(opt).send_request("GET", "/flaky", "")
+  if err != nil { t.Fatalf("api_client_test.go: %s", err) }
+  if res != "It works!" || atomic.LoadInt32(&flaky_requests) != 3 {
+    t.Fatalf("api_client_test.go: Expected success on the third attempt but got '%s' after %d\n", res, flaky_requests)
+  }
+
+  log.Printf("api_client_test.go: Testing retry_max_attempts stops retries\n")
+  atomic.StoreInt32(&flaky_requests, 0)
+  opt.retry_max_attempts = 1
+  if _, err = NewAPIClient(opt).send_request("GET", "/flaky", ""); err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts") {
+    t.Fatalf("api_client_test.go: Expected to give up after 2 attempts but got: %v\n", err)
+  }
+
+  log.Printf("api_client_test.go: Testing retry_max_elapsed stops retries first\n")
+  atomic.StoreInt32(&flaky_requests, -100)
+  opt.retry_max_attempts = 0
+  opt.retry_max_elapsed = 2
+  opt.retry_wait_min = 1
+  start := time.Now()
+  _, err = NewAPIClient(opt).send_request("GET", "/flaky", "")
+  if err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts in") || time.Since(start) > 3 * time.Second {
+    t.Fatalf("api_client_test.go: Expected to give up after 2 attempts within 2 seconds but got: %v\n", err)
+  }
+
+  log.Printf("api_client_test.go: Testing errors that will not pass are not retried\n")
+  atomic.StoreInt32(&flaky_requests, 0)
+  if _, err = NewAPIClient(opt).send_request("GET", "/fail", ""); err == nil || strings.Contains(err.Error(), "gave up") {
+    t.Fatalf("api_client_test.go: Expected a 400 to fail without retries but got: %v\n", err)
+  }
+}
+
+func TestAPIClientTimeoutRetryFactor(t *testing.T) {
+  debug := false
+  setup_api_client_server()
+  defer shutdown_api_client_server()
+
+  opt := &api_client_opt{
+    uri: "http://127.0.0.1:8080/",
+    timeout: 1,
+    timeout_retry_factor: 2,
+    timeout_max: 3,
+    retry_max_attempts: 1,
+    retry_wait_min: 0,
+    debug: debug,
+  }
+  client := NewAPIClient(opt)
+
+  log.Printf("api_client_test.go: Testing each retry gets a longer timeout up to timeout_max\n")
+  for i, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+    if got := client.attempt_timeout(i + 1); got != expected {
+      t.Fatalf("api_client_test.go: Expected attempt %d to time out after %s but got %s\n", i + 1, expected, got)
+    }
+  }
+
+  log.Printf("api_client_test.go: Testing requests that answer quickly still work\n")
+  res, err := client.send_request("GET", "/ok", "")
+  if err != nil || res != "It works!" {
+    t.Fatalf("api_client_test.go: Expected 'It works!' but got '%s': %v\n", res, err)
+  }
+
+  log.Printf("api_client_test.go: Testing a retry waits longer than the first attempt\n")
+  start := time.Now()
+  _, err = client.send_request("GET", "/slow", "")
+  if err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts") {
+    t.Fatalf("api_client_test.go: Expected to give up after 2 attempts but got: %v\n", err)
+  }
+  if elapsed := time.Since(start); elapsed < 2500 * time.Millisecond || elapsed > 5 * time.Second {
+    t.Fatalf("api_client_test.go: Expected the attempts to take about 3 seconds but they took %s\n", elapsed)
+  }
+
+  log.Printf("api_client_test.go: Testing the timeout does not change without a factor\n")
+  opt.timeout_retry_factor = 0
+  if got := NewAPIClient(opt).attempt_timeout(3); got != 0 {
+    t.Fatalf("api_client_test.go: Expected no per attempt timeout but got %s\n", got)
+  }
+}
+
+func setup_api_client_server () {
+  serverMux := http.NewServeMux()
+  serverMux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("It works!"))
+  })
+  serverMux.HandleFunc("/envelope/ok", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(`{"status": "success", "data": {"id": "1"}}`))
+  })
+  serverMux.HandleFunc("/envelope/error", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(`{"status": "error", "error": {"message": "no such thing"}}`))
+  })
+  serverMux.HandleFunc("/envelope/ordered", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(`{"data": {"zeta": 1, "alpha": {"b": "2", "a": [1, {"y": true, "x": null}]}}}`))
+  })
+  serverMux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&token_requests, 1)
+    token_authorization.Store(r.Header.Get("Authorization"))
+    /* Slow enough that the other requests pile up behind this one */
+    time.Sleep(200 * time.Millisecond)
+    w.Write([]byte(`{"access_token": "valid", "expires_in": 7200}`))
+  })
+  serverMux.HandleFunc("/protected", func(w http.ResponseWriter, r *http.Request) {
+    if r.Header.Get("Authorization") != "Bearer valid" {
+      http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+      return
+    }
+    w.Write([]byte("It works!"))
+  })
+  serverMux.HandleFunc("/protected/", func(w http.ResponseWriter, r *http.Request) {
+    if r.Header.Get("Authorization") != "Bearer valid" {
+      http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+      return
+    }
+    /* Everything a response can change on the client */
+    w.Header().Set("X-RateLimit-Remaining", strings.TrimPrefix(r.URL.Path, "/protected/"))
+    http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+    w.Write([]byte(r.URL.Path))
+  })
+  serverMux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+    /* Flushing before the handler returns forces chunked encoding */
+    for i := 0; i < 5; i++ {
+      w.Write([]byte(fmt.Sprintf("chunk%d", i)))
+      w.(http.Flusher).Flush()
+      time.Sleep(10 * time.Millisecond)
+    }
+  })
+  serverMux.HandleFunc("/chunked/slow", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("chunk0"))
+    w.(http.Flusher).Flush()
+    time.Sleep(5 * time.Second)
+    w.Write([]byte("This will never be read!!!!!"))
+  })
+  serverMux.HandleFunc("/signed", func(w http.ResponseWriter, r *http.Request) {
+    body := []byte(`{"id": "1"}`)
+    mac := hmac.New(sha256.New, []byte("secret"))
+    mac.Write(body)
+    w.Header().Set("X-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+    w.Write(body)
+  })
+  serverMux.HandleFunc("/signed/bad", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Signature", "sha256=0123456789abcdef")
+    w.Write([]byte(`{"id": "1"}`))
+  })
+  serverMux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+    /* Reading the body is what sends 100 Continue */
+    body, _ := ioutil.ReadAll(r.Body)
+    w.Write([]byte(r.Header.Get("Expect") + " " + string(body)))
+  })
+  serverMux.HandleFunc("/upload/reject", func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+  })
+  serverMux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusBadRequest)
+    w.Write([]byte(`{"reason": "bad name", "api_token": "hunter2"}`))
+  })
+  serverMux.HandleFunc("/duplicate", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(`{"items": [{"id": "1"}, {"id": "2", "name": "x", "id": "3"}]}`))
+  })
+  serverMux.HandleFunc("/problem", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    w.Write([]byte(`{"type": "about:blank", "title": "Invalid name", "detail": "name must not be empty", "status": 422}`))
+  })
+  serverMux.HandleFunc("/form", func(w http.ResponseWriter, r *http.Request) {
+    /* Only the one field, so nothing else can be mistaken for it */
+    r.ParseForm()
+    if len(r.PostForm) != 1 {
+      http.Error(w, fmt.Sprintf("expected one form field but got %v", r.PostForm), http.StatusBadRequest)
+      return
+    }
+    w.Write([]byte(r.Header.Get("Content-Type") + "\n" + r.PostForm.Get("payload")))
+  })
+  serverMux.HandleFunc("/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-RateLimit-Limit", "100")
+    w.Header().Set("X-RateLimit-Remaining", "99")
+    w.Header().Set("RateLimit-Reset", "soon")
+    w.Write([]byte("It works!"))
+  })
+  serverMux.HandleFunc("/authorization", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(r.Header.Get("Authorization")))
+  })
+  serverMux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+    http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+  })
+  serverMux.HandleFunc("/xssi", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(")]}'\n{\"id\": \"1\"}-- served by api-7\n"))
+  })
+  serverMux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/"})
+  })
+  serverMux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+    if c, err := r.Cookie("session"); err == nil { w.Write([]byte(c.Value)) }
+  })
+  serverMux.HandleFunc("/counted/", func(w http.ResponseWriter, r *http.Request) {
+    /* Every response is different, so a cached one is obvious */
+    w.Write([]byte(fmt.Sprintf("%d", atomic.AddInt32(&counted_requests, 1))))
+  })
+  serverMux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+    /* Unavailable for the first two attempts */
+    if atomic.AddInt32(&flaky_requests, 1) < 3 {
+      http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+      return
+    }
+    w.Write([]byte("It works!"))
+  })
+  serverMux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+    /* Echo back the names of the headers that were sent */
+    for name := range r.Header {
+      w.Write([]byte(name + "\n"))
+    }
+  })
+  serverMux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+    /* Only the third attempt has a body */
+    if atomic.AddInt32(&empty_requests, 1) >= 3 {
+      w.Write([]byte(`{"id": "1"}`))
+    }
+  })
+  serverMux.HandleFunc("/yaml", func(w http.ResponseWriter, r *http.Request) {
+    if r.Header.Get("Content-Type") != "application/yaml" {
+      http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+      return
+    }
+    w.Write([]byte("id: \"1\"\nspec:\n  size: 3\n"))
   })
   serverMux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
     time.Sleep(9999 * time.Second)
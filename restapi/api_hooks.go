@@ -0,0 +1,79 @@
+package restapi
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+/* What is known about one attempt at a request. The status,
+   header, duration and err are only set once it is done */
+type request_info struct {
+	method   string
+	path     string
+	uri      string
+	attempt  int
+	start    time.Time
+	status   int
+	header   http.Header
+	duration time.Duration
+	err      error
+
+	/* For hooks to keep whatever they need between calls, such
+	   as a tracing span */
+	context map[string]interface{}
+}
+
+/* Called around every attempt at a request, for tracing and
+   metrics. before_request is called just before the attempt
+   is sent and after_request once it is done, with the same
+   info. Both may be called from many requests at once */
+type request_hooks interface {
+	before_request(info *request_info)
+	after_request(info *request_info)
+}
+
+/* The default, which does nothing */
+type no_request_hooks struct{}
+
+func (no_request_hooks) before_request(info *request_info) {}
+func (no_request_hooks) after_request(info *request_info)  {}
+
+/* Logs one line per attempt with how it went and how long
+   it took, for log_requests */
+type log_request_hooks struct{}
+
+func (log_request_hooks) before_request(info *request_info) {}
+
+func (log_request_hooks) after_request(info *request_info) {
+	if info.err != nil && info.status == 0 {
+		log.Printf("[INFO] api_hooks.go: %s %s (attempt %d) failed after %s: %s\n", info.method, info.path, info.attempt, info.duration.Round(time.Millisecond), info.err)
+		return
+	}
+	log.Printf("[INFO] api_hooks.go: %s %s (attempt %d) returned %d in %s\n", info.method, info.path, info.attempt, info.status, info.duration.Round(time.Millisecond))
+}
+
+/* Send one attempt at a request with the hooks called
+   around it */
+func (client *api_client) send_request_hooked(method string, path string, data string, headers map[string]string, attempt int) (string, *http.Response, error) {
+	info := &request_info{
+		method:  method,
+		path:    path,
+		uri:     client.uri + path,
+		attempt: attempt,
+		start:   time.Now(),
+		context: make(map[string]interface{}),
+	}
+	client.hooks.before_request(info)
+
+	body, resp, err := client.send_request_attempt(method, path, data, headers, client.attempt_timeout(attempt))
+
+	info.duration = time.Since(info.start)
+	info.err = err
+	if resp != nil {
+		info.status = resp.StatusCode
+		info.header = resp.Header
+	}
+	client.hooks.after_request(info)
+	return body, resp, err
+}
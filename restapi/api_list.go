@@ -0,0 +1,264 @@
+package restapi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* How to page through a collection. page_param is the query
+   parameter for the page number (starting at 1) and
+   page_size_param the one asking for page_size objects per
+   page. If page_size_path is set, it is the dotted path to
+   the page size the server actually used, which may be less
+   than what was asked for. With cached, pages may come from
+   the response cache (see send_request_cached) */
+type list_paging struct {
+	page_param      string
+	page_size_param string
+	page_size       int
+	page_size_path  string
+	cached          bool
+}
+
+/* Read a collection of objects from the API. If results_key
+   is set, it is the dotted path to the array of objects in
+   the response. Otherwise the response must be the array.
+   With paging, pages are read until one comes back short
+   or empty */
+func (client *api_client) list_objects(path string, results_key string, paging *list_paging) ([]interface{}, error) {
+	list, _, _, err := client.list_pages(path, results_key, paging)
+	return list, err
+}
+
+/* list_objects, also handing back the first page as parsed
+   and the response to the last request (for its status when
+   it failed, and nil from the cache) */
+func (client *api_client) list_pages(path string, results_key string, paging *list_paging) ([]interface{}, interface{}, *http.Response, error) {
+	if paging == nil {
+		paging = &list_paging{}
+	}
+
+	list := make([]interface{}, 0)
+	var first interface{}
+	var resp *http.Response
+	page_size := paging.page_size
+	for page := 1; ; page++ {
+		query := url.Values{}
+		if paging.page_param != "" {
+			query.Set(paging.page_param, strconv.Itoa(page))
+		}
+		if paging.page_size_param != "" && page_size > 0 {
+			query.Set(paging.page_size_param, strconv.Itoa(page_size))
+		}
+		page_path := path
+		if len(query) > 0 {
+			if strings.Contains(path, "?") {
+				page_path += "&" + query.Encode()
+			} else {
+				page_path += "?" + query.Encode()
+			}
+		}
+
+		items, parsed, page_resp, err := client.list_page(page_path, results_key, paging.cached)
+		resp = page_resp
+		if err != nil {
+			return nil, nil, resp, err
+		}
+		if page == 1 {
+			first = parsed
+		}
+		list = append(list, items...)
+
+		if paging.page_param == "" || len(items) == 0 {
+			break
+		}
+
+		/* The server may cap the page size. Ask for what it
+		   allows from now on, so page numbers still line up */
+		if paging.page_size_path != "" {
+			if val, ok := get_path(parsed, paging.page_size_path); ok {
+				if used, ok := val.(float64); ok && used > 0 && (page_size <= 0 || int(used) < page_size) {
+					if client.debug {
+						log.Printf("api_list.go: Server used a page size of %d rather than %d\n", int(used), page_size)
+					}
+					page_size = int(used)
+				}
+			}
+		}
+		/* Without a page size, only an empty page is the end */
+		if page_size > 0 && len(items) < page_size {
+			break
+		}
+	}
+
+	if client.debug {
+		log.Printf("api_list.go: Read %d objects from '%s'\n", len(list), path)
+	}
+	return list, first, resp, nil
+}
+
+/* Read one page of a collection. The whole response is also
+   returned, parsed so paging information can be taken from
+   it and as the HTTP response (unless it came from the cache).
+   Without a results_key, list_unwrap_path is used */
+func (client *api_client) list_page(path string, results_key string, cached bool) ([]interface{}, interface{}, *http.Response, error) {
+	if results_key == "" {
+		results_key = client.list_unwrap_path
+	}
+
+	var res_str string
+	var resp *http.Response
+	var err error
+	if cached {
+		res_str, err = client.send_request_cached("GET", path, "")
+	} else {
+		res_str, resp, err = client.send_request_full("GET", path, "", nil)
+	}
+	if err != nil {
+		return nil, nil, resp, err
+	}
+
+	/* An empty collection may come back as [], null or nothing
+	   at all, and none of them is an error */
+	if strings.TrimSpace(res_str) == "" {
+		return make([]interface{}, 0), nil, resp, nil
+	}
+	parsed, err := client.decode_json(res_str)
+	if err != nil {
+		return nil, nil, resp, err
+	}
+	if parsed == nil {
+		return make([]interface{}, 0), nil, resp, nil
+	}
+
+	results, ok := get_path(parsed, results_key)
+	if !ok {
+		return nil, nil, resp, errors.New(fmt.Sprintf("The response from '%s' does not contain '%s'", path, results_key))
+	}
+	if results == nil {
+		return make([]interface{}, 0), parsed, resp, nil
+	}
+
+	list, ok := results.([]interface{})
+	if !ok {
+		return nil, nil, resp, errors.New(fmt.Sprintf("Expected an array of objects from '%s' (results_key='%s') but got: %s", path, results_key, res_str))
+	}
+	return list, parsed, resp, nil
+}
+
+/* Apply a JMESPath expression to a list of objects, such as
+   "[?enabled]" or "[*].{id: id, name: name}". If the result
+   is not a list, it becomes the only item in the list. The
+   result does not keep the order of keys in objects */
+func filter_objects(list []interface{}, expression string) ([]interface{}, error) {
+	result, err := jmespath.Search(expression, plain_value(list))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid filter '%s': %s", expression, err))
+	}
+
+	switch v := result.(type) {
+	case nil:
+		return make([]interface{}, 0), nil
+	case []interface{}:
+		return v, nil
+	default:
+		return []interface{}{v}, nil
+	}
+}
+
+/* Read several objects by id, at most parallel at a time.
+   Each is read from path with {id} replaced by the id (or
+   /<id> appended). Every failure is reported, not just the
+   first, and no objects are returned if any read fails.
+   Responses may come from the response cache */
+func (client *api_client) read_objects(path string, ids []string, parallel int) (map[string]string, error) {
+	objects := make(map[string]string)
+	var mutex sync.Mutex
+	failures := client.for_each_object(path, ids, parallel, func(id string, object_path string) error {
+		res_str, err := client.send_request_cached("GET", object_path, "")
+		if err == nil {
+			res_str, err = client.unwrap_object(res_str)
+		}
+		if err == nil {
+			mutex.Lock()
+			objects[id] = res_str
+			mutex.Unlock()
+		}
+		return err
+	})
+
+	if len(failures) > 0 {
+		return nil, errors.New(fmt.Sprintf("Failed to read %d of %d objects from '%s':\n%s", len(failures), len(ids), path, strings.Join(failures, "\n")))
+	}
+
+	if client.debug {
+		log.Printf("api_list.go: Read %d objects by id from '%s'\n", len(objects), path)
+	}
+	return objects, nil
+}
+
+/* Delete several objects by id, at most parallel at a time,
+   the same way read_objects reads them. A failure does not
+   stop the other deletes, and the error lists every id that
+   failed, so deleting again only has those left to do */
+func (client *api_client) delete_objects(path string, ids []string, parallel int) error {
+	failures := client.for_each_object(path, ids, parallel, func(id string, object_path string) error {
+		_, err := client.send_request("DELETE", object_path, "")
+		return err
+	})
+
+	if len(failures) > 0 {
+		return errors.New(fmt.Sprintf("Failed to delete %d of %d objects from '%s':\n%s", len(failures), len(ids), path, strings.Join(failures, "\n")))
+	}
+
+	if client.debug {
+		log.Printf("api_list.go: Deleted %d objects by id from '%s'\n", len(ids), path)
+	}
+	return nil
+}
+
+/* Call fn for each id with the path of that object, at most
+   parallel at a time. The failures, one line per id, are
+   returned sorted */
+func (client *api_client) for_each_object(path string, ids []string, parallel int, fn func(id string, object_path string) error) []string {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	failures := make([]string, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan bool, parallel)
+
+	for _, id := range ids {
+		object_path := strings.Replace(path, "{id}", id, -1)
+		if object_path == path {
+			object_path = strings.TrimRight(path, "/") + "/" + id
+		}
+
+		wg.Add(1)
+		slots <- true
+		go func(id string, object_path string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := fn(id, object_path); err != nil {
+				mutex.Lock()
+				failures = append(failures, fmt.Sprintf("  %s: %s", id, err))
+				mutex.Unlock()
+			}
+		}(id, object_path)
+	}
+	wg.Wait()
+
+	sort.Strings(failures)
+	return failures
+}
@@ -0,0 +1,204 @@
+package restapi
+
+import (
+	"encoding/json"
+	"github.com/compassmarketing/terraform-provider-restapi/fakeserver"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPIList(t *testing.T) {
+	generated_objects := make(map[string]test_api_object)
+	api_server_objects := make(map[string]map[string]interface{})
+	generate_test_api_objects(&generated_objects, &api_server_objects, t, test_debug)
+
+	svr := fakeserver.NewFakeServer(8083, api_server_objects, true, http_server_debug)
+	defer svr.Shutdown()
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8083/",
+		timeout:      5,
+		id_attribute: "Id",
+		debug:        api_client_debug,
+	})
+
+	log.Printf("api_list_test.go: Testing list_objects()")
+	list, err := client.list_objects("/api/objects", "", nil)
+	if err != nil {
+		t.Fatalf("api_list_test.go: Failed to list objects: %s", err)
+	} else if len(list) != len(api_server_objects) {
+		t.Fatalf("api_list_test.go: Expected %d objects but got %d", len(api_server_objects), len(list))
+	}
+
+	log.Printf("api_list_test.go: Testing filter_objects()")
+	cats, err := filter_objects(list, "[?Is_cat]")
+	if err != nil {
+		t.Fatalf("api_list_test.go: Failed to filter objects: %s", err)
+	} else if len(cats) != 1 || cats[0].(map[string]interface{})["Test_case"] != "pet" {
+		t.Fatalf("api_list_test.go: Expected only the 'pet' object but got %+v", cats)
+	}
+
+	things, err := filter_objects(list, "[*].Thing")
+	if err != nil {
+		t.Fatalf("api_list_test.go: Failed to reshape objects: %s", err)
+	} else if len(things) != len(list) || things[0] != "potato" {
+		t.Fatalf("api_list_test.go: Expected a list of every Thing starting with 'potato' but got %+v", things)
+	}
+
+	if _, err = filter_objects(list, "[?"); err == nil {
+		t.Fatalf("api_list_test.go: Expected an error from an invalid filter")
+	}
+}
+
+func TestAPIReadObjects(t *testing.T) {
+	generated_objects := make(map[string]test_api_object)
+	api_server_objects := make(map[string]map[string]interface{})
+	generate_test_api_objects(&generated_objects, &api_server_objects, t, test_debug)
+
+	svr := fakeserver.NewFakeServer(8083, api_server_objects, true, http_server_debug)
+	defer svr.Shutdown()
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8083/",
+		timeout:      5,
+		id_attribute: "Id",
+		debug:        api_client_debug,
+	})
+
+	log.Printf("api_list_test.go: Testing read_objects()")
+	objects, err := client.read_objects("/api/objects", []string{"1", "2", "3"}, 2)
+	if err != nil {
+		t.Fatalf("api_list_test.go: Failed to read objects: %s", err)
+	} else if len(objects) != 3 || !strings.Contains(objects["2"], `"fork"`) {
+		t.Fatalf("api_list_test.go: Expected objects 1, 2 and 3 but got %+v", objects)
+	}
+
+	_, err = client.read_objects("/api/objects/{id}", []string{"1", "missing", "gone"}, 2)
+	if err == nil {
+		t.Fatalf("api_list_test.go: Expected an error reading objects that do not exist")
+	} else if !strings.Contains(err.Error(), "2 of 3") || !strings.Contains(err.Error(), "missing:") || !strings.Contains(err.Error(), "gone:") {
+		t.Fatalf("api_list_test.go: Expected the error to list both missing objects but got: %s", err)
+	}
+}
+
+func TestAPIDeleteObjects(t *testing.T) {
+	generated_objects := make(map[string]test_api_object)
+	api_server_objects := make(map[string]map[string]interface{})
+	generate_test_api_objects(&generated_objects, &api_server_objects, t, test_debug)
+
+	svr := fakeserver.NewFakeServer(8083, api_server_objects, true, http_server_debug)
+	defer svr.Shutdown()
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8083/",
+		timeout:      5,
+		id_attribute: "Id",
+		debug:        api_client_debug,
+	})
+
+	log.Printf("api_list_test.go: Testing delete_objects()")
+	err := client.delete_objects("/api/objects", []string{"1", "missing", "2", "3"}, 2)
+	if err == nil {
+		t.Fatalf("api_list_test.go: Expected an error deleting an object that does not exist")
+	} else if !strings.Contains(err.Error(), "1 of 4") || !strings.Contains(err.Error(), "missing:") || strings.Contains(err.Error(), "  2:") {
+		t.Fatalf("api_list_test.go: Expected the error to list only the missing object but got: %s", err)
+	}
+
+	/* The failure did not stop the others */
+	if _, err = client.read_objects("/api/objects", []string{"4"}, 1); err != nil {
+		t.Fatalf("api_list_test.go: Expected object 4 to be left alone but got: %s", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err = client.read_objects("/api/objects", []string{id}, 1); err == nil {
+			t.Fatalf("api_list_test.go: Expected object %s to have been deleted", id)
+		}
+	}
+}
+
+func TestAPIListPaging(t *testing.T) {
+	var requests int32
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/items", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		/* 250 items, at most 100 per page */
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		per_page, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		if per_page <= 0 || per_page > 100 {
+			per_page = 100
+		}
+		items := make([]interface{}, 0)
+		for i := (page - 1) * per_page; i < page*per_page && i < 250; i++ {
+			items = append(items, map[string]interface{}{"id": strconv.Itoa(i)})
+		}
+		b, _ := json.Marshal(map[string]interface{}{"items": items, "per_page": per_page})
+		w.Write(b)
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8091", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8091/",
+		timeout:      5,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	log.Printf("api_list_test.go: Testing list_objects() with paging")
+	list, err := client.list_objects("/api/items", "items", &list_paging{page_param: "page", page_size_param: "per_page", page_size: 500, page_size_path: "per_page"})
+	if err != nil {
+		t.Fatalf("api_list_test.go: Failed to list objects: %s", err)
+	} else if len(list) != 250 || list[249].(map[string]interface{})["id"] != "249" {
+		t.Fatalf("api_list_test.go: Expected all 250 objects in order but got %d", len(list))
+	} else if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("api_list_test.go: Expected 3 requests for 250 objects at 100 per page but made %d", n)
+	}
+}
+
+func TestAPIListEmpty(t *testing.T) {
+	serverMux := http.NewServeMux()
+	for path, body := range map[string]string{
+		"/api/array":      `[]`,
+		"/api/null":       `null`,
+		"/api/nothing":    ``,
+		"/api/items":      `{"items": []}`,
+		"/api/null_items": `{"items": null}`,
+		"/api/no_items":   `{"count": 0}`,
+	} {
+		body := body
+		serverMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	svr := &http.Server{Addr: "127.0.0.1:8103", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8103/",
+		timeout:      5,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	log.Printf("api_list_test.go: Testing empty collections are empty lists")
+	for path, results_key := range map[string]string{"/api/array": "", "/api/null": "", "/api/nothing": "", "/api/items": "items", "/api/null_items": "items"} {
+		list, err := client.list_objects(path, results_key, &list_paging{page_param: "page"})
+		if err != nil {
+			t.Fatalf("api_list_test.go: Expected no error listing the empty collection at '%s' but got: %s", path, err)
+		} else if list == nil || len(list) != 0 {
+			t.Fatalf("api_list_test.go: Expected an empty list from '%s' but got %+v", path, list)
+		}
+	}
+
+	if _, err := client.list_objects("/api/no_items", "items", nil); err == nil {
+		t.Fatalf("api_list_test.go: Expected an error when the response has no results_key at all")
+	}
+}
@@ -4,57 +4,239 @@ import (
   "log"
   "errors"
   "fmt"
+  "crypto/sha256"
+  "encoding/hex"
   "encoding/json"
   "bytes"
+  "net/http"
+  "net/url"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
   "github.com/davecgh/go-spew/spew"
+  "gopkg.in/yaml.v2"
 )
 
+/* Matches {name} placeholders in an object's path */
+var path_param_regexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+/* Matches the {id} and {data.<path>} placeholders in
+   destroy_data, which is usually JSON with braces of its own */
+var body_param_regexp = regexp.MustCompile(`\{(id|data\.[^{}]+)\}`)
+
+type api_object_opt struct {
+  path                 string
+  id                   string
+  data                 string
+  debug                bool
+  ready_status_field   string
+  ready_status_value   string
+  failed_status_values []string
+  ready_timeout        int
+  ready_poll_interval  int
+  api_schema           map[string]string
+  preserve_unknown     bool
+  update_defaults      string
+  server_defaults      string
+  update_copy_keys     []string
+  preserve_fields      []string
+  coerce_fields        map[string]string
+  prior_response       string
+  read_before_destroy  bool
+  destroy_data         string
+  destroy_headers      map[string]string
+  probe_method         string
+  probe_query          string
+  query_params         map[string]string
+  create_lookup_path   string
+  create_lookup_query  map[string]string
+  create_lookup_key    string
+  operation            async_operation
+  self_link            string
+  list_read            list_read
+  dedup_keys           []string
+}
+
+/* For APIs that answer a create with 202 Accepted and a
+   reference to an operation in the body, rather than with
+   the object or a Location. id_path is the dotted path to
+   the operation's id in that body and path is where the
+   operation is read, with {operation_id} in it. The create is
+   done when the field at status_path reaches one of the
+   success_values, and the object's id is then read from
+   result_id_path in the operation if it was not known */
+type async_operation struct {
+  id_path        string
+  path           string
+  status_path    string
+  success_values []string
+  failed_values  []string
+  result_id_path string
+}
+
+/* For APIs with no way to GET one object. It is read by
+   listing path (page by page with paging) and picking the
+   object whose id_path (id_attribute if not set) matches
+   its id.
+   With paginated, the object itself is a collection whose
+   array at results_key spans pages of the object's own path,
+   which are all read into it */
+type list_read struct {
+  path        string
+  results_key string
+  id_path     string
+  paging      list_paging
+  paginated   bool
+}
+
+/* Returned by read_object when an object read from a list
+   is not in it, so it can be treated as gone */
+var object_not_listed = errors.New("The object was not found in its list")
+
+/* The parts of api_data named in an api_schema, converted
+   to the types asked for, plus anything else if requested */
+type typed_api_data struct {
+  strings map[string]string
+  numbers map[string]float64
+  bools   map[string]bool
+  json    map[string]string
+  other   map[string]string
+}
+
 type api_object struct {
   api_client           *api_client
   path                 string
   debug                bool
   id                   string
+  ready_status_field   string
+  ready_status_value   string
+  failed_status_values []string
+  ready_timeout        int
+  ready_poll_interval  int
+  api_schema           map[string]string
+  preserve_unknown     bool
+  update_defaults      map[string]interface{}
+  server_defaults      map[string]interface{} /* What the server filled in on the first read, with merge_server_defaults */
+  update_copy_keys     []string
+  preserve_fields      []string
+  coerce_fields        map[string]string
+  prior_response       string /* The object as last stored in state */
+  read_before_destroy  bool
+  destroy_data         string
+  destroy_headers      map[string]string
+  probe_method         string
+  probe_query          string
+  query_params         map[string]string
+  create_lookup_path   string
+  create_lookup_query  map[string]string
+  create_lookup_key    string
+  operation            async_operation
+  self_link            string
+  list_read            list_read
+  dedup_keys           []string
 
   /* Set internally */
   data         map[string]interface{} /* Data as managed by the user */
   api_data     map[string]interface{} /* Data as available from the API */
+  api_response string                 /* The last response body exactly as the API sent it */
+  typed        typed_api_data         /* api_data converted according to api_schema */
+  write_result string                 /* What the last create or update did: created, updated or "" */
 }
 
 // Make an api_object to manage a RESTful object in an API
-func NewAPIObject (i_client *api_client, i_path string, i_id string, i_data string, i_debug bool) (*api_object, error) {
-  if i_debug {
+func NewAPIObject (i_client *api_client, opt *api_object_opt) (*api_object, error) {
+  if opt.debug {
     log.Printf("api_object.go: Constructing debug api_object\n")
-    log.Printf(" path: %s\n", i_path)
-    log.Printf(" id: %s\n", i_id)
+    log.Printf(" path: %s\n", opt.path)
+    log.Printf(" id: %s\n", opt.id)
   }
 
+  /* Sane defaults */
+  if opt.ready_poll_interval <= 0 { opt.ready_poll_interval = 5 }
+
   obj := api_object{
     api_client: i_client,
-    path: i_path,
-    debug: i_debug,
-    id: i_id,
+    path: opt.path,
+    debug: opt.debug,
+    id: i_client.normalize_id(opt.id),
+    ready_status_field: opt.ready_status_field,
+    ready_status_value: opt.ready_status_value,
+    failed_status_values: opt.failed_status_values,
+    ready_timeout: opt.ready_timeout,
+    ready_poll_interval: opt.ready_poll_interval,
+    api_schema: opt.api_schema,
+    preserve_unknown: opt.preserve_unknown,
+    update_defaults: make(map[string]interface{}),
+    server_defaults: make(map[string]interface{}),
+    update_copy_keys: opt.update_copy_keys,
+    preserve_fields: opt.preserve_fields,
+    coerce_fields: opt.coerce_fields,
+    prior_response: opt.prior_response,
+    read_before_destroy: opt.read_before_destroy,
+    destroy_data: opt.destroy_data,
+    destroy_headers: opt.destroy_headers,
+    probe_method: opt.probe_method,
+    probe_query: opt.probe_query,
+    query_params: opt.query_params,
+    create_lookup_path: opt.create_lookup_path,
+    create_lookup_query: opt.create_lookup_query,
+    create_lookup_key: opt.create_lookup_key,
+    operation: opt.operation,
+    self_link: opt.self_link,
+    list_read: opt.list_read,
+    dedup_keys: opt.dedup_keys,
     data: make(map[string]interface{}),
     api_data: make(map[string]interface{}),
   }
 
-  if "" == i_path { return nil, errors.New("No path passed to api_object constructor") }
-  if "" == i_data { return nil, errors.New("No data passed to api_object constructor") }
+  if "" == opt.path { return nil, errors.New("No path passed to api_object constructor") }
+  if "" == opt.data { return nil, errors.New("No data passed to api_object constructor") }
+  if opt.list_read.paginated {
+    if opt.list_read.path != "" { return nil, errors.New("read_paginated cannot be used with read_list_path") }
+    if opt.list_read.results_key == "" || opt.list_read.paging.page_param == "" {
+      return nil, errors.New("read_paginated needs read_list_results_key (where the items are in each page) and read_list_page_param")
+    }
+  }
 
-  if i_data != ""{
-    if i_debug { log.Printf("api_object.go: Parsing data: '%s'", i_data) }
+  if opt.data != ""{
+    if opt.debug { log.Printf("api_object.go: Parsing data: '%s'", i_client.log_body(opt.data)) }
 
-    err := json.Unmarshal([]byte(i_data), &obj.data)
+    err := json.Unmarshal([]byte(opt.data), &obj.data)
     if err != nil {
       return nil, err
     }
 
+    if opt.update_defaults != "" {
+      err = json.Unmarshal([]byte(opt.update_defaults), &obj.update_defaults)
+      if err != nil { return nil, errors.New(fmt.Sprintf("Could not parse update_defaults as a JSON object: %s", err)) }
+    }
+
+    if opt.server_defaults != "" {
+      err = json.Unmarshal([]byte(opt.server_defaults), &obj.server_defaults)
+      if err != nil { return nil, errors.New(fmt.Sprintf("Could not parse server_defaults as a JSON object: %s", err)) }
+    }
+
+    /* Find fields that cannot be converted before anything
+       is sent, rather than partway through an apply */
+    for field, to := range obj.coerce_fields {
+      if to != "string" && to != "number" && to != "bool" {
+        return nil, errors.New(fmt.Sprintf("coerce_fields field '%s' has unknown type '%s'. Must be one of string, number or bool.", field, to))
+      }
+      if _, err := coerce_field(obj.data, field, to); err != nil {
+        return nil, errors.New(fmt.Sprintf("coerce_fields field '%s': %s", field, err))
+      }
+    }
+
     /* Opportunistically set the object's ID if it is provided in the data.
        If it is not set, we will get it later in synchronize_state */
     if obj.id == "" {
-      val, ok := obj.data[obj.api_client.id_attribute]
+      numbered, _ := decode_numbers(opt.data)
+      val, ok := get_key(numbered, obj.api_client.id_attribute)
       if ok {
-        obj.id = fmt.Sprintf("%v", val)
-      } else if !obj.api_client.write_returns_object && !obj.api_client.create_returns_object {
+        obj.id = obj.api_client.normalize_id(id_string(val))
+      } else if !obj.api_client.write_returns_object && !obj.api_client.create_returns_object && !obj.api_client.id_from_location && !obj.has_create_lookup() && obj.operation.result_id_path == "" {
         /* If the id is not set and we cannot obtain it
 	   later, error out to be safe */
         return nil, errors.New(fmt.Sprintf("Provided data does not have %s attribute for the object's id and the client is not configured to read the object from a POST response. Without an id, the object cannot be managed.", obj.api_client.id_attribute))
@@ -73,8 +255,8 @@ func (obj *api_object) toString() string {
   buffer.WriteString(fmt.Sprintf("id: %s\n", obj.id))
   buffer.WriteString(fmt.Sprintf("path: %s\n", obj.path))
   buffer.WriteString(fmt.Sprintf("debug: %t\n", obj.debug))
-  buffer.WriteString(fmt.Sprintf("data: %s\n", spew.Sdump(obj.data)))
-  buffer.WriteString(fmt.Sprintf("api_data: %s\n", spew.Sdump(obj.api_data)))
+  buffer.WriteString(fmt.Sprintf("data: %s\n", spew.Sdump(obj.api_client.mask_value(obj.data))))
+  buffer.WriteString(fmt.Sprintf("api_data: %s\n", spew.Sdump(obj.api_client.mask_value(obj.api_data))))
   return buffer.String()
 }
 
@@ -82,30 +264,37 @@ func (obj *api_object) toString() string {
    the api_object is updated with data that has come back from
    the API */
 func (obj *api_object) update_state(state string) error {
-  if obj.debug { log.Printf("api_object.go: Updating API object state to '%s'\n", state) }
+  if obj.debug { log.Printf("api_object.go: Updating API object state to '%s'\n", obj.api_client.log_body(state)) }
+  obj.api_response = state
 
-  /* Other option - Decode as JSON Numbers instead of golang datatypes
-  d := json.NewDecoder(strings.NewReader(res_str))
-  d.UseNumber()
-  err = d.Decode(&obj.api_data)
-  */
   err := json.Unmarshal([]byte(state), &obj.api_data)
   if err != nil { return err }
 
+  /* The id is looked for in a copy decoded as json.Number so
+     large integer ids are not rounded through a float64 */
+  numbered, err := decode_numbers(state)
+  if err != nil { return err }
+
   /* A usable ID was not passed (in constructor or here), 
      so we have to guess what it is from the data structure */
   if obj.id == "" {
-    val, ok := obj.api_data[obj.api_client.id_attribute]
-    if ok {
-      /* Coax to string */
-      obj.id = fmt.Sprintf("%v", val)
+    obj.id = obj.find_id(numbered)
+    if obj.id != "" {
       log.Printf("api_object.go: Updating object id (unset) to '%s'\n", obj.id)
     } else {
       /* An ID is REQUIRED to manage the object. We canot proceed */
-      err_message := fmt.Sprintf("api_object.go: Error: %s is not in the data presented nor passed in the constructor.\n", obj.api_client.id_attribute)
+      err_message := fmt.Sprintf("Error: %s is not in the data presented nor passed in the constructor.\n", obj.api_client.id_attribute)
       err_message += fmt.Sprintf("List of keys available:\n")
-      for k := range obj.data { err_message += fmt.Sprintf("  %s\n", k) }
-      errors.New(err_message)
+      for k := range obj.api_data { err_message += fmt.Sprintf("  %s\n", k) }
+      return errors.New(err_message)
+    }
+  } else if new_id := obj.find_id(numbered); new_id != "" && new_id != obj.id && obj.api_client.id_changed != "" && obj.api_client.id_changed != "ignore" {
+    /* Some APIs change an object's id. Say so, or follow it */
+    if obj.api_client.id_changed == "adopt" {
+      log.Printf("api_object.go: WARNING: The API now has %s '%s' for the object with id '%s'. Using the new id.\n", obj.api_client.id_attribute, new_id, obj.id)
+      obj.id = new_id
+    } else {
+      return errors.New(fmt.Sprintf("The object with id '%s' now has %s '%s' in the API. Set id_changed to adopt to follow the new id.", obj.id, obj.api_client.id_attribute, new_id))
     }
   } else if obj.debug {
     log.Printf("api_object.go: Not updating id. It is already set to '%s'\n", obj.id)
@@ -114,45 +303,479 @@ func (obj *api_object) update_state(state string) error {
   /* Any keys that come from the data we want to copy are done here */
   if len(obj.api_client.copy_keys) > 0 {
     for _, key := range obj.api_client.copy_keys {
+      if obj.empty_as_absent(key) {
+        if obj.debug { log.Printf("api_object.go: Not copying key '%s', which is empty or missing in both api_data and data\n", key) }
+        continue
+      }
       if obj.debug {
-        log.Printf("api_object.go: Copying key '%s' from api_data (%v) to data (%v)\n", key, obj.api_data[key], obj.data[key])
+        server, _ := get_key(obj.api_data, key)
+        user, _ := get_key(obj.data, key)
+        log.Printf("api_object.go: Copying key '%s' from api_data (%v) to data (%v)\n", key, server, user)
+      }
+      if !set_key(obj.data, key, obj.copy_key_value(key)) {
+        log.Printf("api_object.go: WARNING: Unable to copy key '%s' into data\n", key)
       }
-      obj.data[key] = obj.api_data[key]
     }
   } else if obj.debug {
     log.Printf("api_object.go: copy_keys is empty - not attempting to copy data")
   }
 
+  /* Keep the last link the API gave, if any */
+  if obj.api_client.self_link_path != "" {
+    if link, ok := get_path(obj.api_data, obj.api_client.self_link_path); ok && link != nil && fmt.Sprintf("%v", link) != "" {
+      obj.self_link = fmt.Sprintf("%v", link)
+    }
+  }
+
+  obj.typed, err = obj.type_api_data()
+  if err != nil { return err }
+
   if obj.debug {
     log.Printf("api_object.go: final object after synchronization of state:\n%+v\n", obj.toString())
   }
   return err
 }
 
+/* Whether key is one of copy_keys_empty_as_absent and is
+   empty ("", null or missing) in both api_data and data, so
+   the two are the same and data is left as the user set it */
+func (obj *api_object) empty_as_absent(key string) bool {
+  empty := func(data map[string]interface{}) bool {
+    val, ok := get_key(data, key)
+    return !ok || val == nil || val == ""
+  }
+  for _, k := range obj.api_client.copy_keys_empty_as_absent {
+    if k == key { return empty(obj.api_data) && empty(obj.data) }
+  }
+  return false
+}
+
+/* The value copy_keys copies for key. Arrays are replaced
+   by what the API has unless the provider's
+   copy_keys_array_strategy for key says to merge them */
+func (obj *api_object) copy_key_value(key string) interface{} {
+  server_val, _ := get_key(obj.api_data, key)
+  user_val, _ := get_key(obj.data, key)
+  server, server_ok := server_val.([]interface{})
+  user, user_ok := user_val.([]interface{})
+  strategy := obj.api_client.copy_keys_array_strategy[key]
+  if !server_ok || !user_ok || strategy == "" || strategy == "replace" { return server_val }
+
+  merged := make([]interface{}, 0)
+  if strategy == "merge_by_index" {
+    for i, v := range user {
+      if i < len(server) { v = merge_missing(v, server[i]) }
+      merged = append(merged, v)
+    }
+    if len(server) > len(user) { merged = append(merged, server[len(user):]...) }
+    return merged
+  }
+
+  /* merge_by_key:<field> matches elements on that field */
+  field := strings.TrimPrefix(strategy, "merge_by_key:")
+  element_key := func(v interface{}) (string, bool) {
+    m, ok := v.(map[string]interface{})
+    if !ok || m[field] == nil { return "", false }
+    return fmt.Sprintf("%v", m[field]), true
+  }
+  by_key := make(map[string]interface{})
+  for _, v := range server {
+    if k, ok := element_key(v); ok { by_key[k] = v }
+  }
+  seen := make(map[string]bool)
+  for _, v := range user {
+    if k, ok := element_key(v); ok {
+      seen[k] = true
+      if s, ok := by_key[k]; ok { v = merge_missing(v, s) }
+    }
+    merged = append(merged, v)
+  }
+  for _, v := range server {
+    if k, ok := element_key(v); !ok || !seen[k] { merged = append(merged, v) }
+  }
+  return merged
+}
+
+/* Add the fields of server that user does not have. Only
+   objects are merged - otherwise user's value is kept */
+func merge_missing(user interface{}, server interface{}) interface{} {
+  u, ok := user.(map[string]interface{})
+  if !ok { return user }
+  s, ok := server.(map[string]interface{})
+  if !ok { return user }
+
+  merged := make(map[string]interface{})
+  for k, v := range s { merged[k] = v }
+  for k, v := range u { merged[k] = v }
+  return merged
+}
+
+/* Convert the fields named in api_schema (dotted paths into
+   api_data) to string, number, bool or json (a JSON string
+   of any value). Fields missing from api_data are skipped.
+   If preserve_unknown is set, top level keys not covered by
+   api_schema are kept in other as JSON strings */
+func (obj *api_object) type_api_data() (typed_api_data, error) {
+  typed := typed_api_data{
+    strings: make(map[string]string),
+    numbers: make(map[string]float64),
+    bools:   make(map[string]bool),
+    json:    make(map[string]string),
+    other:   make(map[string]string),
+  }
+  if len(obj.api_schema) == 0 { return typed, nil }
+
+  /* Sensitive fields are left out, and masked within json */
+  api_data := obj.api_client.mask_value(obj.api_data).(map[string]interface{})
+  known := make(map[string]bool)
+  for field, field_type := range obj.api_schema {
+    known[strings.SplitN(field, ".", 2)[0]] = true
+
+    val, ok := get_path(api_data, field)
+    if !ok || val == nil || val == redacted { continue }
+
+    switch field_type {
+    case "string":
+      if s, ok := val.(string); ok {
+        typed.strings[field] = s
+      } else {
+        b, _ := json.Marshal(val)
+        typed.strings[field] = strings.Trim(string(b), `"`)
+      }
+    case "number":
+      switch v := val.(type) {
+      case float64:
+        typed.numbers[field] = v
+      case string:
+        n, err := strconv.ParseFloat(v, 64)
+        if err != nil { return typed, errors.New(fmt.Sprintf("api_schema field '%s' is not a number: '%s'", field, v)) }
+        typed.numbers[field] = n
+      default:
+        return typed, errors.New(fmt.Sprintf("api_schema field '%s' is not a number: %v", field, val))
+      }
+    case "bool":
+      switch v := val.(type) {
+      case bool:
+        typed.bools[field] = v
+      case string:
+        b, err := strconv.ParseBool(v)
+        if err != nil { return typed, errors.New(fmt.Sprintf("api_schema field '%s' is not a bool: '%s'", field, v)) }
+        typed.bools[field] = b
+      default:
+        return typed, errors.New(fmt.Sprintf("api_schema field '%s' is not a bool: %v", field, val))
+      }
+    case "json":
+      b, _ := json.Marshal(val)
+      typed.json[field] = string(b)
+    default:
+      return typed, errors.New(fmt.Sprintf("api_schema field '%s' has unknown type '%s'. Must be one of string, number, bool or json.", field, field_type))
+    }
+  }
+
+  if obj.preserve_unknown {
+    for k, v := range api_data {
+      if known[k] { continue }
+      b, _ := json.Marshal(v)
+      typed.other[k] = string(b)
+    }
+  }
+  return typed, nil
+}
+
+/* Substitute every {name} placeholder in the object's path.
+   {id} is the object's id. Any other name is looked up in the
+   data managed by the user, then in the data from the API */
+func (obj *api_object) resolve_path(path string) (string, error) {
+  return obj.fill_placeholders(path, "path")
+}
+
+/* Fill {name} placeholders in any template (what says which,
+   for errors) the same way as in the path */
+func (obj *api_object) fill_placeholders(template string, what string) (string, error) {
+  var missing []string
+  resolved := path_param_regexp.ReplaceAllStringFunc(template, func(match string) string {
+    name := match[1:len(match)-1]
+    if name == "id" && obj.id != "" { return obj.id }
+    if val, ok := obj.api_client.path_variables[name]; ok { return val }
+    if val, ok := obj.data[name]; ok && val != nil { return id_string(val) }
+    if val, ok := obj.api_data[name]; ok && val != nil { return id_string(val) }
+    missing = append(missing, match)
+    return match
+  })
+
+  if len(missing) > 0 {
+    return "", errors.New(fmt.Sprintf("Unable to resolve parameter(s) %s in %s '%s'. Each must be the object's id, one of the provider's path_variables (%s) or a key in the object's data.", strings.Join(missing, ", "), what, template, obj.api_client.path_variable_names()))
+  }
+  if obj.debug { log.Printf("api_object.go: Resolved %s '%s' to '%s'\n", what, template, resolved) }
+  return resolved, nil
+}
+
+/* Fill {id} and {data.<path>} in destroy_data. The path is
+   looked up in the data managed by the user, then in the data
+   from the API. Anything else in braces is left alone. Values
+   are JSON escaped, so a string is safe inside quotes and any
+   other value (a number, or a whole object) stands alone */
+func (obj *api_object) fill_body_template(template string, what string) (string, error) {
+  var missing []string
+  filled := body_param_regexp.ReplaceAllStringFunc(template, func(match string) string {
+    name := match[1:len(match)-1]
+    if name == "id" && obj.id != "" { return json_escape(obj.id) }
+    path := strings.TrimPrefix(name, "data.")
+    if val, ok := get_path(obj.data, path); ok && val != nil { return json_escape(val) }
+    if val, ok := get_path(obj.api_data, path); ok && val != nil { return json_escape(val) }
+    missing = append(missing, match)
+    return match
+  })
+
+  if len(missing) > 0 {
+    return "", errors.New(fmt.Sprintf("Unable to resolve %s in %s '%s'. Each must be {id} or {data.<path>} for a path in the object's data.", strings.Join(missing, ", "), what, template))
+  }
+  if obj.debug { log.Printf("api_object.go: Resolved %s '%s' to '%s'\n", what, template, filled) }
+  return filled, nil
+}
+
+/* The path used to POST new objects. If the path ends
+   with an {id} segment, it is dropped since the id may
+   not be known until after the object is created */
+func (obj *api_object) collection_path() (string, error) {
+  path := strings.TrimSuffix(obj.path, "/{id}")
+  resolved, err := obj.resolve_path(path)
+  if err != nil { return "", err }
+  return obj.add_query_params(resolved)
+}
+
+/* The path used to GET, PUT and DELETE an existing object.
+   If the path does not say where the id goes, it is appended.
+   An object the API has linked to is always at its link */
+func (obj *api_object) object_path() (string, error) {
+  if obj.self_link != "" {
+    path, err := obj.api_client.path_from_link(obj.self_link)
+    if err != nil { return "", err }
+    return obj.add_query_params(path)
+  }
+
+  path := obj.path
+  if !strings.Contains(path, "{id}") {
+    path = path + "/{id}"
+  }
+  resolved, err := obj.resolve_path(path)
+  if err != nil { return "", err }
+
+  /* Go straight to where the API would redirect. Following
+     a redirect turns a PUT or DELETE into a GET */
+  switch obj.api_client.trailing_slash {
+  case "add":
+    if !strings.HasSuffix(resolved, "/") { resolved += "/" }
+  case "strip":
+    resolved = strings.TrimRight(resolved, "/")
+  }
+  return obj.add_query_params(resolved)
+}
+
+/* Add the query_params to a path, with their values filled
+   like {name} placeholders in the path and then escaped */
+func (obj *api_object) add_query_params(path string) (string, error) {
+  if len(obj.query_params) == 0 { return path, nil }
+
+  query, err := obj.query_values(obj.query_params, "query parameter")
+  if err != nil { return "", err }
+  return obj.api_client.add_query(path, query), nil
+}
+
+/* Fill each query parameter's template. A template that is
+   just a placeholder for an array in the data, as in
+   { "id" = "{ids}" }, gives the parameter a value for each
+   element, sent as query_array_style says */
+func (obj *api_object) query_values(templates map[string]string, what string) (url.Values, error) {
+  query := url.Values{}
+  for name, template := range templates {
+    if match := path_param_regexp.FindStringSubmatch(template); match != nil && match[0] == template {
+      if list, ok := obj.data[match[1]].([]interface{}); ok {
+        for _, item := range list { query.Add(name, id_string(item)) }
+        continue
+      }
+    }
+    value, err := obj.fill_placeholders(template, what + " " + name)
+    if err != nil { return nil, err }
+    query.Set(name, value)
+  }
+  return query, nil
+}
+
+/* Serialize the object's data the way the API expects to
+   receive it: as JSON or YAML. Some legacy APIs want it
+   percent-encoded in a form field rather than as the body */
+func (obj *api_object) request_body() string {
+  return obj.encode_body(obj.data)
+}
+
+func (obj *api_object) encode_body(data map[string]interface{}) string {
+  data = obj.body_data(data)
+
+  var b []byte
+  if obj.api_client.body_encoding == "yaml" {
+    b, _ = yaml.Marshal(data)
+  } else {
+    b, _ = json.Marshal(data)
+  }
+  if obj.api_client.body_form_field != "" {
+    return obj.api_client.body_form_field + "=" + url.QueryEscape(string(b))
+  }
+  return string(b)
+}
+
+/* The data as it is sent, before it is encoded */
+func (obj *api_object) body_data(data map[string]interface{}) map[string]interface{} {
+  /* Send each of coerce_fields as the type the API expects,
+     whatever type terraform made it */
+  for field, to := range obj.coerce_fields {
+    coerced, err := coerce_field(data, field, to)
+    if err != nil {
+      log.Printf("api_object.go: WARNING: Sending coerce_fields field '%s' as it is: %s\n", field, err)
+      continue
+    }
+    data = coerced.(map[string]interface{})
+  }
+  /* To some APIs a null means remove the field */
+  if obj.api_client.null_fields == "strip" {
+    data = strip_nulls(data).(map[string]interface{})
+  }
+  /* So a server comparing or signing the body sees the same
+     bytes however the text was typed */
+  if obj.api_client.normalize_unicode {
+    data = normalize_nfc(data).(map[string]interface{})
+  }
+  return data
+}
+
+/* What a create or update sends, for verify_created to
+   compare with what the API kept. It is a copy, since sending
+   fills in data */
+func (obj *api_object) sent_data() map[string]interface{} {
+  sent := make(map[string]interface{})
+  for k, v := range obj.body_data(obj.data) { sent[k] = v }
+  return sent
+}
+
+/* The best guess at the data of an object being imported,
+   since whatever created it is not known: the object as read,
+   less copy_keys and computed_keys, which the API sets itself
+   rather than the user */
+func (obj *api_object) imported_data() string {
+  /* A deep copy, since keys may be removed from nested objects */
+  data := make(map[string]interface{})
+  b, _ := json.Marshal(obj.api_data)
+  json.Unmarshal(b, &data)
+  for _, k := range obj.api_client.copy_keys { delete_key(data, k) }
+  for _, k := range obj.api_client.computed_keys { delete_key(data, k) }
+  b, _ = json.Marshal(data)
+  return string(b)
+}
+
+/* Look for the object's id in data from the API. An empty
+   value is as good as missing. If id_attribute is not there,
+   the provider's id_fallback_attribute is tried */
+func (obj *api_object) find_id(data map[string]interface{}) string {
+  if val, ok := get_key(data, obj.api_client.id_attribute); ok && val != nil {
+    if id := id_string(val); id != "" { return obj.api_client.normalize_id(id) }
+  }
+  if obj.api_client.id_fallback_attribute != "" {
+    if val, ok := get_path(data, obj.api_client.id_fallback_attribute); ok && val != nil {
+      if id := id_string(val); id != "" {
+        if obj.debug { log.Printf("api_object.go: %s not found - using %s for the id\n", obj.api_client.id_attribute, obj.api_client.id_fallback_attribute) }
+        return obj.api_client.normalize_id(id)
+      }
+    }
+  }
+  return ""
+}
+
+/* Use the last path segment of a create response's
+   Location header (/things/123 -> 123) as the id */
+func id_from_location(resp *http.Response) string {
+  if resp == nil { return "" }
+  location := strings.TrimRight(resp.Header.Get("Location"), "/")
+  if n := strings.Index(location, "?"); n != -1 { location = location[:n] }
+  if n := strings.LastIndex(location, "/"); n != -1 { location = location[n+1:] }
+  return location
+}
+
 func (obj *api_object) create_object() error {
   /* Failsafe: The constructor should prevent this situation, but
      protect here also. If no id is set, and the API does not respond
      with the id of whatever gets created, we have no way to know what
      the object's id will be. Abandon this attempt */
-  if obj.id == "" && !obj.api_client.write_returns_object && !obj.api_client.create_returns_object {
+  if obj.id == "" && !obj.api_client.write_returns_object && !obj.api_client.create_returns_object && !obj.api_client.id_from_location && !obj.has_create_lookup() && obj.operation.result_id_path == "" {
     return errors.New("ERROR: Provided object does not have an id set and the client is not configured to read the object from a POST or PUT response. Without an id, the object cannot be managed.")
   }
 
-  b, _ := json.Marshal(obj.data)
-  res_str, err := obj.api_client.send_request("POST", obj.path, string(b))
+  path, err := obj.collection_path()
   if err != nil { return err }
 
+  /* A create that timed out may still have been made. Look
+     before resending it, and take over what was made */
+  var duplicate string
+  var before_retry func() bool
+  if len(obj.dedup_keys) > 0 {
+    before_retry = func() bool {
+      duplicate = obj.find_duplicate()
+      return duplicate != ""
+    }
+  }
+
+  var res_str string
+  var resp *http.Response
+  if obj.api_client.write_returns_object || obj.api_client.create_returns_object {
+    res_str, resp, err = obj.api_client.send_request_expecting_body("POST", path, obj.request_body(), nil, before_retry)
+  } else {
+    res_str, resp, err = obj.api_client.send_request_checked("POST", path, obj.request_body(), nil, before_retry)
+  }
+  if duplicate != "" {
+    obj.id = duplicate
+    obj.write_result = ""
+    return obj.read_object()
+  }
+  if err != nil { return err }
+  obj.note_write_result("POST", resp)
+
+  /* The object is not there until the operation is done */
+  if resp.StatusCode == http.StatusAccepted && obj.operation.path != "" {
+    return obj.wait_for_operation(res_str)
+  }
+
   /* We will need to sync state as well as get the object's ID */
   if obj.api_client.write_returns_object || obj.api_client.create_returns_object {
     if obj.debug {
       log.Printf("api_object.go: Parsing response from POST to update internal structures (write_returns_object=%t, create_returns_object=%t)...\n",
         obj.api_client.write_returns_object, obj.api_client.create_returns_object)
     }
+    res_str, err = obj.api_client.unwrap_object(res_str)
+    if err != nil { return err }
+    res_str, err = obj.select_created(res_str)
+    if err != nil { return err }
+
+    if obj.id == "" && obj.api_client.id_from_location {
+      created, _ := decode_numbers(res_str)
+      if obj.find_id(created) == "" { obj.id = obj.api_client.normalize_id(id_from_location(resp)) }
+    }
+
     err = obj.update_state(res_str)
-    /* Yet another failsafe. In case something terrible went wrong internally,
-       bail out so the user at least knows that the ID did not get set. */
-    if obj.id == "" { return errors.New("Internal validation failed. Object ID is not set, but *may* have been created. This should never happen!") }
+    /* Never store an empty id. The create succeeded, so be
+       clear that the object probably exists on the server */
+    if obj.id == "" {
+      return errors.New(fmt.Sprintf("The API reported success (HTTP %d) creating the object, but its id could not be determined so it cannot be managed. The object *may* have been created and need to be removed by hand. %s", resp.StatusCode, err))
+    }
   } else {
+    if obj.id == "" && obj.has_create_lookup() {
+      obj.id, err = obj.lookup_created()
+      if err != nil {
+        return errors.New(fmt.Sprintf("The API reported success (HTTP %d) creating the object, but it could not be found to get its id: %s. The object *may* have been created and need to be removed by hand.", resp.StatusCode, err))
+      }
+    }
+    if obj.id == "" { obj.id = obj.api_client.normalize_id(id_from_location(resp)) }
+    if obj.id == "" {
+      return errors.New(fmt.Sprintf("The API reported success (HTTP %d) creating the object, but the response has no Location header to take the id from. The object *may* have been created and need to be removed by hand.", resp.StatusCode))
+    }
     if obj.debug {
       log.Printf("api_object.go: Requesting created object from API (write_returns_object=%t, create_returns_object=%t)...\n",
         obj.api_client.write_returns_object, obj.api_client.create_returns_object)
@@ -162,29 +785,541 @@ func (obj *api_object) create_object() error {
   return err
 }
 
+/* For APIs whose create response does not say what the id
+   is: find the new object by reading create_lookup_path
+   (the collection path by default) with create_lookup_query,
+   both filled from the data sent. If more than one object
+   comes back, the one that has everything sent is used */
+func (obj *api_object) lookup_created() (string, error) {
+  path, err := obj.create_lookup_url()
+  if err != nil { return "", err }
+
+  list, err := obj.api_client.list_objects(path, obj.create_lookup_key, nil)
+  if err != nil { return "", err }
+
+  matches := list
+  if len(list) > 1 {
+    matches = make([]interface{}, 0)
+    for _, item := range list {
+      if json_subset(map[string]interface{}(obj.data), plain_value(item)) { matches = append(matches, item) }
+    }
+  }
+  if len(matches) != 1 {
+    return "", errors.New(fmt.Sprintf("Expected one object matching what was sent from '%s' but found %d", path, len(matches)))
+  }
+
+  found, ok := plain_value(matches[0]).(map[string]interface{})
+  if !ok { return "", errors.New(fmt.Sprintf("Expected an object from '%s' but got: %v", path, matches[0])) }
+  id := obj.find_id(found)
+  if id == "" { return "", errors.New(fmt.Sprintf("The object found at '%s' has no %s", path, obj.api_client.id_attribute)) }
+  if obj.debug { log.Printf("api_object.go: Found the created object's id '%s' at '%s'\n", id, path) }
+  return id, nil
+}
+
+/* Where to look for objects that were created: the filled
+   create_lookup_path with create_lookup_query */
+func (obj *api_object) create_lookup_url() (string, error) {
+  path := obj.create_lookup_path
+  if path == "" { path = strings.TrimSuffix(obj.path, "/{id}") }
+  path, err := obj.fill_placeholders(path, "create_lookup_path")
+  if err != nil { return "", err }
+
+  query, err := obj.query_values(obj.create_lookup_query, "create_lookup_query parameter")
+  if err != nil { return "", err }
+  return obj.api_client.add_query(path, query), nil
+}
+
+/* Before a create is sent again, look for an object with
+   the same dedup_keys as what was sent, in case the last
+   attempt was created even though its response was lost.
+   Returns its id if exactly one is found. Any trouble looking
+   is logged, and the create is then retried as usual */
+func (obj *api_object) find_duplicate() string {
+  path, err := obj.create_lookup_url()
+  if err == nil {
+    var list []interface{}
+    list, err = obj.api_client.list_objects(path, obj.create_lookup_key, nil)
+    if err == nil {
+      matches := make([]map[string]interface{}, 0)
+      for _, item := range list {
+        found, ok := plain_value(item).(map[string]interface{})
+        if ok && obj.same_dedup_keys(found) { matches = append(matches, found) }
+      }
+      if len(matches) == 1 {
+        if id := obj.find_id(matches[0]); id != "" {
+          log.Printf("api_object.go: Found object '%s' at '%s' with the same %s as the create being retried. Using it instead of creating another.\n", id, path, strings.Join(obj.dedup_keys, ", "))
+          return id
+        }
+      }
+      if len(matches) > 1 {
+        log.Printf("api_object.go: WARNING: %d objects at '%s' have the same %s as the create being retried. Not using any of them.\n", len(matches), path, strings.Join(obj.dedup_keys, ", "))
+      }
+      return ""
+    }
+  }
+  log.Printf("api_object.go: WARNING: Unable to look for an object the create may have made before retrying it: %s\n", err)
+  return ""
+}
+
+func (obj *api_object) same_dedup_keys(found map[string]interface{}) bool {
+  for _, key := range obj.dedup_keys {
+    sent, sent_ok := get_key(obj.data, key)
+    got, got_ok := get_key(found, key)
+    if !sent_ok || !got_ok || !json_subset(sent, got) || !json_subset(got, sent) { return false }
+  }
+  return true
+}
+
+func (obj *api_object) has_create_lookup() bool {
+  return obj.create_lookup_path != "" || len(obj.create_lookup_query) > 0
+}
+
+/* Some APIs accept a create but quietly ignore or change
+   fields. Compare what was sent (other than copy_keys, which
+   come from the API) with the object the API now has. sent is
+   the body as it went out (see sent_data), so coerce_fields,
+   stripped nulls and normalize_unicode are already applied */
+func (obj *api_object) verify_created(sent map[string]interface{}) error {
+  if obj.api_client.verify_create == "" { return nil }
+
+  copied := make(map[string]bool)
+  for _, key := range obj.api_client.copy_keys { copied[key] = true }
+
+  altered := make([]string, 0)
+  for key, val := range sent {
+    if copied[key] { continue }
+    if got, ok := obj.api_data[key]; !ok {
+      altered = append(altered, fmt.Sprintf("%s (dropped)", key))
+    } else if !json_subset(val, got) {
+      sent_json, _ := json.Marshal(val)
+      got_json, _ := json.Marshal(got)
+      altered = append(altered, fmt.Sprintf("%s (sent %s, got %s)", key, sent_json, got_json))
+    }
+  }
+  if len(altered) == 0 { return nil }
+
+  sort.Strings(altered)
+  message := fmt.Sprintf("The API did not keep every field sent to create object '%s': %s", obj.id, strings.Join(altered, ", "))
+  if obj.api_client.verify_create == "error" { return errors.New(message) }
+  log.Printf("api_object.go: WARNING: %s\n", message)
+  return nil
+}
+
+/* Bulk-style create endpoints may respond with an array of
+   objects rather than just the one created. Pick out the one
+   whose create_match_field matches what was sent, or the only
+   element if there is just one */
+func (obj *api_object) select_created(res_str string) (string, error) {
+  parsed, err := obj.api_client.decode_json(res_str)
+  if err != nil { return "", err }
+
+  list, ok := parsed.([]interface{})
+  if !ok { return res_str, nil }
+
+  field := obj.api_client.create_match_field
+  if field == "" {
+    if len(list) == 1 {
+      b, _ := json.Marshal(list[0])
+      return string(b), nil
+    }
+    return "", errors.New(fmt.Sprintf("The create response is an array of %d objects. Set create_match_field so the created object can be found.", len(list)))
+  }
+
+  want, ok := get_path(obj.data, field)
+  if !ok { return "", errors.New(fmt.Sprintf("create_match_field '%s' is not in the data sent to the API", field)) }
+
+  for _, item := range list {
+    if val, ok := get_path(item, field); ok && fmt.Sprintf("%v", val) == fmt.Sprintf("%v", want) {
+      if obj.debug { log.Printf("api_object.go: Selected created object where %s='%v' from array response\n", field, want) }
+      b, _ := json.Marshal(item)
+      return string(b), nil
+    }
+  }
+  return "", errors.New(fmt.Sprintf("None of the %d objects in the create response have %s='%v'", len(list), field, want))
+}
+
+/* Follow the operation a 202 create response refers to until
+   it succeeds, fails or ready_timeout passes, polling every
+   ready_poll_interval, then read the object it created */
+func (obj *api_object) wait_for_operation(res_str string) error {
+  var accepted interface{}
+  if err := json.Unmarshal([]byte(res_str), &accepted); err != nil {
+    return errors.New(fmt.Sprintf("The API accepted the create (HTTP 202) but the response is not JSON, so the operation cannot be followed: %s", err))
+  }
+  operation_id, ok := get_path(accepted, obj.operation.id_path)
+  if !ok || operation_id == nil || fmt.Sprintf("%v", operation_id) == "" {
+    return errors.New(fmt.Sprintf("The API accepted the create (HTTP 202) but the response has no operation id at '%s'. The object *may* be created and need to be removed by hand. Response: %s", obj.operation.id_path, res_str))
+  }
+
+  path := strings.Replace(obj.operation.path, "{operation_id}", url.PathEscape(fmt.Sprintf("%v", operation_id)), -1)
+  path, err := obj.fill_placeholders(path, "operation_path")
+  if err != nil { return err }
+
+  start := time.Now()
+  for {
+    op_str, err := obj.api_client.send_request("GET", path, "")
+    if err != nil { return err }
+    var op interface{}
+    if err := json.Unmarshal([]byte(op_str), &op); err != nil {
+      return errors.New(fmt.Sprintf("Unable to parse the operation at '%s' as JSON: %s", path, err))
+    }
+
+    status, _ := get_path(op, obj.operation.status_path)
+    s := fmt.Sprintf("%v", status)
+    for _, failed := range obj.operation.failed_values {
+      if s == failed {
+        return errors.New(fmt.Sprintf("The create operation at '%s' failed (%s='%s'): %s", path, obj.operation.status_path, s, op_str))
+      }
+    }
+    for _, success := range obj.operation.success_values {
+      if s == success {
+        if obj.debug { log.Printf("api_object.go: Create operation at '%s' is done (%s='%s')\n", path, obj.operation.status_path, s) }
+        if obj.id == "" && obj.operation.result_id_path != "" {
+          if id, ok := get_path(op, obj.operation.result_id_path); ok && id != nil {
+            obj.id = obj.api_client.normalize_id(id_string(id))
+          }
+        }
+        if obj.id == "" {
+          return errors.New(fmt.Sprintf("The create operation at '%s' is done, but the object's id is not at '%s' in it. The object *may* have been created and need to be removed by hand.", path, obj.operation.result_id_path))
+        }
+        return obj.read_object()
+      }
+    }
+    if obj.debug { log.Printf("api_object.go: Waiting for create operation at '%s' (%s='%s')\n", path, obj.operation.status_path, s) }
+
+    if obj.ready_timeout > 0 && time.Since(start) >= time.Duration(obj.ready_timeout) * time.Second {
+      return errors.New(fmt.Sprintf("Timed out after %d seconds waiting for the create operation at '%s' (%s='%s'). The object *may* still be created and need to be removed by hand.", obj.ready_timeout, path, obj.operation.status_path, s))
+    }
+    time.Sleep(time.Duration(obj.ready_poll_interval) * time.Second)
+  }
+}
+
+/* Some objects are created right away but are not usable until
+   the API says they are ready. Poll until ready_status_field
+   reaches ready_status_value, fails, or ready_timeout passes */
+func (obj *api_object) wait_for_ready() error {
+  if obj.ready_status_field == "" { return nil }
+
+  start := time.Now()
+  for {
+    if status, ok := get_path(obj.api_data, obj.ready_status_field); ok {
+      s := fmt.Sprintf("%v", status)
+      if s == obj.ready_status_value {
+        if obj.debug { log.Printf("api_object.go: Object is ready (%s='%s')\n", obj.ready_status_field, s) }
+        return nil
+      }
+      for _, failed := range obj.failed_status_values {
+        if s == failed {
+          return errors.New(fmt.Sprintf("Object '%s' reached failed status %s='%s' while waiting for it to be ready", obj.id, obj.ready_status_field, s))
+        }
+      }
+      if obj.debug { log.Printf("api_object.go: Waiting for object to be ready (%s='%s')\n", obj.ready_status_field, s) }
+    }
+
+    if obj.ready_timeout > 0 && time.Since(start) >= time.Duration(obj.ready_timeout) * time.Second {
+      return errors.New(fmt.Sprintf("Timed out after %d seconds waiting for object '%s' to reach %s='%s'", obj.ready_timeout, obj.id, obj.ready_status_field, obj.ready_status_value))
+    }
+
+    time.Sleep(time.Duration(obj.ready_poll_interval) * time.Second)
+    if err := obj.read_object(); err != nil { return err }
+  }
+}
+
 func (obj *api_object) read_object() error {
+  _, err := obj.read_response()
+  return err
+}
+
+/* read_object, also handing back the response (nil if there
+   was none) so a failed read can be told apart from a gone
+   object */
+func (obj *api_object) read_response() (*http.Response, error) {
   if obj.id == "" {
-    return errors.New("Cannot read an object unless the ID has been set.")
+    return nil, errors.New("Cannot read an object unless the ID has been set.")
   }
 
-  res_str, err := obj.api_client.send_request("GET", obj.path + "/" + obj.id, "")
-  if err != nil { return err }
+  if obj.list_read.path != "" { return nil, obj.read_from_list() }
+  if obj.list_read.paginated { return obj.read_pages() }
+
+  path, err := obj.object_path()
+  if err != nil { return nil, err }
+
+  res_str, resp, err := obj.api_client.send_request_full("GET", path, "", nil)
+  if err != nil { return resp, err }
+
+  res_str, err = obj.api_client.unwrap_object(res_str)
+  if err != nil { return resp, err }
 
   err = obj.update_state(res_str)
+  return resp, err
+}
+
+/* Whether the object still exists, by reading it (or with
+   probe, probing it). It is gone only if it is no longer
+   listed or the API answers with one of gone_codes. Any other
+   failure is an error, and a 401 or 403 says so plainly: losing
+   access to an object is not the object being deleted, and
+   treating it as gone would have terraform create it again */
+func (obj *api_object) exists(probe bool) (bool, error) {
+  var resp *http.Response
+  var err error
+  if probe {
+    resp, err = obj.probe_response()
+  } else {
+    resp, err = obj.read_response()
+  }
+
+  if err == nil { return true, nil }
+  if err == object_not_listed { return false, nil }
+  if resp == nil { return false, err }
+  if obj.api_client.is_gone(resp.StatusCode) {
+    log.Printf("api_object.go: Object '%s' is gone (HTTP %d)\n", obj.id, resp.StatusCode)
+    return false, nil
+  }
+  if resp.StatusCode == 401 || resp.StatusCode == 403 {
+    return false, errors.New(fmt.Sprintf("Access to object '%s' was refused (HTTP %d), so whether it still exists cannot be known. Check that the provider's credentials still have access to it. %s", obj.id, resp.StatusCode, err))
+  }
+  return false, err
+}
+
+/* Read the object by finding it in a list. Finding none is
+   object_not_listed, but more than one is an error since
+   which is the object cannot be known */
+func (obj *api_object) read_from_list() error {
+  path, err := obj.fill_placeholders(obj.list_read.path, "read_list_path")
+  if err != nil { return err }
+
+  list, err := obj.api_client.list_objects(path, obj.list_read.results_key, &obj.list_read.paging)
+  if err != nil { return err }
+
+  id_path := obj.list_read.id_path
+  find := get_path
+  if id_path == "" { id_path, find = obj.api_client.id_attribute, get_key }
+
+  matches := make([]interface{}, 0)
+  for _, item := range list {
+    val, ok := find(item, id_path)
+    if ok && val != nil && obj.api_client.normalize_id(id_string(plain_value(val))) == obj.id {
+      matches = append(matches, item)
+    }
+  }
+
+  switch len(matches) {
+  case 0:
+    if obj.debug { log.Printf("api_object.go: No object in '%s' has %s '%s'\n", path, id_path, obj.id) }
+    return object_not_listed
+  case 1:
+    b, err := json.Marshal(matches[0])
+    if err != nil { return err }
+    return obj.update_state(string(b))
+  default:
+    return errors.New(fmt.Sprintf("Expected one object in '%s' with %s '%s' but found %d", path, id_path, obj.id, len(matches)))
+  }
+}
+
+/* Read an object that is a collection spanning pages, such
+   as a group and its members. Every page is read and their
+   items are put together at results_key in the first page, so
+   the object is compared with data in full. Otherwise items on
+   later pages would look like they had been removed */
+func (obj *api_object) read_pages() (*http.Response, error) {
+  path, err := obj.object_path()
+  if err != nil { return nil, err }
+
+  items, first, resp, err := obj.api_client.list_pages(path, obj.list_read.results_key, &obj.list_read.paging)
+  if err != nil { return resp, err }
+
+  object, ok := plain_value(first).(map[string]interface{})
+  if !ok { return resp, errors.New(fmt.Sprintf("Expected an object with its items at '%s' from '%s' but got: %v", obj.list_read.results_key, path, first)) }
+  if !set_key(object, json_pointer(obj.list_read.results_key), items) {
+    return resp, errors.New(fmt.Sprintf("Unable to put the items read from '%s' at '%s'", path, obj.list_read.results_key))
+  }
+  if obj.debug { log.Printf("api_object.go: Read %d items of object '%s' from its pages\n", len(items), obj.id) }
+
+  b, err := json.Marshal(object)
+  if err != nil { return resp, err }
+  res_str, err := obj.api_client.unwrap_object(string(b))
+  if err != nil { return resp, err }
+  return resp, obj.update_state(res_str)
+}
+
+/* A cheap check that the object still exists, such as a
+   HEAD or a GET of just the id, for routine refreshes. The
+   response is not used to update the object's data */
+func (obj *api_object) probe_object() error {
+  _, err := obj.probe_response()
   return err
 }
 
+/* probe_object, also handing back the response */
+func (obj *api_object) probe_response() (*http.Response, error) {
+  if obj.id == "" {
+    return nil, errors.New("Cannot probe an object unless the ID has been set.")
+  }
+
+  path, err := obj.object_path()
+  if err != nil { return nil, err }
+  if obj.probe_query != "" {
+    if strings.Contains(path, "?") { path += "&" + obj.probe_query } else { path += "?" + obj.probe_query }
+  }
+
+  method := obj.probe_method
+  if method == "" { method = "GET" }
+  _, resp, err := obj.api_client.send_request_full(method, path, "", nil)
+  return resp, err
+}
+
+func (obj *api_object) has_probe() bool {
+  return obj.probe_method != "" || obj.probe_query != ""
+}
+
+/* Updates to some APIs must re-send fields the user did not
+   change (an etag or version). Start from update_defaults,
+   then the server_defaults, then the update_copy_keys from
+   the last read, then data, so what the user set always wins.
+   Last, what the server has in preserve_fields is merged in */
+func (obj *api_object) update_data() map[string]interface{} {
+  data := make(map[string]interface{})
+  for k, v := range obj.update_defaults { data[k] = v }
+  for k, v := range obj.server_defaults { data[k] = v }
+  for _, k := range obj.update_copy_keys {
+    if v, ok := obj.api_data[k]; ok { data[k] = v }
+  }
+  for k, v := range obj.data { data[k] = v }
+  if len(obj.preserve_fields) == 0 { return data }
+
+  /* A deep copy, since nested objects are merged into */
+  b, _ := json.Marshal(data)
+  data = make(map[string]interface{})
+  json.Unmarshal(b, &data)
+
+  server := obj.preserved_source()
+  for _, field := range obj.preserve_fields {
+    server_val, ok := get_key(server, field)
+    if !ok || server_val == redacted { continue }
+    user_val, user_ok := get_key(data, field)
+    if user_ok { server_val = merge_preserved(user_val, server_val) }
+    if obj.debug { log.Printf("api_object.go: Preserving server field '%s' (%v) in the update\n", field, server_val) }
+    if !set_key(data, field, server_val) {
+      log.Printf("api_object.go: WARNING: Unable to preserve field '%s' in the update\n", field)
+    }
+  }
+  return data
+}
+
+/* The keys the server filled in that the user did not
+   specify, from the object as last read. Only kept from the
+   first read after the object is made, so this is one way:
+   a key the user sets later wins, and one the server adds
+   later is not picked up. What the server manages itself (the
+   id, copy_keys and computed_keys) is left out, since sending
+   it back later would be stale, and so are sensitive_fields */
+func (obj *api_object) find_server_defaults() map[string]interface{} {
+  /* A deep copy, since keys may be removed from nested objects */
+  server := make(map[string]interface{})
+  b, _ := json.Marshal(obj.api_data)
+  json.Unmarshal(b, &server)
+  delete_key(server, obj.api_client.id_attribute)
+  for _, k := range obj.api_client.copy_keys { delete_key(server, k) }
+  for _, k := range obj.api_client.computed_keys { delete_key(server, k) }
+  for _, k := range obj.api_client.sensitive_fields { delete_key(server, json_pointer(k)) }
+
+  defaults := make(map[string]interface{})
+  for key, val := range server {
+    if _, ok := obj.data[key]; !ok {
+      if obj.debug { log.Printf("api_object.go: Keeping server default for key '%s' (%v)\n", key, val) }
+      defaults[key] = val
+    }
+  }
+  return defaults
+}
+
+/* The object as the server last had it: as read just now if
+   it was, otherwise as last stored in state */
+func (obj *api_object) preserved_source() map[string]interface{} {
+  if len(obj.api_data) > 0 { return obj.api_data }
+  server := make(map[string]interface{})
+  json.Unmarshal([]byte(obj.prior_response), &server)
+  return server
+}
+
+/* Deep merge what the server has into what the user set.
+   Fields of objects only the server has are added, and arrays
+   are merged element by element, but only as far as the user's
+   array goes. Wherever both have a value, the user's is kept.
+   Masked sensitive values are never sent back */
+func merge_preserved(user interface{}, server interface{}) interface{} {
+  switch u := user.(type) {
+  case map[string]interface{}:
+    s, ok := server.(map[string]interface{})
+    if !ok { return user }
+    merged := make(map[string]interface{})
+    for k, v := range s {
+      if v != redacted { merged[k] = v }
+    }
+    for k, v := range u {
+      if sv, ok := s[k]; ok { v = merge_preserved(v, sv) }
+      merged[k] = v
+    }
+    return merged
+  case []interface{}:
+    s, ok := server.([]interface{})
+    if !ok { return user }
+    merged := make([]interface{}, len(u))
+    for i, v := range u {
+      if i < len(s) { v = merge_preserved(v, s[i]) }
+      merged[i] = v
+    }
+    return merged
+  }
+  return user
+}
+
 func (obj *api_object) update_object() error {
   if obj.id == "" {
     return errors.New("Cannot update an object unless the ID has been set.")
   }
 
-  b, _ := json.Marshal(obj.data)
-  res_str, err := obj.api_client.send_request("PUT", obj.path + "/" + obj.id, string(b))
+  path, err := obj.object_path()
   if err != nil { return err }
 
+  /* Optimistic concurrency for APIs without ETags: send the
+     object as it was last known so the server can refuse the
+     update if it has changed since */
+  data := obj.with_body_id(obj.update_data())
+  headers := make(map[string]string)
+  guarded := obj.prior_response != "" && (obj.api_client.prior_state_header != "" || obj.api_client.prior_state_field != "")
+  if guarded {
+    if obj.api_client.prior_state_header != "" {
+      sum := sha256.Sum256([]byte(obj.prior_response))
+      headers[obj.api_client.prior_state_header] = hex.EncodeToString(sum[:])
+    }
+    if obj.api_client.prior_state_field != "" {
+      var prior interface{}
+      if err := json.Unmarshal([]byte(obj.prior_response), &prior); err != nil { return err }
+      data[obj.api_client.prior_state_field] = prior
+    }
+  }
+
+  var res_str string
+  var resp *http.Response
+  if obj.api_client.write_returns_object {
+    res_str, resp, err = obj.api_client.send_request_expecting_body("PUT", path, obj.encode_body(data), headers, nil)
+  } else {
+    res_str, resp, err = obj.api_client.send_request_full("PUT", path, obj.encode_body(data), headers)
+  }
+  if err != nil {
+    if guarded && resp != nil && (resp.StatusCode == 409 || resp.StatusCode == 412) {
+      return errors.New(fmt.Sprintf("The object at '%s' was changed on the server since it was last read, so the update was refused (HTTP %d). Run terraform refresh to pick up the changes and try again. %s", path, resp.StatusCode, err))
+    }
+    return err
+  }
+  obj.note_write_result("PUT", resp)
+
   if obj.api_client.write_returns_object {
     if obj.debug { log.Printf("api_object.go: Parsing response from PUT to update internal structures (write_returns_object=true)...\n") }
+    res_str, err = obj.api_client.unwrap_object(res_str)
+    if err != nil { return err }
     err = obj.update_state(res_str)
   } else {
     if obj.debug { log.Printf("api_object.go: Requesting updated object from API (write_returns_object=false)...\n") }
@@ -193,13 +1328,79 @@ func (obj *api_object) update_object() error {
   return err
 }
 
+/* data with the object's id at id_body_field as well, for
+   APIs that check the id in the body is the one in the path.
+   The id keeps the type the API last gave it (a number stays
+   a number) */
+func (obj *api_object) with_body_id(data map[string]interface{}) map[string]interface{} {
+  field := obj.api_client.id_body_field
+  if field == "" { return data }
+
+  var id interface{} = obj.id
+  if val, ok := get_key(obj.preserved_source(), obj.api_client.id_attribute); ok && obj.api_client.normalize_id(id_string(val)) == obj.id {
+    id = val
+  }
+
+  /* A deep copy, since a pointer may reach into nested objects */
+  if is_json_pointer(field) {
+    b, _ := json.Marshal(data)
+    data = make(map[string]interface{})
+    json.Unmarshal(b, &data)
+  }
+  if !set_key(data, field, id) {
+    log.Printf("api_object.go: WARNING: Unable to set the id at id_body_field '%s'\n", field)
+  }
+  return data
+}
+
+/* Keep what the response code to a create or update says
+   was done, so a POST that found the object already there or
+   a PUT that made it again can be told apart */
+func (obj *api_object) note_write_result(method string, resp *http.Response) {
+  obj.write_result = obj.api_client.write_result(resp.StatusCode)
+  if obj.debug {
+    result := obj.write_result
+    if result == "" { result = "neither created nor updated" }
+    log.Printf("api_object.go: The %s returned HTTP %d (%s)\n", method, resp.StatusCode, result)
+  }
+}
+
 func (obj *api_object) delete_object() error {
   if obj.id == "" {
     log.Printf("WARNING: Attempting to delete an object that has no id set. Assuming this is OK.\n")
     return nil
   }
 
-  _, err := obj.api_client.send_request("DELETE", obj.path + "/" + obj.id, "")
+  /* Version guarded deletes need fields only a fresh read
+     has, which fill the placeholders in the path, body and
+     headers of the delete */
+  if obj.read_before_destroy {
+    if err := obj.read_object(); err != nil { return err }
+  }
+
+  path, err := obj.object_path()
+  if err != nil { return err }
+
+  body := ""
+  if obj.destroy_data != "" {
+    if body, err = obj.fill_body_template(obj.destroy_data, "destroy_data"); err != nil { return err }
+  }
+  if obj.api_client.id_body_field != "" {
+    data := make(map[string]interface{})
+    if body != "" {
+      if err := json.Unmarshal([]byte(body), &data); err != nil {
+        return errors.New(fmt.Sprintf("destroy_data must be a JSON object for id_body_field to be set in it: %s", err))
+      }
+    }
+    /* Sent the way every other body is (YAML or a form field) */
+    body = obj.encode_body(obj.with_body_id(data))
+  }
+  headers := make(map[string]string)
+  for name, value := range obj.destroy_headers {
+    if headers[name], err = obj.fill_placeholders(value, "destroy_headers"); err != nil { return err }
+  }
+
+  _, _, err = obj.api_client.send_request_full("DELETE", path, body, headers)
   if err != nil { return err }
 
   return nil
@@ -1,11 +1,20 @@
 package restapi
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/compassmarketing/terraform-provider-restapi/fakeserver"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var test_debug = false
@@ -41,19 +50,19 @@ func TestAPIObject(t *testing.T) {
 	api_server_objects := make(map[string]map[string]interface{})
 	generate_test_api_objects(&generated_objects, &api_server_objects, t, test_debug)
 
-	client := NewAPIClient(
-		"http://127.0.0.1:8081/", /* URL */
-		false,             /* insecure */
-		"",                /* username */
-		"",                /* password */
-		"",                /* Authorization header */
-		5,                 /* HTTP Timeout in seconds */
-		"Id",              /* Attribute from server that serves as ID */
-		[]string{"Thing"}, /* keys to copy from api_data to data */
-		true,              /* Write returns object */
-		false,             /* Create returns object */
-		api_client_debug,  /* Debug logging */
-	)
+	client := NewAPIClient(&api_client_opt{
+		uri:                   "http://127.0.0.1:8081/", /* URL */
+		insecure:              false,                    /* insecure */
+		username:              "",                       /* username */
+		password:              "",                       /* password */
+		auth_header:           "",                       /* Authorization header */
+		timeout:               5,                        /* HTTP Timeout in seconds */
+		id_attribute:          "Id",                     /* Attribute from server that serves as ID */
+		copy_keys:             []string{"Thing"},        /* keys to copy from api_data to data */
+		write_returns_object:  true,                     /* Write returns object */
+		create_returns_object: false,                    /* Create returns object */
+		debug:                 api_client_debug,         /* Debug logging */
+	})
 
 	/* Construct a local map of test case objects with only the ID populated */
 	if test_debug {
@@ -64,11 +73,13 @@ func TestAPIObject(t *testing.T) {
 			log.Printf("api_object_test.go:   '%s'\n", id)
 		}
 		o, err := NewAPIObject(
-			client,         /* The HTTP client created above */
-			"/api/objects", /* path to the "object" in the test server (note: id will automatically be appended) */
-			"",             /* Do not set an ID to force the constructor to verify id_attribute works */
-			fmt.Sprintf(`{ "Id": "%s" }`, id), /* Start with only an empty JSON object ID as our "data" */
-			api_object_debug,                  /* Whether the object's debug is enabled */
+			client, /* The HTTP client created above */
+			&api_object_opt{
+				path:  "/api/objects",                    /* path to the "object" in the test server (note: id will automatically be appended) */
+				id:    "",                                /* Do not set an ID to force the constructor to verify id_attribute works */
+				data:  fmt.Sprintf(`{ "Id": "%s" }`, id), /* Start with only an empty JSON object ID as our "data" */
+				debug: api_object_debug,                  /* Whether the object's debug is enabled */
+			},
 		)
 		if err != nil {
 			t.Fatalf("api_object_test.go: Failed to create new api_object for id '%s'", id)
@@ -149,6 +160,240 @@ func TestAPIObject(t *testing.T) {
 	}
 }
 
+func TestAPIObjectPathParams(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8081/",
+		timeout:      5,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	o, err := NewAPIObject(client, &api_object_opt{path: "/orgs/{parent_id}/repos/{id}", data: `{ "id": "42", "parent_id": "acme" }`, debug: api_object_debug})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to create new api_object: %s", err)
+	}
+
+	path, err := o.object_path()
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to resolve object path: %s", err)
+	} else if path != "/orgs/acme/repos/42" {
+		t.Fatalf("api_object_test.go: Expected object path '/orgs/acme/repos/42' but got '%s'", path)
+	}
+
+	path, err = o.collection_path()
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to resolve collection path: %s", err)
+	} else if path != "/orgs/acme/repos" {
+		t.Fatalf("api_object_test.go: Expected collection path '/orgs/acme/repos' but got '%s'", path)
+	}
+
+	/* Paths without an {id} placeholder still get the id appended */
+	o.path = "/orgs/{parent_id}/repos"
+	path, _ = o.object_path()
+	if path != "/orgs/acme/repos/42" {
+		t.Fatalf("api_object_test.go: Expected object path '/orgs/acme/repos/42' but got '%s'", path)
+	}
+
+	/* Unresolvable placeholders are named in the error */
+	o.path = "/orgs/{org_name}/repos/{id}"
+	_, err = o.object_path()
+	if err == nil {
+		t.Fatalf("api_object_test.go: Expected an error resolving a path with a missing parameter")
+	} else if !strings.Contains(err.Error(), "{org_name}") {
+		t.Fatalf("api_object_test.go: Expected the error to name '{org_name}' but got '%s'", err)
+	}
+
+	/* Query parameters are filled the same way, and escaped */
+	o.path = "/repos"
+	o.query_params = map[string]string{"parent": "{parent_id}", "q": "id={id}&x"}
+	path, _ = o.object_path()
+	if path != "/repos/42?parent=acme&q=id%3D42%26x" {
+		t.Fatalf("api_object_test.go: Expected object path '/repos/42?parent=acme&q=id%%3D42%%26x' but got '%s'", path)
+	}
+	path, _ = o.collection_path()
+	if path != "/repos?parent=acme&q=id%3D42%26x" {
+		t.Fatalf("api_object_test.go: Expected collection path '/repos?parent=acme&q=id%%3D42%%26x' but got '%s'", path)
+	}
+}
+
+func TestAPIObjectSelectCreated(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:                  "http://127.0.0.1:8081/",
+		id_attribute:         "id",
+		create_match_field:   "name",
+		write_returns_object: true,
+		debug:                api_client_debug,
+	})
+
+	o, err := NewAPIObject(client, &api_object_opt{path: "/api/objects", data: `{ "name": "second" }`, debug: api_object_debug})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to create new api_object: %s", err)
+	}
+
+	res, err := o.select_created(`[{"id": "1", "name": "first"}, {"id": "2", "name": "second"}]`)
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to select created object: %s", err)
+	} else if res != `{"id":"2","name":"second"}` {
+		t.Fatalf("api_object_test.go: Expected the object named 'second' but got '%s'", res)
+	}
+
+	_, err = o.select_created(`[{"id": "1", "name": "first"}]`)
+	if err == nil {
+		t.Fatalf("api_object_test.go: Expected an error when no object in the response matches")
+	}
+}
+
+func TestAPIObjectCreateMissingID(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/api/things/99")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8082", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	opt := &api_client_opt{
+		uri:                   "http://127.0.0.1:8082/",
+		timeout:               2,
+		id_attribute:          "id",
+		create_returns_object: true,
+		debug:                 api_client_debug,
+	}
+
+	/* An empty id in the response must not be stored */
+	o, _ := NewAPIObject(NewAPIClient(opt), &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	err := o.create_object()
+	if err == nil {
+		t.Fatalf("api_object_test.go: Expected an error creating an object whose id is empty in the response")
+	} else if o.id != "" {
+		t.Fatalf("api_object_test.go: Expected no id to be set but got '%s'", o.id)
+	}
+
+	/* ... unless there is somewhere else to get it from */
+	opt.id_from_location = true
+	o, _ = NewAPIObject(NewAPIClient(opt), &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err = o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object with id_from_location: %s", err)
+	} else if o.id != "99" {
+		t.Fatalf("api_object_test.go: Expected id '99' from the Location header but got '%s'", o.id)
+	}
+
+	opt.id_from_location = false
+	opt.id_fallback_attribute = "name"
+	o, _ = NewAPIObject(NewAPIClient(opt), &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err = o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object with id_fallback_attribute: %s", err)
+	} else if o.id != "widget" {
+		t.Fatalf("api_object_test.go: Expected id 'widget' from id_fallback_attribute but got '%s'", o.id)
+	}
+}
+
+func TestAPIObjectWaitForReady(t *testing.T) {
+	var reads int32
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/jobs/1", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&reads, 1) < 3 {
+			w.Write([]byte(`{"id": "1", "state": {"phase": "pending"}}`))
+		} else {
+			w.Write([]byte(`{"id": "1", "state": {"phase": "ready"}}`))
+		}
+	})
+	serverMux.HandleFunc("/api/jobs/2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "2", "state": {"phase": "error"}}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8084", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8084/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+	opt := &api_object_opt{
+		path:                 "/api/jobs",
+		data:                 `{ "id": "1" }`,
+		debug:                api_object_debug,
+		ready_status_field:   "state.phase",
+		ready_status_value:   "ready",
+		failed_status_values: []string{"error"},
+		ready_timeout:        10,
+		ready_poll_interval:  1,
+	}
+
+	o, _ := NewAPIObject(client, opt)
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read job: %s", err)
+	}
+	if err := o.wait_for_ready(); err != nil {
+		t.Fatalf("api_object_test.go: Failed waiting for job to be ready: %s", err)
+	} else if n := atomic.LoadInt32(&reads); n != 3 {
+		t.Fatalf("api_object_test.go: Expected the job to be read 3 times but it was read %d times", n)
+	}
+
+	opt.data = `{ "id": "2" }`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read job: %s", err)
+	}
+	if err := o.wait_for_ready(); err == nil {
+		t.Fatalf("api_object_test.go: Expected a job in a failed state to fail waiting for it to be ready")
+	}
+}
+
+func TestAPIObjectSchema(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8081/",
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+	opt := &api_object_opt{
+		path:  "/api/objects",
+		data:  `{ "id": "1" }`,
+		debug: api_object_debug,
+		api_schema: map[string]string{
+			"name":          "string",
+			"spec.replicas": "number",
+			"spec.enabled":  "bool",
+			"spec.tags":     "json",
+		},
+		preserve_unknown: true,
+	}
+	o, _ := NewAPIObject(client, opt)
+
+	err := o.update_state(`{"id": "1", "name": "web", "spec": {"replicas": "3", "enabled": true, "tags": ["a", "b"]}, "owner": "me"}`)
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to update state: %s", err)
+	}
+	if o.typed.strings["name"] != "web" {
+		t.Fatalf("api_object_test.go: Expected string 'web' for name but got '%s'", o.typed.strings["name"])
+	}
+	if o.typed.numbers["spec.replicas"] != 3 {
+		t.Fatalf("api_object_test.go: Expected number 3 for spec.replicas but got %v", o.typed.numbers["spec.replicas"])
+	}
+	if !o.typed.bools["spec.enabled"] {
+		t.Fatalf("api_object_test.go: Expected bool true for spec.enabled")
+	}
+	if o.typed.json["spec.tags"] != `["a","b"]` {
+		t.Fatalf("api_object_test.go: Expected JSON '[\"a\",\"b\"]' for spec.tags but got '%s'", o.typed.json["spec.tags"])
+	}
+	if o.typed.other["owner"] != `"me"` {
+		t.Fatalf("api_object_test.go: Expected the unknown field 'owner' to be preserved but got %+v", o.typed.other)
+	} else if _, ok := o.typed.other["spec"]; ok {
+		t.Fatalf("api_object_test.go: Expected 'spec' to be covered by api_schema but it is in %+v", o.typed.other)
+	}
+
+	err = o.update_state(`{"id": "1", "spec": {"replicas": "many"}}`)
+	if err == nil {
+		t.Fatalf("api_object_test.go: Expected an error converting 'many' to a number")
+	}
+}
+
 func generate_test_api_objects(typed *map[string]test_api_object, untyped *map[string]map[string]interface{}, t *testing.T, test_debug bool) {
 	add_test_api_object(
 		`{
@@ -242,3 +487,1471 @@ func add_test_api_object(input string, test_api_objects *map[string]test_api_obj
 		(*api_server_objects)[id] = api_server_obj
 	}
 }
+
+func TestAPIObjectIDCase(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "AB12-CD34", "name": "widget"}`))
+	})
+	/* Like many APIs, this one only accepts the lower case id */
+	serverMux.HandleFunc("/api/things/ab12-cd34", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "AB12-CD34", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8085", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                  "http://127.0.0.1:8085/",
+		timeout:              2,
+		id_attribute:         "id",
+		id_case:              "lower",
+		write_returns_object: true,
+		debug:                api_client_debug,
+	})
+
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err := o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object: %s", err)
+	} else if o.id != "ab12-cd34" {
+		t.Fatalf("api_object_test.go: Expected the created id to be lower cased to 'ab12-cd34' but got '%s'", o.id)
+	}
+
+	/* An id in state with different casing reads the same object
+	   and comes back unchanged, so there is nothing to diff */
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/things", id: "AB12-cd34", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read object: %s", err)
+	} else if o.id != "ab12-cd34" {
+		t.Fatalf("api_object_test.go: Expected id 'ab12-cd34' after reading but got '%s'", o.id)
+	}
+}
+
+func TestAPIObjectUpdateDefaults(t *testing.T) {
+	var put_body []byte
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			put_body, _ = ioutil.ReadAll(r.Body)
+		}
+		w.Write([]byte(`{"id": "1", "name": "server", "version": 7, "etag": "abc"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8086", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8086/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	o, err := NewAPIObject(client, &api_object_opt{
+		path:             "/api/docs",
+		id:               "1",
+		data:             `{ "id": "1", "name": "mine" }`,
+		update_defaults:  `{ "kind": "doc", "name": "default" }`,
+		update_copy_keys: []string{"version", "missing"},
+		debug:            api_object_debug,
+	})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to make object: %s", err)
+	}
+	if err = o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read object: %s", err)
+	}
+	if err = o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update object: %s", err)
+	}
+
+	sent := make(map[string]interface{})
+	json.Unmarshal(put_body, &sent)
+	expected := map[string]interface{}{"id": "1", "name": "mine", "kind": "doc", "version": float64(7)}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("api_object_test.go: Expected the update to send %v but it sent %s", expected, put_body)
+	}
+}
+
+func TestAPIObjectPriorStateGuard(t *testing.T) {
+	current := `{"id": "1", "name": "theirs"}`
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			sum := sha256.Sum256([]byte(current))
+			if r.Header.Get("X-Prior-Hash") != hex.EncodeToString(sum[:]) {
+				http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+				return
+			}
+		}
+		w.Write([]byte(current))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8087", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                "http://127.0.0.1:8087/",
+		timeout:            2,
+		id_attribute:       "id",
+		prior_state_header: "X-Prior-Hash",
+		debug:              api_client_debug,
+	})
+
+	/* Someone else changed the object since it was last read */
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/docs", id: "1", data: `{ "id": "1", "name": "mine" }`, prior_response: `{"id": "1", "name": "old"}`, debug: api_object_debug})
+	err := o.update_object()
+	if err == nil || !strings.Contains(err.Error(), "changed on the server") {
+		t.Fatalf("api_object_test.go: Expected a conflict error updating a changed object but got: %v", err)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/docs", id: "1", data: `{ "id": "1", "name": "mine" }`, prior_response: current, debug: api_object_debug})
+	if err = o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update an unchanged object: %s", err)
+	}
+}
+
+func TestAPIObjectCopyKeysEmptyAsAbsent(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:                       "http://127.0.0.1:8081/",
+		id_attribute:              "id",
+		copy_keys:                 []string{"note", "label", "/meta/etag", "strict"},
+		copy_keys_empty_as_absent: []string{"note", "label", "/meta/etag"},
+		debug:                     api_client_debug,
+	})
+
+	for _, test := range []struct {
+		data     string
+		response string
+		expected string
+	}{
+		/* The API leaves out what data has as empty */
+		{`{"id": "1", "note": "", "meta": {"etag": ""}}`, `{"id": "1"}`, `{"id": "1", "note": "", "meta": {"etag": ""}, "strict": null}`},
+		/* The API has as empty what data leaves out */
+		{`{"id": "1"}`, `{"id": "1", "note": "", "label": null, "meta": {"etag": ""}}`, `{"id": "1", "strict": null}`},
+		/* Real values are still copied either way */
+		{`{"id": "1", "note": ""}`, `{"id": "1", "note": "set", "label": "x", "meta": {"etag": "v2"}}`, `{"id": "1", "note": "set", "label": "x", "meta": {"etag": "v2"}, "strict": null}`},
+		{`{"id": "1", "note": "old"}`, `{"id": "1"}`, `{"id": "1", "note": null, "strict": null}`},
+		/* Other copy_keys keep the difference */
+		{`{"id": "1", "strict": ""}`, `{"id": "1"}`, `{"id": "1", "strict": null}`},
+	} {
+		o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", data: test.data, debug: api_object_debug})
+		if err := o.update_state(test.response); err != nil {
+			t.Fatalf("api_object_test.go: Failed to update state: %s", err)
+		}
+		expected := map[string]interface{}{}
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(o.data, expected) {
+			got, _ := json.Marshal(o.data)
+			t.Fatalf("api_object_test.go: Expected data %s with %s from the API to become %s but got %s", test.data, test.response, test.expected, got)
+		}
+	}
+}
+
+func TestAPIObjectCopyKeysArrayStrategy(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8081/",
+		id_attribute: "id",
+		copy_keys:    []string{"tags", "rules", "ports"},
+		copy_keys_array_strategy: map[string]string{
+			"rules": "merge_by_key:name",
+			"ports": "merge_by_index",
+		},
+		debug: api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:  "/api/things",
+		data:  `{ "id": "1", "tags": ["a"], "rules": [{"name": "b", "allow": true}, {"name": "a"}], "ports": [{"port": 80}] }`,
+		debug: api_object_debug,
+	})
+
+	/* The server reorders rules, adds to them and fills in defaults */
+	err := o.update_state(`{ "id": "1", "tags": ["a", "server"],
+		"rules": [{"name": "a", "rid": 1}, {"name": "b", "allow": false, "rid": 2}, {"name": "c", "rid": 3}],
+		"ports": [{"port": 80, "proto": "tcp"}, {"port": 443}] }`)
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to update state: %s", err)
+	}
+
+	expected := map[string]interface{}{}
+	json.Unmarshal([]byte(`{ "id": "1", "tags": ["a", "server"],
+		"rules": [{"name": "b", "allow": true, "rid": 2}, {"name": "a", "rid": 1}, {"name": "c", "rid": 3}],
+		"ports": [{"port": 80, "proto": "tcp"}, {"port": 443}] }`), &expected)
+	if !reflect.DeepEqual(o.data, expected) {
+		t.Fatalf("api_object_test.go: Expected data %v after copying keys but got %v", expected, o.data)
+	}
+}
+
+func TestAPIObjectNullFields(t *testing.T) {
+	opt := &api_client_opt{
+		uri:          "http://127.0.0.1:8081/",
+		id_attribute: "id",
+		debug:        api_client_debug,
+	}
+	data := `{ "id": "1", "name": null, "spec": { "size": null, "tags": [null, "a"] } }`
+
+	o, _ := NewAPIObject(NewAPIClient(opt), &api_object_opt{path: "/api/things", data: data, debug: api_object_debug})
+	if body := o.request_body(); body != `{"id":"1","name":null,"spec":{"size":null,"tags":[null,"a"]}}` {
+		t.Fatalf("api_object_test.go: Expected nulls to be sent by default but got %s", body)
+	}
+
+	opt.null_fields = "strip"
+	o, _ = NewAPIObject(NewAPIClient(opt), &api_object_opt{path: "/api/things", data: data, debug: api_object_debug})
+	if body := o.request_body(); body != `{"id":"1","spec":{"tags":[null,"a"]}}` {
+		t.Fatalf("api_object_test.go: Expected null fields to be stripped but got %s", body)
+	}
+}
+
+func TestAPIObjectReadBeforeDestroy(t *testing.T) {
+	var deleted string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			body, _ := ioutil.ReadAll(r.Body)
+			deleted = r.Header.Get("If-Match") + " " + string(body)
+			return
+		}
+		w.Write([]byte(`{"id": "1", "version": 8, "etag": "v8"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8088", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8088/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	opt := &api_object_opt{
+		path:            "/api/docs",
+		id:              "1",
+		data:            `{ "id": "1" }`,
+		destroy_data:    `{"version": {data.version}}`,
+		destroy_headers: map[string]string{"If-Match": "{etag}"},
+		debug:           api_object_debug,
+	}
+	o, _ := NewAPIObject(client, opt)
+	if err := o.delete_object(); err == nil || !strings.Contains(err.Error(), "{data.version}") {
+		t.Fatalf("api_object_test.go: Expected an error about {data.version} without a read first but got: %v", err)
+	}
+
+	opt.read_before_destroy = true
+	o, _ = NewAPIObject(client, opt)
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object: %s", err)
+	} else if deleted != `v8 {"version": 8}` {
+		t.Fatalf("api_object_test.go: Expected the delete to send the fresh version but it sent '%s'", deleted)
+	}
+}
+
+func TestAPIObjectServerDefaults(t *testing.T) {
+	var sent []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			sent = append(sent, string(body))
+		}
+		w.Write([]byte(`{"id": "1", "name": "doc", "color": "blue", "size": 3}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8118", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                   "http://127.0.0.1:8118/",
+		timeout:               2,
+		id_attribute:          "id",
+		merge_server_defaults: true,
+		debug:                 api_client_debug,
+	})
+
+	/* The first read finds what the server filled in, but
+	   leaves the data alone */
+	opt := &api_object_opt{
+		path:  "/api/docs",
+		id:    "1",
+		data:  `{"id": "1", "name": "doc", "size": 5}`,
+		debug: api_object_debug,
+	}
+	o, _ := NewAPIObject(client, opt)
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read object: %s", err)
+	}
+	if defaults := o.find_server_defaults(); !reflect.DeepEqual(defaults, map[string]interface{}{"color": "blue"}) {
+		t.Fatalf("api_object_test.go: Expected only the color as a server default but got %v", defaults)
+	}
+	if _, ok := o.data["color"]; ok {
+		t.Fatalf("api_object_test.go: Expected reading not to change data but got %v", o.data)
+	}
+
+	/* What the server manages itself, and secrets, are never
+	   kept to be sent back */
+	managed := NewAPIClient(&api_client_opt{
+		uri:                   "http://127.0.0.1:8118/",
+		timeout:               2,
+		id_attribute:          "id",
+		copy_keys:             []string{"revision"},
+		computed_keys:         []string{"updated_at"},
+		sensitive_fields:      []string{"password"},
+		merge_server_defaults: true,
+		debug:                 api_client_debug,
+	})
+	o, _ = NewAPIObject(managed, &api_object_opt{
+		path:  "/api/docs",
+		id:    "1",
+		data:  `{"name": "doc"}`,
+		debug: api_object_debug,
+	})
+	o.update_state(`{"id": "1", "name": "doc", "color": "blue", "revision": 7, "updated_at": "2026-01-01T00:00:00Z", "password": "hunter2"}`)
+	if defaults := o.find_server_defaults(); !reflect.DeepEqual(defaults, map[string]interface{}{"color": "blue"}) {
+		t.Fatalf("api_object_test.go: Expected the id, revision, timestamp and password to be left out of the server defaults but got %v", defaults)
+	}
+
+	/* Updates send the defaults where data does not set them */
+	opt.server_defaults = `{"color": "blue"}`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update object: %s", err)
+	}
+	opt.data = `{"id": "1", "name": "doc", "color": "red"}`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update object: %s", err)
+	}
+	expected := []string{
+		`{"color":"blue","id":"1","name":"doc","size":5}`,
+		`{"color":"red","id":"1","name":"doc"}`,
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("api_object_test.go: Expected the updates:\n%s\nbut sent:\n%s", strings.Join(expected, "\n"), strings.Join(sent, "\n"))
+	}
+
+	opt.server_defaults = `[1]`
+	if _, err := NewAPIObject(client, opt); err == nil {
+		t.Fatalf("api_object_test.go: Expected an error for server_defaults that is not a JSON object")
+	}
+}
+
+func TestAPIObjectDestroyData(t *testing.T) {
+	var deleted []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deleted = append(deleted, string(body))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8117", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8117/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	/* A literal JSON body has braces that are not placeholders */
+	opt := &api_object_opt{
+		path:         "/api/docs",
+		id:           "1",
+		data:         `{ "id": "1", "note": "say \"hi\" \\ bye", "spec": { "tags": ["a", "b"] } }`,
+		destroy_data: `{"force": true}`,
+		debug:        api_object_debug,
+	}
+	o, _ := NewAPIObject(client, opt)
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object with a literal body: %s", err)
+	}
+
+	/* Values are escaped to keep the body valid JSON */
+	opt.destroy_data = `{"id": "{id}", "reason": "{data.note}", "tags": {data.spec.tags}}`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object with placeholders: %s", err)
+	}
+
+	expected := []string{
+		`{"force": true}`,
+		`{"id": "1", "reason": "say \"hi\" \\ bye", "tags": ["a","b"]}`,
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Fatalf("api_object_test.go: Expected the delete bodies:\n%s\nbut sent:\n%s", strings.Join(expected, "\n"), strings.Join(deleted, "\n"))
+	}
+	sent := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(deleted[1]), &sent); err != nil || sent["reason"] != `say "hi" \ bye` {
+		t.Fatalf("api_object_test.go: Expected a valid JSON body with the note intact but got %v: %v", sent, err)
+	}
+
+	opt.destroy_data = `{"version": {data.version}}`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.delete_object(); err == nil || !strings.Contains(err.Error(), "{data.version}") {
+		t.Fatalf("api_object_test.go: Expected an error about {data.version} but got: %v", err)
+	}
+}
+
+func TestAPIObjectIdBodyField(t *testing.T) {
+	var sent []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "GET" {
+			sent = append(sent, r.Method+" "+r.URL.Path+" "+string(body))
+		}
+		w.Write([]byte(`{"uid": 42, "name": "doc"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8115", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:           "http://127.0.0.1:8115/",
+		timeout:       2,
+		id_attribute:  "uid",
+		id_body_field: "/meta/uid",
+		debug:         api_client_debug,
+	})
+
+	/* The id in data is wrong, and the one from state wins */
+	opt := &api_object_opt{
+		path:           "/api/docs",
+		id:             "42",
+		data:           `{"name": "doc", "meta": {"uid": 7, "owner": "me"}}`,
+		prior_response: `{"uid": 42, "name": "doc"}`,
+		debug:          api_object_debug,
+	}
+	o, _ := NewAPIObject(client, opt)
+	if err := o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update object: %s", err)
+	}
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object: %s", err)
+	}
+	opt.destroy_data = `{"force": true, "reason": "{data.name} is done"}`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object: %s", err)
+	}
+	expected := []string{
+		`PUT /api/docs/42 {"meta":{"owner":"me","uid":42},"name":"doc"}`,
+		`DELETE /api/docs/42 {"meta":{"uid":42}}`,
+		`DELETE /api/docs/42 {"force":true,"meta":{"uid":42},"reason":"doc is done"}`,
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("api_object_test.go: Expected the id in both the path and the body:\n%s\nbut sent:\n%s", strings.Join(expected, "\n"), strings.Join(sent, "\n"))
+	}
+	if uid := o.data["meta"].(map[string]interface{})["uid"]; uid != float64(7) {
+		t.Fatalf("api_object_test.go: Expected data to be left alone but got %v", o.data)
+	}
+
+	opt.destroy_data = `force=true`
+	o, _ = NewAPIObject(client, opt)
+	if err := o.delete_object(); err == nil || !strings.Contains(err.Error(), "must be a JSON object") {
+		t.Fatalf("api_object_test.go: Expected an error for destroy_data that is not JSON but got: %v", err)
+	}
+
+	/* The body is encoded like any other */
+	sent = nil
+	opt.destroy_data = ""
+	o, _ = NewAPIObject(NewAPIClient(&api_client_opt{
+		uri:             "http://127.0.0.1:8115/",
+		timeout:         2,
+		id_attribute:    "uid",
+		id_body_field:   "/meta/uid",
+		body_form_field: "payload",
+		debug:           api_client_debug,
+	}), opt)
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete object: %s", err)
+	}
+	if expected := []string{`DELETE /api/docs/42 payload=%7B%22meta%22%3A%7B%22uid%22%3A42%7D%7D`}; !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("api_object_test.go: Expected the delete body in a form field but sent:\n%s", strings.Join(sent, "\n"))
+	}
+}
+
+func TestAPIObjectProbe(t *testing.T) {
+	var probes []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/docs/1", func(w http.ResponseWriter, r *http.Request) {
+		probes = append(probes, r.Method+" "+r.URL.RawQuery)
+		w.Write([]byte(`{"id": "1"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8089", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8089/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/docs", id: "1", data: `{ "id": "1" }`, probe_method: "HEAD", debug: api_object_debug})
+	if err := o.probe_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to probe object: %s", err)
+	}
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/docs", id: "1", data: `{ "id": "1" }`, probe_query: "fields=id", debug: api_object_debug})
+	if err := o.probe_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to probe object: %s", err)
+	}
+	if !reflect.DeepEqual(probes, []string{"HEAD ", "GET fields=id"}) {
+		t.Fatalf("api_object_test.go: Expected a HEAD and a GET with fields=id but got %v", probes)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/docs", id: "2", data: `{ "id": "2" }`, probe_method: "HEAD", debug: api_object_debug})
+	if err := o.probe_object(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("api_object_test.go: Expected a 404 probing an object that does not exist but got: %v", err)
+	}
+}
+
+func TestAPIObjectCreateLookup(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		/* Creates say nothing about what was created */
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if r.URL.Query().Get("name") != "widget" {
+			w.Write([]byte(`{"items": []}`))
+			return
+		}
+		w.Write([]byte(`{"items": [{"id": "7", "name": "widget", "size": 1}, {"id": "8", "name": "widget", "size": 2}]}`))
+	})
+	serverMux.HandleFunc("/api/things/8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "8", "name": "widget", "size": 2}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8092", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8092/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	o, err := NewAPIObject(client, &api_object_opt{
+		path:                "/api/things",
+		data:                `{ "name": "widget", "size": 2 }`,
+		create_lookup_query: map[string]string{"name": "{name}"},
+		create_lookup_key:   "items",
+		debug:               api_object_debug,
+	})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Expected an object without an id to be allowed with create_lookup_query but got: %s", err)
+	}
+	if err = o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object with create_lookup_query: %s", err)
+	} else if o.id != "8" || o.api_data["size"] != 2.0 {
+		t.Fatalf("api_object_test.go: Expected the object with id '8' matching what was sent but got '%s': %v", o.id, o.api_data)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{
+		path:                "/api/things",
+		data:                `{ "name": "gadget" }`,
+		create_lookup_query: map[string]string{"name": "{name}"},
+		create_lookup_key:   "items",
+		debug:               api_object_debug,
+	})
+	if err = o.create_object(); err == nil || !strings.Contains(err.Error(), "found 0") {
+		t.Fatalf("api_object_test.go: Expected an error when the created object cannot be found but got: %v", err)
+	}
+}
+
+func TestAPIObjectImportedData(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:           "http://127.0.0.1:8081/",
+		id_attribute:  "id",
+		copy_keys:     []string{"revision"},
+		computed_keys: []string{"created"},
+		debug:         api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "1", data: `{ "id": "1" }`, debug: api_object_debug})
+
+	/* Keys the API sets itself are not the user's to manage */
+	o.update_state(`{ "id": "1", "name": "widget", "revision": 5, "created": "today" }`)
+	if data := o.imported_data(); data != `{"id":"1","name":"widget"}` {
+		t.Fatalf("api_object_test.go: Expected imported data without copy_keys and computed_keys but got '%s'", data)
+	}
+}
+
+func TestAPIObjectTrailingSlash(t *testing.T) {
+	var requests []string
+	serverMux := http.NewServeMux()
+	/* Each API has a favourite and redirects to it */
+	serverMux.HandleFunc("/api/widgets/1", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		http.Redirect(w, r, "/api/widgets/1/", http.StatusMovedPermanently)
+	})
+	serverMux.HandleFunc("/api/widgets/1/", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": "1", "kind": "widget"}`))
+	})
+	serverMux.HandleFunc("/api/gadgets/1/", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		http.Redirect(w, r, "/api/gadgets/1", http.StatusMovedPermanently)
+	})
+	serverMux.HandleFunc("/api/gadgets/1", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": "1", "kind": "gadget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8093", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	for _, test := range []struct {
+		trailing_slash string
+		path           string
+		expected       []string
+	}{
+		{"", "/api/widgets", []string{"GET /api/widgets/1", "GET /api/widgets/1/"}},
+		{"add", "/api/widgets", []string{"GET /api/widgets/1/"}},
+		{"", "/api/gadgets/{id}/", []string{"GET /api/gadgets/1/", "GET /api/gadgets/1"}},
+		{"strip", "/api/gadgets/{id}/", []string{"GET /api/gadgets/1"}},
+	} {
+		requests = nil
+		client := NewAPIClient(&api_client_opt{
+			uri:            "http://127.0.0.1:8093/",
+			timeout:        2,
+			id_attribute:   "id",
+			trailing_slash: test.trailing_slash,
+			debug:          api_client_debug,
+		})
+		o, _ := NewAPIObject(client, &api_object_opt{path: test.path, id: "1", data: `{ "id": "1" }`, debug: api_object_debug})
+		if err := o.read_object(); err != nil {
+			t.Fatalf("api_object_test.go: Failed to read object at '%s' with trailing_slash '%s': %s", test.path, test.trailing_slash, err)
+		}
+		if !reflect.DeepEqual(requests, test.expected) {
+			t.Fatalf("api_object_test.go: Expected requests %v with trailing_slash '%s' but got %v", test.expected, test.trailing_slash, requests)
+		}
+	}
+}
+
+func TestAPIObjectSensitiveFields(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:              "http://127.0.0.1:8081/",
+		id_attribute:     "id",
+		sensitive_fields: []string{"password", "keys.1.secret", "missing.field"},
+		debug:            api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:       "/api/users",
+		id:         "1",
+		data:       `{ "id": "1" }`,
+		api_schema: map[string]string{"password": "string", "keys": "json"},
+		debug:      api_object_debug,
+	})
+
+	o.update_state(`{"id": "1", "password": "hunter2", "keys": [{"secret": "a"}, {"secret": "b", "size": 2}]}`)
+	if masked := client.mask_body(o.api_response); masked != `{"id":"1","keys":[{"secret":"a"},{"secret":"<redacted>","size":2}],"password":"<redacted>"}` {
+		t.Fatalf("api_object_test.go: Expected the sensitive fields to be masked but got '%s'", masked)
+	}
+	if _, ok := o.typed.strings["password"]; ok || strings.Contains(o.typed.json["keys"], `"b"`) {
+		t.Fatalf("api_object_test.go: Expected sensitive fields to be left out of typed data but got %v %v", o.typed.strings, o.typed.json)
+	}
+	/* The real values are still there for the provider to use */
+	if o.api_data["password"] != "hunter2" {
+		t.Fatalf("api_object_test.go: Expected api_data to keep the password but got %v", o.api_data)
+	}
+	if body := `{"id": "2"}`; client.mask_body(body) != body {
+		t.Fatalf("api_object_test.go: Expected a body without sensitive fields to be left as it is")
+	}
+
+	/* JSON Pointers, as every other path option takes */
+	client.sensitive_fields = []string{"/credentials/0/api.key", "/a~1b"}
+	body := `{"id": "3", "credentials": [{"api.key": "s3cret", "name": "ci"}], "a/b": "x"}`
+	if masked := client.mask_body(body); masked != `{"a/b":"<redacted>","credentials":[{"api.key":"<redacted>","name":"ci"}],"id":"3"}` {
+		t.Fatalf("api_object_test.go: Expected the JSON Pointer fields to be masked but got '%s'", masked)
+	}
+}
+
+func TestAPIObjectSelfLink(t *testing.T) {
+	var requests []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": "1", "name": "widget", "_links": {"self": {"href": "http://127.0.0.1:8094/api/v2/things/abc"}}}`))
+	})
+	serverMux.HandleFunc("/api/v2/things/abc", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": "1", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8094", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                   "http://127.0.0.1:8094/api",
+		timeout:               2,
+		id_attribute:          "id",
+		create_returns_object: true,
+		self_link_path:        "_links.self.href",
+		debug:                 api_client_debug,
+	})
+
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err := o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object: %s", err)
+	}
+	/* The read response has no link, so the one from the create is kept */
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read object at its link: %s", err)
+	}
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read object at its link again: %s", err)
+	}
+	if !reflect.DeepEqual(requests, []string{"POST /api/things", "GET /api/v2/things/abc", "GET /api/v2/things/abc"}) {
+		t.Fatalf("api_object_test.go: Expected the object to be read at its link but got %v", requests)
+	}
+}
+
+func TestAPIObjectAsyncOperation(t *testing.T) {
+	var polls int32
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		if strings.Contains(r.URL.RawQuery, "bad") {
+			w.Write([]byte(`{"operation": {"id": "op2"}}`))
+			return
+		}
+		w.Write([]byte(`{"operation": {"id": "op1"}}`))
+	})
+	serverMux.HandleFunc("/api/operations/op1", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) < 2 {
+			w.Write([]byte(`{"state": "running"}`))
+			return
+		}
+		w.Write([]byte(`{"state": "done", "result": {"thing_id": "9"}}`))
+	})
+	serverMux.HandleFunc("/api/operations/op2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"state": "error", "message": "no capacity"}`))
+	})
+	serverMux.HandleFunc("/api/things/9", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "9", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8095", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8095/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+	operation := async_operation{
+		id_path:        "operation.id",
+		path:           "/api/operations/{operation_id}",
+		status_path:    "state",
+		success_values: []string{"done"},
+		failed_values:  []string{"error"},
+		result_id_path: "result.thing_id",
+	}
+
+	o, err := NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, operation: operation, ready_poll_interval: 1, debug: api_object_debug})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Expected an object without an id to be allowed with operation_result_id_path but got: %s", err)
+	}
+	if err = o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create object with an async operation: %s", err)
+	} else if o.id != "9" || o.api_data["name"] != "widget" || atomic.LoadInt32(&polls) != 2 {
+		t.Fatalf("api_object_test.go: Expected object '9' to be read after the operation was done but got '%s' after %d polls", o.id, polls)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, query_params: map[string]string{"q": "bad"}, operation: operation, ready_poll_interval: 1, debug: api_object_debug})
+	if err = o.create_object(); err == nil || !strings.Contains(err.Error(), "no capacity") {
+		t.Fatalf("api_object_test.go: Expected the failed operation to be reported but got: %v", err)
+	}
+}
+
+func TestAPIObjectVerifyCreated(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:           "http://127.0.0.1:8081/",
+		id_attribute:  "id",
+		copy_keys:     []string{"revision"},
+		verify_create: "error",
+		debug:         api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:  "/api/things",
+		data:  `{ "id": "1", "name": "widget", "spec": { "size": 2 }, "color": "red", "revision": 0 }`,
+		debug: api_object_debug,
+	})
+	sent := make(map[string]interface{})
+	for k, v := range o.data {
+		sent[k] = v
+	}
+
+	/* Extra fields are fine, but color was dropped and size changed */
+	o.update_state(`{ "id": "1", "name": "widget", "spec": { "size": 3, "unit": "m" }, "revision": 5, "created": "today" }`)
+	err := o.verify_created(sent)
+	if err == nil || !strings.Contains(err.Error(), `color (dropped), spec (sent {"size":2}, got {"size":3,"unit":"m"})`) {
+		t.Fatalf("api_object_test.go: Expected an error naming color and spec but got: %v", err)
+	}
+
+	o.update_state(`{ "id": "1", "name": "widget", "spec": { "size": 2, "unit": "m" }, "color": "red", "revision": 5 }`)
+	if err = o.verify_created(sent); err != nil {
+		t.Fatalf("api_object_test.go: Expected no error when the API kept every field but got: %s", err)
+	}
+}
+
+func TestAPIObjectVerifyCreatedCoerced(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:           "http://127.0.0.1:8081/",
+		id_attribute:  "id",
+		verify_create: "error",
+		debug:         api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:          "/api/things",
+		data:          `{ "id": "1", "name": "widget", "port": "8080" }`,
+		coerce_fields: map[string]string{"port": "number"},
+		debug:         api_object_debug,
+	})
+	sent := o.sent_data()
+
+	/* The port was sent as a number, so that is what is compared */
+	o.update_state(`{ "id": "1", "name": "widget", "port": 8080 }`)
+	if err := o.verify_created(sent); err != nil {
+		t.Fatalf("api_object_test.go: Expected no error when the API kept the coerced port but got: %s", err)
+	}
+
+	o.update_state(`{ "id": "1", "name": "widget", "port": "8080" }`)
+	if err := o.verify_created(sent); err == nil || !strings.Contains(err.Error(), `port (sent 8080, got "8080")`) {
+		t.Fatalf("api_object_test.go: Expected an error naming the port but got: %v", err)
+	}
+}
+
+func TestAPIObjectListRead(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		/* There is no GET for one thing, only pages of them */
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Write([]byte(`{"items": [{"meta": {"uid": 7}, "name": "widget"}, {"meta": {"uid": 8}, "name": "gadget"}]}`))
+		case "2":
+			w.Write([]byte(`{"items": [{"meta": {"uid": 9}, "name": "doohickey"}, {"meta": {"uid": 9}, "name": "copy"}]}`))
+		default:
+			w.Write([]byte(`{"items": []}`))
+		}
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8096", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8096/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+	read := list_read{
+		path:        "/api/things",
+		results_key: "items",
+		id_path:     "meta.uid",
+		paging:      list_paging{page_param: "page", page_size: 2},
+	}
+
+	for id, expected := range map[string]string{"8": "gadget", "7": "widget"} {
+		o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: id, data: `{}`, list_read: read, debug: api_object_debug})
+		if err := o.read_object(); err != nil {
+			t.Fatalf("api_object_test.go: Failed to read object '%s' from its list: %s", id, err)
+		} else if o.api_data["name"] != expected {
+			t.Fatalf("api_object_test.go: Expected object '%s' to be '%s' but got: %v", id, expected, o.api_data)
+		}
+	}
+
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "10", data: `{}`, list_read: read, debug: api_object_debug})
+	if err := o.read_object(); err != object_not_listed {
+		t.Fatalf("api_object_test.go: Expected an object missing from the list to be object_not_listed but got: %v", err)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/things", id: "9", data: `{}`, list_read: read, debug: api_object_debug})
+	if err := o.read_object(); err == nil || !strings.Contains(err.Error(), "found 2") {
+		t.Fatalf("api_object_test.go: Expected an error when two objects have the id but got: %v", err)
+	}
+}
+
+func TestAPIObjectPaginatedRead(t *testing.T) {
+	/* A group of five members, two to a page */
+	members := []string{`{"user": "a"}`, `{"user": "b"}`, `{"user": "c"}`, `{"user": "d"}`, `{"user": "e"}`}
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/groups/1", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		size, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		start, end := (page-1)*size, page*size
+		if start > len(members) {
+			start = len(members)
+		}
+		if end > len(members) {
+			end = len(members)
+		}
+		w.Write([]byte(`{"data": {"id": "1", "name": "admins", "members": [` + strings.Join(members[start:end], ",") + `]}, "page": ` + strconv.Itoa(page) + `}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8114", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                "http://127.0.0.1:8114/",
+		timeout:            2,
+		id_attribute:       "id",
+		object_unwrap_path: "data",
+		debug:              api_client_debug,
+	})
+	read := list_read{
+		results_key: "data.members",
+		paging:      list_paging{page_param: "page", page_size_param: "per_page", page_size: 2},
+		paginated:   true,
+	}
+
+	o, err := NewAPIObject(client, &api_object_opt{path: "/api/groups", id: "1", data: `{"id": "1", "name": "admins"}`, list_read: read, debug: api_object_debug})
+	if err != nil {
+		t.Fatalf("api_object_test.go: %s", err)
+	}
+	if err = o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read the pages of the group: %s", err)
+	}
+	got, _ := json.Marshal(o.api_data["members"])
+	if string(got) != `[{"user":"a"},{"user":"b"},{"user":"c"},{"user":"d"},{"user":"e"}]` || o.api_data["name"] != "admins" {
+		t.Fatalf("api_object_test.go: Expected the group with all five members but got: %v", o.api_data)
+	}
+
+	read.path = "/api/groups"
+	if _, err = NewAPIObject(client, &api_object_opt{path: "/api/groups", id: "1", data: `{}`, list_read: read, debug: api_object_debug}); err == nil {
+		t.Fatalf("api_object_test.go: Expected read_paginated with read_list_path to be an error")
+	}
+	read.path = ""
+	read.paging.page_param = ""
+	if _, err = NewAPIObject(client, &api_object_opt{path: "/api/groups", id: "1", data: `{}`, list_read: read, debug: api_object_debug}); err == nil {
+		t.Fatalf("api_object_test.go: Expected read_paginated without read_list_page_param to be an error")
+	}
+
+	/* A group that is gone is gone, not an error */
+	read.paging.page_param = "page"
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/groups", id: "2", data: `{}`, list_read: read, debug: api_object_debug})
+	if exists, err := o.exists(false); exists || err != nil {
+		t.Fatalf("api_object_test.go: Expected a missing group to not exist but got exists=%t: %v", exists, err)
+	}
+}
+
+func TestAPIObjectJSONPointers(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:           "http://127.0.0.1:8081/",
+		id_attribute:  "/meta/uid",
+		copy_keys:     []string{"/meta/version", "/tags/0", "a.b"},
+		computed_keys: []string{"/meta/created"},
+		debug:         api_client_debug,
+	})
+
+	o, err := NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "meta": { "uid": "7" }, "tags": ["mine"], "name": "widget" }`, debug: api_object_debug})
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to make an object with its id at a JSON Pointer: %s", err)
+	} else if o.id != "7" {
+		t.Fatalf("api_object_test.go: Expected the id '7' from /meta/uid but got '%s'", o.id)
+	}
+
+	o.update_state(`{ "meta": { "uid": "7", "version": 3, "created": "today" }, "tags": ["theirs"], "a.b": "dotted", "name": "widget" }`)
+	if data, _ := json.Marshal(o.data); string(data) != `{"a.b":"dotted","meta":{"uid":"7","version":3},"name":"widget","tags":["theirs"]}` {
+		t.Fatalf("api_object_test.go: Expected copy_keys to be copied into nested objects and arrays but got '%s'", data)
+	}
+	if data := o.imported_data(); data != `{"meta":{"uid":"7"},"name":"widget","tags":["theirs"]}` {
+		t.Fatalf("api_object_test.go: Expected imported data without nested copy_keys and computed_keys but got '%s'", data)
+	}
+	if _, ok := o.api_data["meta"].(map[string]interface{})["created"]; !ok {
+		t.Fatalf("api_object_test.go: Expected imported_data to leave api_data alone")
+	}
+
+	if val, ok := get_path(map[string]interface{}{"a/b": map[string]interface{}{"c~d": 1.0}}, "/a~1b/c~0d"); !ok || val != 1.0 {
+		t.Fatalf("api_object_test.go: Expected ~1 and ~0 to be unescaped in a JSON Pointer but got %v", val)
+	}
+}
+
+func TestAPIObjectDedupKeys(t *testing.T) {
+	var posts int32
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		/* The create is made, but the gateway gives up on it */
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		if atomic.LoadInt32(&posts) == 0 || r.URL.Query().Get("name") != "widget" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"id": "5", "name": "widget", "size": 1}, {"id": "6", "name": "widgets", "size": 2}]`))
+	})
+	serverMux.HandleFunc("/api/things/5", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "5", "name": "widget", "size": 1}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8097", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                "http://127.0.0.1:8097/",
+		timeout:            2,
+		id_attribute:       "id",
+		id_from_location:   true,
+		retry_max_attempts: 3,
+		debug:              api_client_debug,
+	})
+
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:                "/api/things",
+		data:                `{ "name": "widget", "size": 1 }`,
+		create_lookup_query: map[string]string{"name": "{name}"},
+		dedup_keys:          []string{"name"},
+		debug:               api_object_debug,
+	})
+	if err := o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Expected the object made by a failed create to be used but got: %s", err)
+	}
+	if o.id != "5" || atomic.LoadInt32(&posts) != 1 {
+		t.Fatalf("api_object_test.go: Expected object '5' from one POST but got '%s' from %d", o.id, atomic.LoadInt32(&posts))
+	}
+}
+
+func TestAPIObjectUnwrapPaths(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/widgets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"widgets": [{"id": "1", "name": "one"}, {"id": "2", "name": "two"}]}`))
+	})
+	serverMux.HandleFunc("/api/widgets/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/widgets/")
+		w.Write([]byte(`{"widget": {"id": "` + id + `", "name": "widget ` + id + `"}}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8098", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                "http://127.0.0.1:8098/",
+		timeout:            2,
+		id_attribute:       "id",
+		object_unwrap_path: "widget",
+		list_unwrap_path:   "widgets",
+		debug:              api_client_debug,
+	})
+
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/widgets", id: "3", data: `{}`, debug: api_object_debug})
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read a wrapped object: %s", err)
+	} else if o.api_data["name"] != "widget 3" {
+		t.Fatalf("api_object_test.go: Expected the object at object_unwrap_path but got: %v", o.api_data)
+	}
+
+	list, err := client.list_objects("/api/widgets", "", nil)
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to list wrapped objects: %s", err)
+	} else if len(list) != 2 {
+		t.Fatalf("api_object_test.go: Expected the 2 objects at list_unwrap_path but got: %v", list)
+	}
+
+	objects, err := client.read_objects("/api/widgets", []string{"4"}, 1)
+	if err != nil {
+		t.Fatalf("api_object_test.go: Failed to read wrapped objects by id: %s", err)
+	} else if objects["4"] != `{"id":"4","name":"widget 4"}` {
+		t.Fatalf("api_object_test.go: Expected objects read by id to be unwrapped but got: %v", objects)
+	}
+}
+
+func TestAPIObjectIdChanged(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things/1", func(w http.ResponseWriter, r *http.Request) {
+		/* The API has renumbered the object */
+		w.Write([]byte(`{"id": "2", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8099", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	for _, mode := range []string{"", "ignore", "error", "adopt"} {
+		client := NewAPIClient(&api_client_opt{
+			uri:          "http://127.0.0.1:8099/",
+			timeout:      2,
+			id_attribute: "id",
+			id_changed:   mode,
+			debug:        api_client_debug,
+		})
+		o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "1", data: `{ "name": "widget" }`, debug: api_object_debug})
+		err := o.read_object()
+
+		switch mode {
+		case "error":
+			if err == nil || !strings.Contains(err.Error(), "'2'") {
+				t.Fatalf("api_object_test.go: Expected an error when the id changed with id_changed=error but got: %v", err)
+			}
+		case "adopt":
+			if err != nil || o.id != "2" {
+				t.Fatalf("api_object_test.go: Expected the new id '2' with id_changed=adopt but got '%s': %v", o.id, err)
+			}
+		default:
+			if err != nil || o.id != "1" {
+				t.Fatalf("api_object_test.go: Expected to keep the id '1' with id_changed='%s' but got '%s': %v", mode, o.id, err)
+			}
+		}
+	}
+}
+
+func TestAPIObjectIntegerIds(t *testing.T) {
+	/* Above 2^53, so a float64 would round it */
+	const big = "9007199254740993"
+	var paths []string
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": ` + big + `, "name": "widget"}`))
+	})
+	serverMux.HandleFunc("/api/things/", func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": ` + big + `, "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8104", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	client := NewAPIClient(&api_client_opt{
+		uri:                   "http://127.0.0.1:8104/",
+		timeout:               2,
+		id_attribute:          "id",
+		create_returns_object: true,
+		debug:                 api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "name": "widget" }`, debug: api_object_debug})
+	if err := o.create_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to create the object: %s", err)
+	}
+	if o.id != big {
+		t.Fatalf("api_object_test.go: Expected the id '%s' but got '%s'", big, o.id)
+	}
+
+	if err := o.read_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to read the object: %s", err)
+	}
+	if err := o.update_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to update the object: %s", err)
+	}
+	if err := o.delete_object(); err != nil {
+		t.Fatalf("api_object_test.go: Failed to delete the object: %s", err)
+	}
+	for _, p := range paths {
+		if !strings.HasSuffix(p, " /api/things/"+big) {
+			t.Fatalf("api_object_test.go: Expected every request to use the id '%s' but got '%s'", big, p)
+		}
+	}
+	if len(paths) == 0 || !strings.HasPrefix(paths[len(paths)-1], "DELETE ") {
+		t.Fatalf("api_object_test.go: Expected the object to be deleted but got requests %v", paths)
+	}
+
+	/* An id given in the data is kept exactly too */
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/api/things", data: `{ "id": ` + big + `, "name": "widget" }`, debug: api_object_debug})
+	if o.id != big {
+		t.Fatalf("api_object_test.go: Expected the id '%s' from the data but got '%s'", big, o.id)
+	}
+}
+
+func TestAPIObjectPathVariables(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:            "http://127.0.0.1:8080/",
+		timeout:        2,
+		id_attribute:   "id",
+		path_variables: map[string]string{"account": "acme", "region": "eu"},
+		debug:          api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/accounts/{account}/{kind}", id: "1", data: `{ "kind": "widgets" }`, debug: api_object_debug})
+
+	path, err := o.object_path()
+	if err != nil || path != "/accounts/acme/widgets/1" {
+		t.Fatalf("api_object_test.go: Expected the path '/accounts/acme/widgets/1' but got '%s': %v", path, err)
+	}
+
+	o, _ = NewAPIObject(client, &api_object_opt{path: "/accounts/{tenant}/widgets", id: "1", data: `{}`, debug: api_object_debug})
+	_, err = o.object_path()
+	if err == nil || !strings.Contains(err.Error(), "{tenant}") || !strings.Contains(err.Error(), "set: account, region") {
+		t.Fatalf("api_object_test.go: Expected an error naming {tenant} and the variables that are set but got: %v", err)
+	}
+
+	/* Data sources only have the variables, and {id} is left for read_objects */
+	path, err = client.fill_path_variables("/accounts/{account}/widgets/{id}", "path")
+	if err != nil || path != "/accounts/acme/widgets/{id}" {
+		t.Fatalf("api_object_test.go: Expected the path '/accounts/acme/widgets/{id}' but got '%s': %v", path, err)
+	}
+	_, err = client.fill_path_variables("/accounts/{tenant}/widgets", "path")
+	if err == nil || !strings.Contains(err.Error(), "{tenant}") {
+		t.Fatalf("api_object_test.go: Expected an error naming {tenant} but got: %v", err)
+	}
+}
+
+func TestAPIObjectExists(t *testing.T) {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things/", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/things/"))
+		w.WriteHeader(code)
+		w.Write([]byte(`{"id": "` + strconv.Itoa(code) + `"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8105", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	for _, test := range []struct {
+		gone_codes []int
+		id         string
+		exists     bool
+		err        string
+	}{
+		{nil, "200", true, ""},
+		{nil, "404", false, ""},
+		{nil, "410", false, ""},
+		{nil, "403", false, "refused (HTTP 403)"},
+		{nil, "401", false, "refused (HTTP 401)"},
+		{nil, "500", false, "500"},
+		{[]int{404}, "410", false, "410"},
+		{[]int{404, 422}, "422", false, ""},
+	} {
+		client := NewAPIClient(&api_client_opt{
+			uri:          "http://127.0.0.1:8105/",
+			timeout:      2,
+			id_attribute: "id",
+			gone_codes:   test.gone_codes,
+			debug:        api_client_debug,
+		})
+		o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: test.id, data: `{}`, debug: api_object_debug})
+		for _, probe := range []bool{false, true} {
+			o.probe_method = ""
+			if probe {
+				o.probe_method = "HEAD"
+			}
+			exists, err := o.exists(probe)
+			if exists != test.exists || (test.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("api_object_test.go: Expected exists=%t and an error with '%s' for %s (gone_codes %v, probe %t) but got exists=%t: %v", test.exists, test.err, test.id, test.gone_codes, probe, exists, err)
+			}
+		}
+	}
+}
+
+func TestAPIObjectWriteResult(t *testing.T) {
+	/* Writes answer with the code under test. The object is
+	   then read, which does not change the result */
+	var code int32
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/api/things", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+		w.Write([]byte(`{"id": "1", "name": "widget"}`))
+	})
+	serverMux.HandleFunc("/api/things/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			w.WriteHeader(int(atomic.LoadInt32(&code)))
+		}
+		w.Write([]byte(`{"id": "1", "name": "widget"}`))
+	})
+	svr := &http.Server{Addr: "127.0.0.1:8112", Handler: serverMux}
+	go svr.ListenAndServe()
+	defer svr.Close()
+	time.Sleep(1 * time.Second)
+
+	for _, test := range []struct {
+		created_codes []int
+		updated_codes []int
+		code          int32
+		result        string
+	}{
+		{nil, nil, 201, "created"},
+		{nil, nil, 200, "updated"},
+		{nil, nil, 204, "updated"},
+		{nil, nil, 202, ""},
+		{[]int{200, 201}, []int{204}, 200, "created"},
+		{[]int{201}, []int{202}, 202, "updated"},
+	} {
+		client := NewAPIClient(&api_client_opt{
+			uri:           "http://127.0.0.1:8112/",
+			timeout:       2,
+			id_attribute:  "id",
+			created_codes: test.created_codes,
+			updated_codes: test.updated_codes,
+			debug:         api_client_debug,
+		})
+		atomic.StoreInt32(&code, test.code)
+		for _, method := range []string{"POST", "PUT"} {
+			o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "1", data: `{"id": "1", "name": "widget"}`, debug: api_object_debug})
+			var err error
+			if method == "POST" {
+				err = o.create_object()
+			} else {
+				err = o.update_object()
+			}
+			if err != nil {
+				t.Fatalf("api_object_test.go: %s for HTTP %d: %s", method, test.code, err)
+			}
+			if o.write_result != test.result {
+				t.Fatalf("api_object_test.go: Expected a %s answered with HTTP %d (created_codes %v, updated_codes %v) to be '%s' but got '%s'", method, test.code, test.created_codes, test.updated_codes, test.result, o.write_result)
+			}
+		}
+	}
+}
+
+func TestAPIObjectCoerceFields(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8080/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+
+	for _, test := range []struct {
+		data   string
+		fields map[string]string
+		body   string
+	}{
+		/* To string */
+		{`{"id": "1", "port": 8080}`, map[string]string{"port": "string"}, `{"id":"1","port":"8080"}`},
+		{`{"id": "1", "ratio": 0.25}`, map[string]string{"ratio": "string"}, `{"id":"1","ratio":"0.25"}`},
+		{`{"id": "1", "big": 12345678901}`, map[string]string{"big": "string"}, `{"big":"12345678901","id":"1"}`},
+		{`{"id": "1", "on": true}`, map[string]string{"on": "string"}, `{"id":"1","on":"true"}`},
+		{`{"id": 7}`, map[string]string{"id": "string"}, `{"id":"7"}`},
+		/* To number */
+		{`{"id": "1", "port": "8080"}`, map[string]string{"port": "number"}, `{"id":"1","port":8080}`},
+		{`{"id": "1", "ratio": " 0.25 "}`, map[string]string{"ratio": "number"}, `{"id":"1","ratio":0.25}`},
+		{`{"id": "1", "on": true}`, map[string]string{"on": "number"}, `{"id":"1","on":1}`},
+		/* To bool */
+		{`{"id": "1", "on": "true"}`, map[string]string{"on": "bool"}, `{"id":"1","on":true}`},
+		{`{"id": "1", "on": "0"}`, map[string]string{"on": "bool"}, `{"id":"1","on":false}`},
+		{`{"id": "1", "on": 1}`, map[string]string{"on": "bool"}, `{"id":"1","on":true}`},
+		/* Nested fields, missing fields and nulls */
+		{`{"id": "1", "spec": {"ports": [{"port": "80"}, {"port": "443"}]}}`, map[string]string{"spec.ports.1.port": "number"}, `{"id":"1","spec":{"ports":[{"port":"80"},{"port":443}]}}`},
+		{`{"id": "1", "spec": {"a.b": "1"}}`, map[string]string{"/spec/a.b": "number"}, `{"id":"1","spec":{"a.b":1}}`},
+		{`{"id": "1", "port": null}`, map[string]string{"port": "number", "missing": "bool", "spec.missing": "string"}, `{"id":"1","port":null}`},
+	} {
+		o, err := NewAPIObject(client, &api_object_opt{path: "/api/objects", data: test.data, coerce_fields: test.fields, debug: api_object_debug})
+		if err != nil {
+			t.Fatalf("api_object_test.go: %s", err)
+		}
+		if body := o.request_body(); body != test.body {
+			t.Fatalf("api_object_test.go: Expected %s with coerce_fields %v to be sent as %s but got %s", test.data, test.fields, test.body, body)
+		}
+		/* What is managed is kept as the user wrote it */
+		var data map[string]interface{}
+		json.Unmarshal([]byte(test.data), &data)
+		if !reflect.DeepEqual(o.data, data) {
+			t.Fatalf("api_object_test.go: Expected data to be left as %s but got %v", test.data, o.data)
+		}
+	}
+
+	for _, test := range []struct {
+		data   string
+		fields map[string]string
+		err    string
+	}{
+		{`{"id": "1", "port": "abc"}`, map[string]string{"port": "number"}, "'abc' is not a number"},
+		{`{"id": "1", "on": "maybe"}`, map[string]string{"on": "bool"}, "'maybe' is not a bool"},
+		{`{"id": "1", "on": 2}`, map[string]string{"on": "bool"}, "2 is not a bool"},
+		{`{"id": "1", "spec": {"a": 1}}`, map[string]string{"spec": "string"}, `{"a":1} cannot be converted to string`},
+		{`{"id": "1"}`, map[string]string{"port": "int"}, "unknown type 'int'"},
+	} {
+		_, err := NewAPIObject(client, &api_object_opt{path: "/api/objects", data: test.data, coerce_fields: test.fields, debug: api_object_debug})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("api_object_test.go: Expected an error with '%s' for %s with coerce_fields %v but got: %v", test.err, test.data, test.fields, err)
+		}
+	}
+}
+
+func TestAPIObjectNormalizeUnicode(t *testing.T) {
+	/* "cafe" with the accent as a combining character (NFD) */
+	nfd := "cafe\u0301"
+	for _, normalize := range []bool{false, true} {
+		client := NewAPIClient(&api_client_opt{
+			uri:               "http://127.0.0.1:8080/",
+			timeout:           2,
+			id_attribute:      "id",
+			normalize_unicode: normalize,
+			debug:             api_client_debug,
+		})
+		o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "1", data: `{ "name": "` + nfd + `", "tags": ["` + nfd + `"], "` + nfd + `": true }`, debug: api_object_debug})
+
+		want := map[string]interface{}{"name": nfd, "tags": []interface{}{nfd}, nfd: true}
+		if normalize {
+			want = map[string]interface{}{"name": "caf\u00e9", "tags": []interface{}{"caf\u00e9"}, "caf\u00e9": true}
+		}
+		var got map[string]interface{}
+		json.Unmarshal([]byte(o.request_body()), &got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("api_object_test.go: Expected the body %q with normalize_unicode=%t but got %q", want, normalize, got)
+		}
+	}
+
+	/* An API that keeps the text it was sent (normalized) is
+	   not reported as changing it */
+	client := NewAPIClient(&api_client_opt{
+		uri:               "http://127.0.0.1:8080/",
+		timeout:           2,
+		id_attribute:      "id",
+		normalize_unicode: true,
+		verify_create:     "error",
+		debug:             api_client_debug,
+	})
+	o, _ := NewAPIObject(client, &api_object_opt{path: "/api/things", id: "1", data: `{ "name": "` + nfd + `" }`, debug: api_object_debug})
+	sent := o.sent_data()
+	o.update_state(`{ "id": "1", "name": "caf\u00e9" }`)
+	if err := o.verify_created(sent); err != nil {
+		t.Fatalf("api_object_test.go: Expected no error when the API kept the normalized name but got: %s", err)
+	}
+}
+
+func TestAPIObjectPreserveFields(t *testing.T) {
+	client := NewAPIClient(&api_client_opt{
+		uri:          "http://127.0.0.1:8080/",
+		timeout:      2,
+		id_attribute: "id",
+		debug:        api_client_debug,
+	})
+	/* The server gave each rule an id, and stamped the object */
+	prior := `{"id": "1", "created_at": "2020-01-01", "spec": {"rules": [{"id": "r1", "port": 80}, {"id": "r2", "port": 443}], "owner": "ops"}, "secret": "<redacted>"}`
+	o, _ := NewAPIObject(client, &api_object_opt{
+		path:            "/api/things",
+		id:              "1",
+		data:            `{ "name": "web", "spec": { "rules": [{ "port": 8080 }] } }`,
+		preserve_fields: []string{"created_at", "/spec/rules", "secret", "missing"},
+		prior_response:  prior,
+		debug:           api_object_debug,
+	})
+
+	got := o.update_data()
+	want := map[string]interface{}{
+		"name":       "web",
+		"created_at": "2020-01-01",
+		"spec": map[string]interface{}{
+			"rules": []interface{}{map[string]interface{}{"id": "r1", "port": float64(8080)}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("api_object_test.go: Expected the update body %v but got %v", want, got)
+	}
+	if _, ok := o.data["created_at"]; ok {
+		t.Fatalf("api_object_test.go: Expected preserving fields not to change the object's data but got %v", o.data)
+	}
+}
@@ -0,0 +1,229 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* {token} and {response.<path>} in token_exchange steps */
+var token_param_regexp = regexp.MustCompile(`\{(token|response\.[^{}]+)\}`)
+
+/* Return the current token and its generation, fetching a
+   token if one has not been obtained yet or the current one
+   is within token_refresh_skew seconds of expiring */
+func (client *api_client) get_token() (string, int, error) {
+	client.token_mutex.Lock()
+	token, generation, expiry := client.token, client.token_generation, client.token_expiry
+	client.token_mutex.Unlock()
+
+	/* Refresh a little before the token actually expires so
+	   requests in flight at the boundary do not fail */
+	expiring := !expiry.IsZero() && time.Now().Add(time.Duration(client.token_refresh_skew)*time.Second).After(expiry)
+	if expiring && client.debug {
+		log.Printf("api_token.go: Token expires at %s - refreshing early\n", expiry)
+	}
+
+	if token == "" || expiring {
+		if err := client.refresh_token(generation); err != nil {
+			return "", 0, err
+		}
+		client.token_mutex.Lock()
+		token, generation = client.token, client.token_generation
+		client.token_mutex.Unlock()
+	}
+	return token, generation, nil
+}
+
+/* Replace the token of the given generation with a new one.
+   The lock is held while the token endpoint is called, so when
+   many requests see the same stale token at once only the first
+   one fetches a token. The rest wait and find the generation has
+   already moved on, so they reuse the new token */
+func (client *api_client) refresh_token(stale_generation int) error {
+	client.token_mutex.Lock()
+	defer client.token_mutex.Unlock()
+
+	if client.token_generation != stale_generation && client.token != "" {
+		if client.debug {
+			log.Printf("api_token.go: Token already refreshed (generation %d) - reusing it\n", client.token_generation)
+		}
+		return nil
+	}
+
+	token, expires_in, err := client.fetch_token()
+	if err != nil {
+		return err
+	}
+
+	client.token = token
+	client.token_generation++
+	client.token_expiry = time.Time{}
+	if expires_in > 0 {
+		client.token_expiry = time.Now().Add(time.Duration(expires_in) * time.Second)
+	}
+	if client.debug {
+		log.Printf("api_token.go: Obtained new token (generation %d)\n", client.token_generation)
+	}
+	return nil
+}
+
+/* One request in getting a token. The first is to token_url
+   with token_request_body, and any token_exchange steps follow.
+   The {token} placeholder in the body and headers of a step is
+   the token from the step before, and {response.<path>} is the
+   value at path in the response to the step before */
+type token_step struct {
+	url             string
+	method          string
+	body            string
+	headers         map[string]string
+	response_path   string
+	expires_in_path string
+}
+
+/* Get a token by running token_url and then each token_exchange
+   step, returning the last step's token along with how many
+   seconds it is valid for (0 if unknown). This deliberately does
+   not use send_request since it must not be authenticated with
+   the token it is fetching */
+func (client *api_client) fetch_token() (string, float64, error) {
+	steps := append([]token_step{{
+		url:             client.token_url,
+		method:          "POST",
+		body:            client.token_request_body,
+		response_path:   client.token_response_path,
+		expires_in_path: client.token_expires_in_path,
+	}}, client.token_exchange...)
+
+	token := ""
+	expires_in := float64(0)
+	var parsed interface{}
+	for i, step := range steps {
+		var err error
+		token, expires_in, parsed, err = client.fetch_token_step(step, token, parsed)
+		if err != nil {
+			if len(steps) > 1 {
+				return "", 0, errors.New(fmt.Sprintf("Step %d of %d getting a token (%s): %s", i+1, len(steps), step.url, err))
+			}
+			return "", 0, err
+		}
+	}
+	return token, expires_in, nil
+}
+
+/* Send one step's request, with placeholders filled from the
+   step before, and take the token from its response */
+func (client *api_client) fetch_token_step(step token_step, prev_token string, prev_response interface{}) (string, float64, interface{}, error) {
+	body, err := fill_token_template(step.body, prev_token, prev_response, true)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	method := step.method
+	if method == "" {
+		method = "POST"
+	}
+	var req *http.Request
+	if body == "" {
+		req, err = http.NewRequest(method, step.url, nil)
+	} else {
+		req, err = http.NewRequest(method, step.url, bytes.NewReader([]byte(body)))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	for name, template := range step.headers {
+		value, err := fill_token_template(template, prev_token, prev_response, false)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		req.Header.Set(name, value)
+	}
+
+	if client.debug {
+		log.Printf("api_token.go: Requesting token from %s\n", step.url)
+	}
+
+	resp, err := client.token_client.Do(req)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", 0, nil, errors.New(fmt.Sprintf("Unexpected response code '%d' from token endpoint: %s", resp.StatusCode, string(resp_body)))
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal(resp_body, &parsed); err != nil {
+		return "", 0, nil, errors.New(fmt.Sprintf("Unable to parse token endpoint response as JSON: %s", err))
+	}
+
+	response_path := step.response_path
+	if response_path == "" {
+		response_path = "access_token"
+	}
+	token, ok := get_path(parsed, response_path)
+	if !ok || token == nil || id_string(token) == "" {
+		return "", 0, nil, errors.New(fmt.Sprintf("Token endpoint response does not contain a token at '%s'", response_path))
+	}
+	/* How many seconds the token is good for, if the endpoint says */
+	expires_in := float64(0)
+	if step.expires_in_path != "" {
+		if val, ok := get_path(parsed, step.expires_in_path); ok {
+			switch v := val.(type) {
+			case float64:
+				expires_in = v
+			case string:
+				expires_in, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return id_string(token), expires_in, parsed, nil
+}
+
+/* Fill {token} and {response.<path>} in a token step's body or
+   header. Anything else in braces is left alone, since bodies
+   are usually JSON. In a body (escape), values are JSON escaped
+   as fill_body_template does, so a quote or backslash in them
+   cannot break the JSON. Headers get them as they are */
+func fill_token_template(template string, token string, response interface{}, escape bool) (string, error) {
+	var missing []string
+	filled := token_param_regexp.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		if name == "token" {
+			if escape {
+				return json_escape(token)
+			}
+			return token
+		}
+		if val, ok := get_path(response, strings.TrimPrefix(name, "response.")); ok && val != nil {
+			if escape {
+				return json_escape(val)
+			}
+			return id_string(val)
+		}
+		missing = append(missing, match)
+		return match
+	})
+	if len(missing) > 0 {
+		return "", errors.New(fmt.Sprintf("The response to the step before has nothing for %s", strings.Join(missing, ", ")))
+	}
+	return filled, nil
+}
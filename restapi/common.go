@@ -0,0 +1,666 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v2"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* Matches JSON "key": value pairs whose key looks like it holds a secret */
+var secret_field_regexp = regexp.MustCompile(`("[^"]*(?i:password|secret|token|api_?key|credential)[^"]*"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+
+/* Mask the values of secret looking fields so a response
+   body can be logged. The body need not be valid JSON */
+func redact_body(body string) string {
+	return secret_field_regexp.ReplaceAllString(body, `$1"`+redacted+`"`)
+}
+
+/* Walk a dotted path such as "data.items.0.id" through
+   decoded JSON. Numeric segments index into arrays. A path
+   starting with / is a JSON Pointer (RFC 6901) instead, such
+   as "/data/items/0/id", which can also reach keys with dots
+   in them. The second return value is false if any segment
+   is missing */
+func get_path(data interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return data, true
+	}
+	return walk_segments(data, path_segments(path))
+}
+
+func walk_segments(data interface{}, parts []string) (interface{}, bool) {
+	current := data
+	for _, part := range parts {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			val, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			current = val
+		case *ordered_map:
+			val, ok := v.values[part]
+			if !ok {
+				return nil, false
+			}
+			current = val
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func is_json_pointer(path string) bool {
+	return strings.HasPrefix(path, "/")
+}
+
+/* The keys along a dotted path or JSON Pointer. In a pointer,
+   ~1 stands for / and ~0 for ~ */
+func path_segments(path string) []string {
+	if !is_json_pointer(path) {
+		return strings.Split(path, ".")
+	}
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+	}
+	return parts
+}
+
+/* Look up a key such as id_attribute or one of copy_keys in
+   an object. A JSON Pointer reaches into nested objects and
+   arrays, while anything else is a key at the top level, even
+   if it has dots in it */
+func get_key(data interface{}, key string) (interface{}, bool) {
+	if is_json_pointer(key) {
+		return get_path(data, key)
+	}
+	switch v := data.(type) {
+	case map[string]interface{}:
+		val, ok := v[key]
+		return val, ok
+	case *ordered_map:
+		val, ok := v.values[key]
+		return val, ok
+	}
+	return nil, false
+}
+
+/* Set a key in an object the way get_key finds it. Objects
+   missing along a JSON Pointer are added, but arrays are only
+   indexed into. Returns false if the key cannot be set */
+func set_key(data map[string]interface{}, key string, value interface{}) bool {
+	if !is_json_pointer(key) {
+		data[key] = value
+		return true
+	}
+
+	parts := path_segments(key)
+	var current interface{} = data
+	for n, part := range parts {
+		last := n == len(parts)-1
+		switch v := current.(type) {
+		case map[string]interface{}:
+			if last {
+				v[part] = value
+				return true
+			}
+			if _, ok := v[part].(map[string]interface{}); !ok {
+				if _, ok := v[part].([]interface{}); !ok {
+					v[part] = make(map[string]interface{})
+				}
+			}
+			current = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return false
+			}
+			if last {
+				v[i] = value
+				return true
+			}
+			current = v[i]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+/* The JSON Pointer to what a dotted path (or pointer) finds,
+   so set_key can reach it */
+func json_pointer(path string) string {
+	if is_json_pointer(path) {
+		return path
+	}
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		parts[i] = strings.Replace(strings.Replace(part, "~", "~0", -1), "/", "~1", -1)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+/* Remove a key from an object the way get_key finds it.
+   Elements of arrays are not removed */
+func delete_key(data map[string]interface{}, key string) {
+	if !is_json_pointer(key) {
+		delete(data, key)
+		return
+	}
+	parts := path_segments(key)
+	parent, _ := walk_segments(data, parts[:len(parts)-1])
+	if m, ok := parent.(map[string]interface{}); ok {
+		delete(m, parts[len(parts)-1])
+	}
+}
+
+/* Convert a YAML document to JSON so the rest of the provider
+   only ever has to deal with JSON */
+func yaml_to_json(in string) (string, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(in), &parsed); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(yaml_to_json_value(parsed))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/* YAML maps may have keys of any type but JSON objects
+   need string keys */
+func yaml_to_json_value(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for key, val := range v {
+			out[fmt.Sprintf("%v", key)] = yaml_to_json_value(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = yaml_to_json_value(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+/* Go's decoder quietly keeps the last of any repeated key in
+   an object. Find the first key that is repeated, as a dotted
+   path. Anything that is not valid JSON has no duplicates */
+func find_duplicate_key(in string) (string, bool) {
+	dec := json.NewDecoder(strings.NewReader(in))
+	return duplicate_key_in_value(dec, "")
+}
+
+func duplicate_key_in_value(dec *json.Decoder, prefix string) (string, bool) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", false
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return "", false
+	}
+
+	switch delim {
+	case '{':
+		seen := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return "", false
+			}
+			key := fmt.Sprintf("%v", tok)
+			if seen[key] {
+				return prefix + key, true
+			}
+			seen[key] = true
+			if path, found := duplicate_key_in_value(dec, prefix+key+"."); found {
+				return path, true
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			if path, found := duplicate_key_in_value(dec, fmt.Sprintf("%s%d.", prefix, i)); found {
+				return path, true
+			}
+		}
+	}
+	/* The closing delimiter */
+	dec.Token()
+	return "", false
+}
+
+/* The string form of an id taken from decoded JSON. A
+   json.Number keeps the digits the API sent, and whole
+   floats are written out in full rather than as 1.23e+08 */
+func id_string(val interface{}) string {
+	switch v := val.(type) {
+	case json.Number:
+		return v.String()
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+/* A value as it goes into a JSON template: a string is escaped
+   to go between quotes, anything else is encoded as JSON */
+func json_escape(val interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return id_string(val)
+	}
+	out := strings.TrimSuffix(buf.String(), "\n")
+	if _, ok := val.(string); ok {
+		out = out[1 : len(out)-1]
+	}
+	return out
+}
+
+/* Decode a JSON object with numbers as json.Number, so ids
+   too large for a float64 (above 2^53) come through intact */
+func decode_numbers(in string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(in))
+	dec.UseNumber()
+	data := make(map[string]interface{})
+	err := dec.Decode(&data)
+	return data, err
+}
+
+/* Re-encode JSON compactly with sorted keys and without
+   escaping <, > and &, so the bytes that are signed are the
+   same bytes a canonicalizing server computes. Numbers are
+   kept exactly as written */
+func canonical_json(in string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(in))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+/* A copy of value without any null fields in its objects,
+   however deeply nested. Nulls in arrays hold a position,
+   so they are kept */
+func strip_nulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		stripped := make(map[string]interface{})
+		for key, val := range v {
+			if val != nil {
+				stripped[key] = strip_nulls(val)
+			}
+		}
+		return stripped
+	case []interface{}:
+		stripped := make([]interface{}, len(v))
+		for i, val := range v {
+			stripped[i] = strip_nulls(val)
+		}
+		return stripped
+	}
+	return value
+}
+
+/* A copy of value with every string in it, keys included,
+   in Unicode Normalization Form C, so that "é" is always the
+   one character U+00E9 rather than e and a combining accent */
+func normalize_nfc(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return norm.NFC.String(v)
+	case map[string]interface{}:
+		normalized := make(map[string]interface{})
+		for key, val := range v {
+			normalized[norm.NFC.String(key)] = normalize_nfc(val)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, val := range v {
+			normalized[i] = normalize_nfc(val)
+		}
+		return normalized
+	}
+	return value
+}
+
+/* A copy of value with the field at path (a dotted path or
+   JSON Pointer, as get_path finds it) converted to string,
+   number or bool. A missing or null field is left as it is */
+func coerce_field(value interface{}, path string, to string) (interface{}, error) {
+	return coerce_segments(value, path_segments(path), to)
+}
+
+func coerce_segments(value interface{}, parts []string, to string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		val, ok := v[parts[0]]
+		if !ok {
+			return value, nil
+		}
+		var err error
+		if len(parts) > 1 {
+			val, err = coerce_segments(val, parts[1:], to)
+		} else {
+			val, err = coerce_value(val, to)
+		}
+		if err != nil {
+			return value, err
+		}
+		copied := make(map[string]interface{}, len(v))
+		for key, x := range v {
+			copied[key] = x
+		}
+		copied[parts[0]] = val
+		return copied, nil
+	case []interface{}:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return value, nil
+		}
+		var val interface{}
+		if len(parts) > 1 {
+			val, err = coerce_segments(v[i], parts[1:], to)
+		} else {
+			val, err = coerce_value(v[i], to)
+		}
+		if err != nil {
+			return value, err
+		}
+		copied := make([]interface{}, len(v))
+		copy(copied, v)
+		copied[i] = val
+		return copied, nil
+	}
+	return value, nil
+}
+
+/* Convert a decoded JSON value to string, number or bool.
+   Numbers are written without an exponent, so 8080 becomes
+   "8080", and bools also convert to and from 1 and 0 */
+func coerce_value(val interface{}, to string) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch to {
+	case "string":
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case json.Number:
+			return v.String(), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	case "number":
+		switch v := val.(type) {
+		case float64:
+			return v, nil
+		case json.Number:
+			return v.Float64()
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("'%s' is not a number", v))
+			}
+			return n, nil
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+	case "bool":
+		switch v := val.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("'%s' is not a bool", v))
+			}
+			return b, nil
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, nil
+			}
+			return nil, errors.New(fmt.Sprintf("%v is not a bool", v))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown type '%s'. Must be one of string, number or bool", to))
+	}
+	b, _ := json.Marshal(val)
+	return nil, errors.New(fmt.Sprintf("%s cannot be converted to %s", b, to))
+}
+
+/* Whether the decoded JSON value got has everything in sent.
+   Objects in got may have fields that sent does not, but
+   arrays must be the same length */
+func json_subset(sent interface{}, got interface{}) bool {
+	switch s := sent.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, val := range s {
+			if !json_subset(val, g[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(s) {
+			return false
+		}
+		for i := range s {
+			if !json_subset(s[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(sent, got)
+}
+
+/* A JSON object that remembers the order of its keys, so it
+   is encoded again in the order the API sent it */
+type ordered_map struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *ordered_map) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+/* Decode JSON like json.Unmarshal does into an interface{},
+   except that objects are *ordered_map rather than maps */
+func decode_ordered(in string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(in))
+	value, err := decode_ordered_value(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return value, nil
+}
+
+func decode_ordered_value(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		m := &ordered_map{values: make(map[string]interface{})}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			val, err := decode_ordered_value(dec)
+			if err != nil {
+				return nil, err
+			}
+			/* Like json.Unmarshal, the last of a repeated key wins */
+			if _, seen := m.values[key]; !seen {
+				m.keys = append(m.keys, key)
+			}
+			m.values[key] = val
+		}
+		_, err = dec.Token()
+		return m, err
+	case json.Delim('['):
+		list := make([]interface{}, 0)
+		for dec.More() {
+			val, err := decode_ordered_value(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+/* A copy of value with any *ordered_map turned back into a
+   plain map, for code that only understands those */
+func plain_value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *ordered_map:
+		plain := make(map[string]interface{})
+		for key, val := range v.values {
+			plain[key] = plain_value(val)
+		}
+		return plain
+	case []interface{}:
+		plain := make([]interface{}, len(v))
+		for i, val := range v {
+			plain[i] = plain_value(val)
+		}
+		return plain
+	}
+	return value
+}
+
+/* What sensitive values are replaced with */
+const redacted = "<redacted>"
+
+/* A copy of the decoded JSON value with the value at each
+   dotted path or JSON Pointer (as for get_path) replaced by
+   "<redacted>".
+   Paths that are not there are skipped. Only what leads to a
+   masked value is copied. The second return value says whether
+   anything was masked */
+func mask_paths(value interface{}, paths []string) (interface{}, bool) {
+	masked := false
+	for _, path := range paths {
+		var changed bool
+		value, changed = mask_path(value, path_segments(path))
+		masked = masked || changed
+	}
+	return value, masked
+}
+
+func mask_path(value interface{}, parts []string) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		val, ok := v[parts[0]]
+		if !ok {
+			return value, false
+		}
+		if len(parts) > 1 {
+			if val, ok = mask_path(val, parts[1:]); !ok {
+				return value, false
+			}
+		} else {
+			val = redacted
+		}
+		copied := make(map[string]interface{}, len(v))
+		for key, x := range v {
+			copied[key] = x
+		}
+		copied[parts[0]] = val
+		return copied, true
+	case []interface{}:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return value, false
+		}
+		val := interface{}(redacted)
+		if len(parts) > 1 {
+			var ok bool
+			if val, ok = mask_path(v[i], parts[1:]); !ok {
+				return value, false
+			}
+		}
+		copied := make([]interface{}, len(v))
+		copy(copied, v)
+		copied[i] = val
+		return copied, true
+	}
+	return value, false
+}
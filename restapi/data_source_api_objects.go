@@ -0,0 +1,139 @@
+package restapi
+
+import (
+  "github.com/hashicorp/terraform/helper/schema"
+  "encoding/json"
+  "log"
+  "net/url"
+)
+
+func dataSourceRestApiObjects() *schema.Resource {
+  return &schema.Resource{
+    Read: dataSourceRestApiObjectsRead,
+
+    Schema: map[string]*schema.Schema{
+      "path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The API path on top of the base URL set in the provider that returns the collection of objects.",
+        Required:    true,
+      },
+      "results_key": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to the array of objects in the response (for example 'data.items'). If not set, the provider's list_unwrap_path is used, and without that the response itself must be the array.",
+        Optional:    true,
+      },
+      "filter": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "A JMESPath expression applied to the list of objects read from the API, such as '[?enabled]' to filter or '[*].{id: id, name: name}' to reshape them.",
+        Optional:    true,
+      },
+      "query_param": &schema.Schema{
+        Type:        schema.TypeList,
+        Description: "A query parameter to send, with one or more values. More than one value is sent as the provider's query_array_style says.",
+        Optional:    true,
+        Elem: &schema.Resource{
+          Schema: map[string]*schema.Schema{
+            "name": &schema.Schema{
+              Type:        schema.TypeString,
+              Description: "The name of the query parameter.",
+              Required:    true,
+            },
+            "values": &schema.Schema{
+              Type:        schema.TypeList,
+              Elem:        &schema.Schema{ Type: schema.TypeString },
+              Description: "The values of the query parameter.",
+              Required:    true,
+            },
+          },
+        },
+      },
+      "page_param": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The query parameter for the page number (starting at 1). When set, pages are read until one has fewer objects than the page size.",
+        Optional:    true,
+      },
+      "page_size_param": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The query parameter for the number of objects per page.",
+        Optional:    true,
+      },
+      "page_size": &schema.Schema{
+        Type:        schema.TypeInt,
+        Description: "The number of objects per page to ask for with page_size_param. Large pages mean fewer requests.",
+        Optional:    true,
+      },
+      "page_size_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to the page size the server actually used in each response, for servers that cap page_size.",
+        Optional:    true,
+      },
+      "debug": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "Whether to emit verbose debug output while reading the objects.",
+        Optional:    true,
+      },
+      "objects": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The objects read from the API (after any filter is applied), each as a JSON string.",
+        Computed:    true,
+      },
+      "ids": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The id_attribute value of each object that has one, in the same order as objects.",
+        Computed:    true,
+      },
+    }, /* End schema */
+  }
+}
+
+func dataSourceRestApiObjectsRead(d *schema.ResourceData, meta interface{}) error {
+  client := meta.(*api_client)
+  path, err := client.fill_path_variables(d.Get("path").(string), "path")
+  if err != nil { return err }
+  filter := d.Get("filter").(string)
+
+  query := url.Values{}
+  for _, p := range d.Get("query_param").([]interface{}) {
+    param := p.(map[string]interface{})
+    for _, v := range param["values"].([]interface{}) {
+      query.Add(param["name"].(string), v.(string))
+    }
+  }
+  path = client.add_query(path, query)
+  log.Printf("data_source_api_objects.go: Read routine called for path '%s'\n", path)
+
+  paging := &list_paging{
+    page_param:      d.Get("page_param").(string),
+    page_size_param: d.Get("page_size_param").(string),
+    page_size:       d.Get("page_size").(int),
+    page_size_path:  d.Get("page_size_path").(string),
+    cached:          true,
+  }
+
+  list, err := client.list_objects(path, d.Get("results_key").(string), paging)
+  if err != nil { return err }
+
+  if filter != "" {
+    list, err = filter_objects(list, filter)
+    if err != nil { return err }
+    if d.Get("debug").(bool) { log.Printf("data_source_api_objects.go: %d objects left after filter '%s'\n", len(list), filter) }
+  }
+
+  objects := make([]string, 0)
+  ids := make([]string, 0)
+  for _, item := range list {
+    b, _ := json.Marshal(item)
+    objects = append(objects, client.mask_body(string(b)))
+
+    if val, ok := get_key(item, client.id_attribute); ok && val != nil {
+      ids = append(ids, id_string(val))
+    }
+  }
+
+  d.SetId(path)
+  d.Set("objects", objects)
+  d.Set("ids", ids)
+  return nil
+}
@@ -0,0 +1,70 @@
+package restapi
+
+import (
+  "github.com/hashicorp/terraform/helper/schema"
+  "log"
+  "strings"
+)
+
+func dataSourceRestApiObjectsById() *schema.Resource {
+  return &schema.Resource{
+    Read: dataSourceRestApiObjectsByIdRead,
+
+    Schema: map[string]*schema.Schema{
+      "path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The API path on top of the base URL set in the provider for objects of this type. Each object is read from this path with {id} replaced by its id, or with /<id> appended if there is no {id}.",
+        Required:    true,
+      },
+      "ids": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The ids of the objects to read.",
+        Required:    true,
+      },
+      "parallelism": &schema.Schema{
+        Type:        schema.TypeInt,
+        Description: "How many objects to read at the same time. Default is 5.",
+        Optional:    true,
+        Default:     5,
+      },
+      "debug": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "Whether to emit verbose debug output while reading the objects.",
+        Optional:    true,
+      },
+      "objects": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The objects read from the API, keyed by id, each as a JSON string.",
+        Computed:    true,
+      },
+    }, /* End schema */
+  }
+}
+
+func dataSourceRestApiObjectsByIdRead(d *schema.ResourceData, meta interface{}) error {
+  client := meta.(*api_client)
+  path, err := client.fill_path_variables(d.Get("path").(string), "path")
+  if err != nil { return err }
+  log.Printf("data_source_api_objects_by_id.go: Read routine called for path '%s'\n", path)
+
+  ids := make([]string, 0)
+  for _, v := range d.Get("ids").([]interface{}) {
+    ids = append(ids, v.(string))
+  }
+
+  /* Reading an object that does not exist is an error, so a
+     missing object is never silently left out of the map */
+  objects, err := client.read_objects(path, ids, d.Get("parallelism").(int))
+  if err != nil { return err }
+  if d.Get("debug").(bool) { log.Printf("data_source_api_objects_by_id.go: Read %d objects\n", len(objects)) }
+
+  for id, object := range objects {
+    objects[id] = client.mask_body(object)
+  }
+
+  d.SetId(path + ":" + strings.Join(ids, ","))
+  d.Set("objects", objects)
+  return nil
+}
@@ -0,0 +1,89 @@
+package restapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/* A line is logged if its level is at or above the level
+   configured, so error is the quietest */
+var log_levels = map[string]int{"error": 0, "warn": 1, "info": 2, "debug": 3}
+
+/* Matches header lines logged with debug that carry secrets */
+var secret_header_regexp = regexp.MustCompile(`(?i)((?:authorization|proxy-authorization|cookie|set-cookie|x-api-key|x-amz-security-token): ).*`)
+
+/* Sits between the log package and where the logs go,
+   dropping lines below the level and masking secrets */
+type log_writer struct {
+	level int
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+func (w *log_writer) Write(p []byte) (int, error) {
+	line := string(p)
+	if line_log_level(line) > w.level {
+		return len(p), nil
+	}
+
+	line = secret_header_regexp.ReplaceAllString(redact_body(line), "${1}<redacted>")
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := io.WriteString(w.out, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* The provider's messages do not carry a level, other than
+   the ones that say ERROR or WARNING. Everything else is
+   debug output unless it is tagged like [INFO] */
+func line_log_level(line string) int {
+	switch {
+	case strings.Contains(line, "ERROR"):
+		return log_levels["error"]
+	case strings.Contains(line, "WARN"):
+		return log_levels["warn"]
+	case strings.Contains(line, "[INFO]"):
+		return log_levels["info"]
+	}
+	return log_levels["debug"]
+}
+
+/* Send the provider's logs to destination (a file path,
+   "syslog" or "stderr") at the given level. With neither
+   set, logging is left as it is */
+func configure_logging(destination string, level string) error {
+	if destination == "" && level == "" {
+		return nil
+	}
+	if level == "" {
+		level = "debug"
+	}
+	if _, ok := log_levels[level]; !ok {
+		return errors.New(fmt.Sprintf("Invalid log_level '%s'. Must be one of error, warn, info or debug", level))
+	}
+
+	var out io.Writer = os.Stderr
+	var err error
+	switch destination {
+	case "", "stderr":
+	case "syslog":
+		out, err = syslog_writer()
+	default:
+		/* Appending lets the file be rotated with copytruncate */
+		out, err = os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to send logs to '%s': %s", destination, err))
+	}
+
+	log.SetOutput(&log_writer{level: log_levels[level], out: out})
+	return nil
+}
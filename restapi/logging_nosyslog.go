@@ -0,0 +1,12 @@
+// +build windows plan9
+
+package restapi
+
+import (
+	"errors"
+	"io"
+)
+
+func syslog_writer() (io.Writer, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,12 @@
+// +build !windows,!plan9
+
+package restapi
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func syslog_writer() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "terraform-provider-restapi")
+}
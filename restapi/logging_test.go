@@ -0,0 +1,43 @@
+package restapi
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	f, err := ioutil.TempFile("", "restapi-log")
+	if err != nil {
+		t.Fatalf("logging_test.go: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	defer log.SetOutput(os.Stderr)
+
+	if err := configure_logging(f.Name(), "warn"); err != nil {
+		t.Fatalf("logging_test.go: Failed to configure logging: %s", err)
+	}
+	log.Printf("api_client.go: Sending HTTP request to /things...\n")
+	log.Printf("api_client.go:   Authorization: Bearer hunter2")
+	log.Printf("WARNING: Attempting to delete an object that has no id set. Assuming this is OK.\n")
+	log.Printf("[ERROR] failed with BODY: {\"password\": \"hunter2\"}\n")
+
+	b, _ := ioutil.ReadFile(f.Name())
+	logged := string(b)
+	if strings.Contains(logged, "Sending HTTP request") || strings.Contains(logged, "Authorization") {
+		t.Fatalf("logging_test.go: Expected debug messages to be left out but got: %s", logged)
+	}
+	if !strings.Contains(logged, "WARNING: Attempting") || !strings.Contains(logged, `"password": "<redacted>"`) {
+		t.Fatalf("logging_test.go: Expected the warning and the redacted error but got: %s", logged)
+	}
+	if strings.Contains(logged, "hunter2") {
+		t.Fatalf("logging_test.go: Expected secrets to be masked but got: %s", logged)
+	}
+
+	if err := configure_logging("", "loud"); err == nil {
+		t.Fatalf("logging_test.go: Expected an error for an invalid log level")
+	}
+}
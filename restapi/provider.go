@@ -1,8 +1,13 @@
 package restapi
 
 import (
+ "errors"
+ "fmt"
+ "strings"
  "github.com/hashicorp/terraform/helper/schema"
+ "github.com/hashicorp/terraform/helper/validation"
  "github.com/hashicorp/terraform/terraform"
+ "github.com/jmespath/go-jmespath"
 )
 
 func Provider() terraform.ResourceProvider {
@@ -14,6 +19,12 @@ func Provider() terraform.ResourceProvider {
         DefaultFunc: schema.EnvDefaultFunc("REST_API_URI", nil),
         Description: "URI of the REST API endpoint. This serves as the base of all requests.",
       },
+      "path_variables": &schema.Schema{
+        Type: schema.TypeMap,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "Values for {name} placeholders in the paths of every resource and data source, such as { account = \"acme\" } for paths like /accounts/{account}/widgets. This keeps tenant scoping in one place.",
+      },
       "insecure": &schema.Schema{
         Type: schema.TypeBool,
         Optional: true,
@@ -38,24 +49,384 @@ func Provider() terraform.ResourceProvider {
         DefaultFunc: schema.EnvDefaultFunc("REST_API_AUTH_HEADER", nil),
         Description: "If the API does not support BASIC authentication, you can set the Authorization header contents to be sent in all requests. This is useful if you want to use a script via the 'external' provider or provide a pre-approved token. This takes precedence over BASIC auth credentials.",
       },
+      "auth_hosts": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "The hosts that credentials (the Authorization header or an AWS signature) may be sent to, including on redirects. Requests to any other host are sent without them. Defaults to the host of `uri`.",
+      },
+      "max_redirects": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_MAX_REDIRECTS", 10),
+        Description: "The most redirects a request follows before it fails. On each redirect, credentials are removed and, if the new host is in auth_hosts, added again (and the request signed again) for the new URL. Default is 10.",
+      },
+      "redirect_body_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_REDIRECT_BODY_PATH", nil),
+        Description: "For APIs that answer with a success (such as 200) and a body like {\"redirect\": \"/new/location\"} instead of a 3xx: the dotted path to that location in the body. When a response has it, the request is sent again to there, up to max_redirects times.",
+      },
+      "strip_xssi_prefix": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_STRIP_XSSI_PREFIX", nil),
+        Description: "When set, the )]}' prefix some APIs put before JSON to protect against XSSI is removed from responses before they are parsed.",
+      },
+      "response_strip_prefix": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_STRIP_PREFIX", ""),
+        Description: "Text removed from the start of responses before they are parsed.",
+      },
+      "response_strip_suffix": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_STRIP_SUFFIX", ""),
+        Description: "Text removed from the end of responses (ignoring trailing newlines) before they are parsed.",
+      },
+      "response_signature_header": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_SIGNATURE_HEADER", nil),
+        Description: "For APIs that sign their responses, the response header holding the signature. When set, the signature of every successful response body is verified before it is used, and requests fail if it does not match.",
+      },
+      "response_signature_algorithm": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_SIGNATURE_ALGORITHM", "hmac-sha256"),
+        ValidateFunc: validation.StringInSlice([]string{"hmac-sha1", "hmac-sha256", "hmac-sha512"}, false),
+        Description: "The algorithm used to sign responses. One of hmac-sha1, hmac-sha256 or hmac-sha512. Default is hmac-sha256.",
+      },
+      "response_signature_secret": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        Sensitive: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_SIGNATURE_SECRET", nil),
+        Description: "The shared secret used to verify response signatures.",
+      },
+      "body_encoding": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_BODY_ENCODING", "json"),
+        ValidateFunc: validation.StringInSlice([]string{"json", "yaml"}, false),
+        Description: "How objects are encoded in requests and responses. Either json or yaml. With yaml, request bodies are sent with a Content-Type of application/yaml and responses are parsed as YAML. Default is json.",
+      },
+      "canonical_json": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_CANONICAL_JSON", nil),
+        Description: "When set, JSON request bodies are sent (and signed) in a canonical form: compact, with sorted keys and without HTML escaping.",
+      },
+      "preserve_key_order": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PRESERVE_KEY_ORDER", nil),
+        Description: "When set, parts of a response that are kept as JSON (the data of an envelope, the object picked from a create response and the objects of restapi_objects) keep the order of keys the API sent, rather than being sorted.",
+      },
+      "minimal_headers": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_MINIMAL_HEADERS", nil),
+        Description: "When set, the provider does not add any default headers of its own (Content-Type, User-Agent, Accept-Encoding, or an empty x-drench-account). Only the headers needed for the configured authentication are sent. This is for strict APIs that reject headers they did not expect.",
+      },
+      "null_fields": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_NULL_FIELDS", "send"),
+        ValidateFunc: validation.StringInSlice([]string{"send", "strip"}, false),
+        Description: "What to do with fields of an object's data that are null: send sends them as explicit nulls and strip leaves them out of the request body. Default is send.",
+      },
+      "normalize_unicode": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_NORMALIZE_UNICODE", nil),
+        Description: "When set, every string in the body of a create or update (object keys included) is normalized to Unicode NFC before it is serialized and signed.",
+      },
+      "body_form_field": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_BODY_FORM_FIELD", nil),
+        Description: "For legacy APIs that expect the JSON object percent-encoded inside a form field, the name of that field. When set, request bodies are sent as 'FIELD=<percent-encoded JSON>' with a Content-Type of application/x-www-form-urlencoded.",
+      },
+      "aws_sign": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_AWS_SIGN", true),
+        Description: "Sign all requests for AWS API Gateway using AWS credentials (by default, the shared credentials; see aws_credential_chain). The signature replaces any other Authorization header, so disable this to use authorization_header, token_url or BASIC auth. Default is true.",
+      },
+      "aws_region": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_AWS_REGION", "us-east-1"),
+        Description: "The AWS region requests are signed for when aws_sign is enabled. Default is us-east-1.",
+      },
+      "aws_region_from_host": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_AWS_REGION_FROM_HOST", nil),
+        Description: "When set, requests are signed for the region named in the host of the uri (such as eu-west-1 in abc123.execute-api.eu-west-1.amazonaws.com). Hosts that do not name a region use aws_region.",
+      },
+      "aws_credential_chain": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{
+          Type: schema.TypeString,
+          ValidateFunc: validation.StringInSlice(aws_credential_sources, false),
+        },
+        Optional: true,
+        Description: "Where to look for the AWS credentials requests are signed with, in order: env (the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables), shared (the shared credentials file) and ec2_role (the instance's IAM role). The first with credentials is used. Default is [\"shared\"].",
+      },
+      "aws_profile": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_AWS_PROFILE", nil),
+        Description: "The profile in the shared credentials file to sign with. Defaults to the AWS_PROFILE environment variable, then the default profile.",
+      },
+      "token_url": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_URL", nil),
+        Description: "When set, a token is requested by sending a POST to this URL and is sent in the Authorization header of all requests. If the API responds with a 401, a new token is requested once and the request is retried. This takes precedence over authorization_header and BASIC auth credentials. Requires aws_sign to be disabled.",
+      },
+      "token_request_body": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        Sensitive: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_REQUEST_BODY", nil),
+        Description: "JSON data to send in the POST to token_url, such as client credentials.",
+      },
+      "token_response_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_RESPONSE_PATH", "access_token"),
+        Description: "The dotted path to the token in the response from token_url. Default is 'access_token'.",
+      },
+      "token_expires_in_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_EXPIRES_IN_PATH", "expires_in"),
+        Description: "The dotted path to the number of seconds the token is valid for in the response from token_url. Default is 'expires_in'.",
+      },
+      "token_refresh_skew": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_REFRESH_SKEW", 60),
+        Description: "When the token endpoint says how long a token is valid for, a new token is requested this many seconds before the current one expires rather than waiting for a 401. Default is 60.",
+      },
+      "token_header_prefix": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TOKEN_HEADER_PREFIX", "Bearer "),
+        Description: "The text placed before the token in the Authorization header. Default is 'Bearer '.",
+      },
+      "token_exchange": &schema.Schema{
+        Type: schema.TypeList,
+        Optional: true,
+        Description: "Further requests for APIs that exchange the token from token_url for one of their own. They are sent in order, and the token from the last one is used. {token} and {response.<path>} in a step's body and headers are the token from, and a value in the response to, the step before. They are JSON escaped in the body, and put in headers as they are.",
+        Elem: &schema.Resource{
+          Schema: map[string]*schema.Schema{
+            "url": &schema.Schema{
+              Type: schema.TypeString,
+              Required: true,
+              Description: "The URL to send this step's request to.",
+            },
+            "method": &schema.Schema{
+              Type: schema.TypeString,
+              Optional: true,
+              Default: "POST",
+              Description: "The method of this step's request. Default is POST.",
+            },
+            "body": &schema.Schema{
+              Type: schema.TypeString,
+              Optional: true,
+              Sensitive: true,
+              Description: "The body of this step's request. It is sent as JSON unless headers set a Content-Type.",
+            },
+            "headers": &schema.Schema{
+              Type: schema.TypeMap,
+              Elem: &schema.Schema{Type: schema.TypeString},
+              Optional: true,
+              Description: "Headers to send with this step's request, such as { Authorization = \"Bearer {token}\" }.",
+            },
+            "response_path": &schema.Schema{
+              Type: schema.TypeString,
+              Optional: true,
+              Default: "access_token",
+              Description: "The dotted path to the token in the response to this step. Default is 'access_token'.",
+            },
+            "expires_in_path": &schema.Schema{
+              Type: schema.TypeString,
+              Optional: true,
+              Default: "expires_in",
+              Description: "The dotted path to the number of seconds the token from this step is valid for. Default is 'expires_in'.",
+            },
+          },
+        },
+      },
       "timeout": &schema.Schema{
         Type: schema.TypeInt,
         Optional: true,
         DefaultFunc: schema.EnvDefaultFunc("REST_API_TIMEOUT", 0),
         Description: "When set, will cause requests taking longer than this time (in seconds) to be aborted.",
       },
+      "timeout_retry_factor": &schema.Schema{
+        Type: schema.TypeFloat,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TIMEOUT_RETRY_FACTOR", 0),
+        Description: "When set above 1 (along with timeout), each retry of a request may take this many times as long as the attempt before it, up to timeout_max. Default is 0, which means every attempt gets the same timeout.",
+      },
+      "timeout_max": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TIMEOUT_MAX", 0),
+        Description: "The longest (in seconds) a retried request may take when timeout_retry_factor is set. Default is 0, which means no limit.",
+      },
+      "host_overrides": &schema.Schema{
+        Type: schema.TypeMap,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "A map of host names to the address (IP or IP:port) the provider should connect to instead of resolving them. Requests and TLS verification still use the original host name. This is like /etc/hosts, but only for this provider.",
+      },
+      "expect_continue_timeout": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_EXPECT_CONTINUE_TIMEOUT", 0),
+        Description: "When set, requests with a body are sent with `Expect: 100-continue` and the body is only sent once the server agrees or this many seconds pass. This saves sending large bodies the server would reject anyway.",
+      },
+      "share_connections": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_SHARE_CONNECTIONS", nil),
+        Description: "When set, provider blocks (such as aliases) with the same connection settings share one pool of connections instead of each opening their own.",
+      },
+      "warm_connection": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_WARM_CONNECTION", nil),
+        Description: "When set, a HEAD request is sent to the uri when the provider is configured, so the connection (and TLS handshake) is ready for the first real request.",
+      },
+      "max_conns_per_host": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_MAX_CONNS_PER_HOST", 0),
+        Description: "When set, limits the number of simultaneous connections the provider opens to the API host. Requests beyond the limit wait for a connection to be free. Default is 0 which means no limit.",
+      },
       "id_attribute": &schema.Schema{
         Type: schema.TypeString,
         Optional: true,
         DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_ATTRIBUTE", nil),
-        Description: "When set, this key will be used to operate on REST objects. For example, if the ID is set to 'name', changes to the API object will be to http://foo.com/bar/VALUE_OF_NAME",
+        Description: "When set, this key will be used to operate on REST objects. For example, if the ID is set to 'name', changes to the API object will be to http://foo.com/bar/VALUE_OF_NAME. May be a JSON Pointer such as /metadata/uid.",
+      },
+      "id_case": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_CASE", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "lower", "upper"}, false),
+        Description: "When set to `lower` or `upper`, object ids are converted to that case before being stored or used in paths. Useful for APIs that return ids (such as UUIDs) in a different case than they accept.",
+      },
+      "id_fallback_attribute": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_FALLBACK_ATTRIBUTE", nil),
+        Description: "The dotted path to a field used as the object's id when id_attribute is missing or empty in a create response.",
+      },
+      "id_body_field": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_BODY_FIELD", nil),
+        Description: "For APIs that want the id in the body of updates and deletes as well as in the path: the key (or JSON Pointer) the object's id is set at in those bodies.",
+      },
+      "self_link_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_SELF_LINK_PATH", ""),
+        Description: "For APIs that link to each object (such as _links.self.href), the dotted path to that link in responses. Once an object has a link, it is read, updated and deleted at the link rather than at a path built from path and the id.",
+      },
+      "id_from_location": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_FROM_LOCATION", nil),
+        Description: "When set, the last path segment of the Location header of a create response is used as the object's id if the id cannot be found in the response body. This also allows objects to be created without an id when the API does not return the object.",
+      },
+      "id_changed": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ID_CHANGED", "ignore"),
+        ValidateFunc: validation.StringInSlice([]string{"ignore", "error", "adopt"}, false),
+        Description: "What to do when the API returns an object whose id_attribute is not the id in state: ignore it and keep the id in state, error, or adopt the new id. Default is ignore.",
+      },
+      "gone_codes": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{
+          Type: schema.TypeInt,
+          ValidateFunc: validate_gone_code,
+        },
+        Optional: true,
+        Description: "The response codes to a read that mean the object no longer exists, so it is removed from state. Default is 404 and 410. 401 and 403 are never allowed: they mean access was refused, not that the object is gone.",
+      },
+      "created_codes": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{
+          Type: schema.TypeInt,
+          ValidateFunc: validation.IntBetween(200, 299),
+        },
+        Optional: true,
+        Description: "The success codes to a create or update that mean the object was created. An update (an upsert PUT) that creates the object is then treated as a create. Default is 201.",
+      },
+      "updated_codes": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{
+          Type: schema.TypeInt,
+          ValidateFunc: validation.IntBetween(200, 299),
+        },
+        Optional: true,
+        Description: "The success codes to a create or update that mean an object that already existed was updated. Default is 200 and 204.",
+      },
+      "trailing_slash": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TRAILING_SLASH", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "add", "strip"}, false),
+        Description: "For APIs that redirect to add or remove a trailing slash: add or strip it on the paths used to read, update and delete objects, so there is no redirect.",
+      },
+      "query_array_style": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_QUERY_ARRAY_STYLE", "repeat"),
+        ValidateFunc: validation.StringInSlice([]string{"repeat", "comma"}, false),
+        Description: "How a query parameter with more than one value is sent: repeat it (id=1&id=2) or comma to join the values (id=1,2). Default is repeat.",
       },
       "copy_keys": &schema.Schema{
         Type: schema.TypeList,
         Elem: &schema.Schema{Type: schema.TypeString},
         Optional: true,
         DefaultFunc: schema.EnvDefaultFunc("REST_API_PASSWORD", nil),
-        Description: "When set, any PUT to the API for an object will copy these keys from the data the provider has gathered about the object. This is useful if internal API information must also be provided with updates, such as the revision of the object.",
+        Description: "When set, any PUT to the API for an object will copy these keys from the data the provider has gathered about the object. This is useful if internal API information must also be provided with updates, such as the revision of the object. Keys starting with / are JSON Pointers into nested objects.",
+      },
+      "computed_keys": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "Keys the API sets itself (such as created_at), which are left out of the data of imported objects along with copy_keys. May be JSON Pointers.",
+      },
+      "sensitive_fields": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "Dotted paths or JSON Pointers (such as password, credentials.key or /credentials/api.key) to fields of objects that hold secrets. They are masked in logs and in the api_data, api_response and other computed attributes of objects.",
+      },
+      "copy_keys_array_strategy": &schema.Schema{
+        Type: schema.TypeMap,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        ValidateFunc: validate_copy_keys_array_strategy,
+        Description: "How copy_keys copies each array valued key, keyed by the key: replace (the default) uses the API's array, merge_by_index merges elements at the same position and merge_by_key:<field> merges elements with the same value of field.",
+      },
+      "copy_keys_empty_as_absent": &schema.Schema{
+        Type: schema.TypeList,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "copy_keys for which an empty string and a missing (or null) field are the same. When the API and data differ only that way, the key is not copied and data is kept as it is.",
       },
       "write_returns_object": &schema.Schema{
         Type: schema.TypeBool,
@@ -69,6 +440,246 @@ func Provider() terraform.ResourceProvider {
         DefaultFunc: schema.EnvDefaultFunc("REST_API_CRO", nil),
         Description: "Set this when the API returns the object created only on creation operations (POST). This is used by the provider to refresh internal data structures.",
       },
+      "retry_max_attempts": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RETRY_MAX_ATTEMPTS", 0),
+        Description: "How many times to retry a request that gets no response or a 429, 502, 503 or 504. Default is 0, which means no retries unless retry_max_elapsed is set.",
+      },
+      "retry_max_elapsed": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RETRY_MAX_ELAPSED", 0),
+        Description: "The most time (in seconds) to spend retrying a request. Retries stop at this or retry_max_attempts, whichever comes first. Default is 0, which means no limit on time.",
+      },
+      "retry_wait_min": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RETRY_WAIT_MIN", 1),
+        Description: "How long (in seconds) to wait before the first retry. Each retry waits twice as long as the one before. Default is 1.",
+      },
+      "retry_wait_max": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RETRY_WAIT_MAX", 30),
+        Description: "The longest (in seconds) to wait between retries. Default is 30.",
+      },
+      "retry_after_headers": &schema.Schema{
+        Type: schema.TypeMap,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        ValidateFunc: validate_retry_after_headers,
+        Description: "Headers a retried response may say when to retry in, keyed by name, and how to read each: seconds, milliseconds, epoch (Unix time in seconds) or epoch_ms. They are used before a standard Retry-After header.",
+      },
+      "retry_after_429_only": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RETRY_AFTER_429_ONLY", nil),
+        Description: "When set, Retry-After and retry_after_headers are only honored on rate limited (429) responses, and other retried responses (such as a 503) always use the usual backoff.",
+      },
+      "http2_retries": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_HTTP2_RETRIES", 3),
+        Description: "How many times to send a request again, right away and on a new connection, when an HTTP/2 server closes the connection (GOAWAY) or resets the stream under it. POST and PATCH requests are only sent again when the server refused the stream, since it may have acted on them otherwise. These do not count against retry_max_attempts. Default is 3.",
+      },
+      "cache_ttl": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_CACHE_TTL", 0),
+        Description: "When greater than 0, data sources reuse the response to an identical read for this many seconds instead of asking the API again. A create, update or delete clears what is cached for its path. Default is 0 (no caching).",
+      },
+      "max_body_size": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_MAX_BODY_SIZE", 0),
+        Description: "When set, a request whose body is larger than this many bytes fails with an error before it is sent. Default is 0 which means no limit.",
+      },
+      "preflight": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PREFLIGHT", nil),
+        Description: "When set, an OPTIONS request is sent before every create, update and delete. It must succeed and, if it lists the methods allowed, allow the request's method.",
+      },
+      "preflight_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PREFLIGHT_PATH", nil),
+        Description: "Where to send the preflight OPTIONS. {path} is replaced by the path of the request. Default is the path of the request.",
+      },
+      "preflight_headers": &schema.Schema{
+        Type: schema.TypeMap,
+        Elem: &schema.Schema{Type: schema.TypeString},
+        Optional: true,
+        Description: "Headers to send with the preflight OPTIONS. {method} in a value is replaced by the method of the request, as in Access-Control-Request-Method.",
+      },
+      "tls_handshake_retries": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_TLS_HANDSHAKE_RETRIES", 3),
+        Description: "How many times to send a request again, backing off like other retries, when the TLS handshake is broken off or times out. Handshakes the server refuses with an alert are not retried. These do not count against retry_max_attempts. Default is 3.",
+      },
+      "partial_json_retries": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PARTIAL_JSON_RETRIES", 0),
+        Description: "How many times to send a request again, backing off like other retries, when it succeeds but the response is JSON that cannot be parsed, as when a proxy cuts it short. These do not count against retry_max_attempts. Default is 0.",
+      },
+      "strict_content_length": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_STRICT_CONTENT_LENGTH", nil),
+        Description: "When set, a response whose body is not as long as its Content-Length says is an error, and is retried like a 503 when retries are enabled.",
+      },
+      "empty_response_retries": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_EMPTY_RESPONSE_RETRIES", 0),
+        Description: "When write_returns_object or create_returns_object is set, the number of times to resend a request that succeeds with an empty body, backing off like other retries. This helps with eventually consistent APIs. Note that a create is resent as a new POST, so only use this if the API's creates are idempotent. Default is 0.",
+      },
+      "prior_state_header": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PRIOR_STATE_HEADER", ""),
+        Description: "When set, updates send the hex SHA-256 hash of the object as it was last read in this header, so the server can refuse the update if the object has changed since.",
+      },
+      "prior_state_field": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_PRIOR_STATE_FIELD", ""),
+        Description: "When set, updates include the whole object as it was last read in this field of the body, so the server can refuse the update if the object has changed since.",
+      },
+      "verify_create": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_VERIFY_CREATE", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "warn", "error"}, false),
+        Description: "After an object is created, compare the fields sent (other than copy_keys) with the object the API has. If the API dropped or changed any, warn logs a warning and error fails the apply (leaving the object tainted).",
+      },
+      "create_match_field": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_CREATE_MATCH_FIELD", nil),
+        Description: "When the API responds to a create with an array of objects, the dotted path to a field used to find the created object. The element whose field equals the value sent in the object's data is used.",
+      },
+      "merge_server_defaults": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_MERGE_SERVER_DEFAULTS", nil),
+        Description: "When set, the keys the API returns on the first read of an object that are not in its data are captured once in its server_defaults, and resent as they were with every later update where data does not set them. The id, copy_keys, computed_keys and sensitive_fields are never captured, so list other fields the server manages (such as a revision or timestamp) in computed_keys.",
+      },
+      "duplicate_keys": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_DUPLICATE_KEYS", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "warn", "error"}, false),
+        Description: "What to do when a JSON response has the same key more than once in an object: `warn` logs a warning and `error` fails the request. By default the last value is used silently.",
+      },
+      "response_content_type": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_RESPONSE_CONTENT_TYPE", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "strict", "force_json"}, false),
+        Description: "How the Content-Type of responses is treated. By default it is not checked. With `strict`, a successful response with a body must say it is JSON (or YAML with body_encoding yaml), so an HTML page from a proxy is an error. With `force_json`, for APIs that label their JSON as text/plain or similar, every response is taken to be JSON whatever it says it is.",
+      },
+      "error_message_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ERROR_MESSAGE_PATH", ""),
+        Description: "The dotted path to the human readable message in error responses (such as error.detail), so errors read '<message> (HTTP <code>)' instead of including the whole body. The whole body is used when the path is not found.",
+      },
+      "success_expression": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_SUCCESS_EXPRESSION", ""),
+        ValidateFunc: validate_success_expression,
+        Description: "A JMESPath expression that decides whether a response is a success instead of its status code. It is evaluated against an object with the response's status, headers (with lower case names) and body (parsed if it is JSON). Any result other than false, null or something empty is a success.",
+      },
+      "envelope_status_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ENVELOPE_STATUS_PATH", nil),
+        Description: "For APIs that wrap every response in an envelope, the dotted path to the field holding the operation's status (for example 'status'). Responses whose status does not equal envelope_success_value are treated as errors.",
+      },
+      "envelope_success_value": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ENVELOPE_SUCCESS_VALUE", "success"),
+        Description: "The value of the field at envelope_status_path that means the operation succeeded. Default is 'success'.",
+      },
+      "envelope_data_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ENVELOPE_DATA_PATH", nil),
+        Description: "The dotted path to the object inside the response envelope (for example 'data'). When set, only this part of a successful response is used as the object.",
+      },
+      "envelope_error_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_ENVELOPE_ERROR_PATH", nil),
+        Description: "The dotted path to the error message inside the response envelope (for example 'message'). Used in the error returned when the envelope reports a failure.",
+      },
+      "object_unwrap_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_OBJECT_UNWRAP_PATH", nil),
+        Description: "For APIs that wrap a single object (for example {\"widget\": {...}}): the dotted path to the object in responses that are about one object, such as reads, creates and updates.",
+      },
+      "list_unwrap_path": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LIST_UNWRAP_PATH", nil),
+        Description: "For APIs that wrap lists (for example {\"widgets\": [...]}): the dotted path to the array of objects in responses that list them. Used when a results_key is not given.",
+      },
+      "cookie_jar": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_COOKIE_JAR", nil),
+        Description: "When set, cookies the API sets (such as a session cookie from logging in) are kept and sent with later requests.",
+      },
+      "expose_cookies": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_EXPOSE_COOKIES", nil),
+        Description: "When set with cookie_jar, the cookies kept for the API are exposed in the (sensitive) cookies attribute of each object, for debugging.",
+      },
+      "expose_rate_limit": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_EXPOSE_RATE_LIMIT", nil),
+        Description: "When set, the most recent rate limit headers sent by the API (X-RateLimit-*, RateLimit-*) are exposed in the rate_limit attribute of each object. They are always logged when debug is enabled.",
+      },
+      "log_error_bodies": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LOG_ERROR_BODIES", nil),
+        Description: "When set, the body of any response that makes a request fail is logged, with fields that look like secrets masked. Unlike debug, nothing is logged for requests that succeed.",
+      },
+      "log_body_limit": &schema.Schema{
+        Type: schema.TypeInt,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LOG_BODY_LIMIT", 0),
+        Description: "When set, request and response bodies logged with debug or log_error_bodies are cut short after this many bytes, with a note saying how much was left out. Default is 0 which means no limit.",
+      },
+      "log_requests": &schema.Schema{
+        Type: schema.TypeBool,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LOG_REQUESTS", nil),
+        Description: "When set, one line is logged at info level for every request sent, with its method, path, attempt, status and how long it took.",
+      },
+      "log_destination": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LOG_DESTINATION", ""),
+        Description: "Where the provider's logs go: a file path (appended to), syslog or stderr. Secrets are masked wherever the logs go.",
+      },
+      "log_level": &schema.Schema{
+        Type: schema.TypeString,
+        Optional: true,
+        DefaultFunc: schema.EnvDefaultFunc("REST_API_LOG_LEVEL", ""),
+        ValidateFunc: validation.StringInSlice([]string{"", "error", "warn", "info", "debug"}, false),
+        Description: "The least important messages logged: error, warn, info or debug. Default is debug when log_destination is set.",
+      },
       "debug": &schema.Schema{
         Type: schema.TypeBool,
         Optional: true,
@@ -82,6 +693,10 @@ func Provider() terraform.ResourceProvider {
 	 one underscore. This is not documented anywhere I could find */
       "restapi_object": resourceRestApi(),
     },
+    DataSourcesMap: map[string]*schema.Resource{
+      "restapi_objects": dataSourceRestApiObjects(),
+      "restapi_objects_by_id": dataSourceRestApiObjectsById(),
+    },
     ConfigureFunc: configureProvider,
   }
 }
@@ -97,17 +712,248 @@ func configureProvider(d *schema.ResourceData) (interface{}, error) {
     }
   }
 
-  return NewAPIClient(
-    d.Get("uri").(string),
-    d.Get("insecure").(bool),
-    d.Get("username").(string),
-    d.Get("password").(string),
-    d.Get("authorization_header").(string),
-    d.Get("timeout").(int),
-    d.Get("id_attribute").(string),
-    copy_keys,
-    d.Get("write_returns_object").(bool),
-    d.Get("create_returns_object").(bool),
-    d.Get("debug").(bool),
-  ), nil
+  aws_credential_chain := make([]string, 0)
+  for _, v := range d.Get("aws_credential_chain").([]interface{}) {
+    aws_credential_chain = append(aws_credential_chain, v.(string))
+  }
+
+  gone_codes := make([]int, 0)
+  for _, v := range d.Get("gone_codes").([]interface{}) {
+    gone_codes = append(gone_codes, v.(int))
+  }
+
+  created_codes := make([]int, 0)
+  for _, v := range d.Get("created_codes").([]interface{}) {
+    created_codes = append(created_codes, v.(int))
+  }
+  creates := created_codes
+  if len(creates) == 0 { creates = []int{201} }
+  updated_codes := make([]int, 0)
+  for _, v := range d.Get("updated_codes").([]interface{}) {
+    for _, created := range creates {
+      if v.(int) == created {
+        return nil, errors.New(fmt.Sprintf("%d is in both created_codes and updated_codes", created))
+      }
+    }
+    updated_codes = append(updated_codes, v.(int))
+  }
+
+  computed_keys := make([]string, 0)
+  for _, v := range d.Get("computed_keys").([]interface{}) {
+    computed_keys = append(computed_keys, v.(string))
+  }
+
+  sensitive_fields := make([]string, 0)
+  for _, v := range d.Get("sensitive_fields").([]interface{}) {
+    sensitive_fields = append(sensitive_fields, v.(string))
+  }
+
+  auth_hosts := make([]string, 0)
+  for _, v := range d.Get("auth_hosts").([]interface{}) {
+    auth_hosts = append(auth_hosts, v.(string))
+  }
+
+  copy_keys_array_strategy := make(map[string]string)
+  for k, v := range d.Get("copy_keys_array_strategy").(map[string]interface{}) {
+    copy_keys_array_strategy[k] = v.(string)
+  }
+
+  copy_keys_empty_as_absent := make([]string, 0)
+  for _, v := range d.Get("copy_keys_empty_as_absent").([]interface{}) {
+    copy_keys_empty_as_absent = append(copy_keys_empty_as_absent, v.(string))
+  }
+
+  retry_after_headers := make(map[string]string)
+  for k, v := range d.Get("retry_after_headers").(map[string]interface{}) {
+    retry_after_headers[k] = v.(string)
+  }
+
+  path_variables := make(map[string]string)
+  for k, v := range d.Get("path_variables").(map[string]interface{}) {
+    path_variables[k] = v.(string)
+  }
+
+  preflight_headers := make(map[string]string)
+  for k, v := range d.Get("preflight_headers").(map[string]interface{}) {
+    preflight_headers[k] = v.(string)
+  }
+
+  host_overrides := make(map[string]string)
+  for k, v := range d.Get("host_overrides").(map[string]interface{}) {
+    host_overrides[k] = v.(string)
+  }
+
+  token_exchange := make([]token_step, 0)
+  for _, v := range d.Get("token_exchange").([]interface{}) {
+    step := v.(map[string]interface{})
+    headers := make(map[string]string)
+    for name, value := range step["headers"].(map[string]interface{}) {
+      headers[name] = value.(string)
+    }
+    token_exchange = append(token_exchange, token_step{
+      url:             step["url"].(string),
+      method:          step["method"].(string),
+      body:            step["body"].(string),
+      headers:         headers,
+      response_path:   step["response_path"].(string),
+      expires_in_path: step["expires_in_path"].(string),
+    })
+  }
+  if d.Get("response_content_type").(string) == "force_json" && d.Get("body_encoding").(string) == "yaml" {
+    return nil, errors.New("response_content_type force_json cannot be used with body_encoding yaml")
+  }
+  if len(token_exchange) > 0 && d.Get("token_url").(string) == "" {
+    return nil, errors.New("token_exchange requires token_url to be set, since it is the first step of getting a token")
+  }
+
+  if err := configure_logging(d.Get("log_destination").(string), d.Get("log_level").(string)); err != nil {
+    return nil, err
+  }
+
+  opt := &api_client_opt{
+    uri:                          d.Get("uri").(string),
+    path_variables:               path_variables,
+    insecure:                     d.Get("insecure").(bool),
+    username:                     d.Get("username").(string),
+    password:                     d.Get("password").(string),
+    auth_header:                  d.Get("authorization_header").(string),
+    auth_hosts:                   auth_hosts,
+    max_redirects:                d.Get("max_redirects").(int),
+    redirect_body_path:           d.Get("redirect_body_path").(string),
+    strip_xssi_prefix:            d.Get("strip_xssi_prefix").(bool),
+    response_strip_prefix:        d.Get("response_strip_prefix").(string),
+    response_strip_suffix:        d.Get("response_strip_suffix").(string),
+    response_signature_header:    d.Get("response_signature_header").(string),
+    response_signature_algorithm: d.Get("response_signature_algorithm").(string),
+    response_signature_secret:    d.Get("response_signature_secret").(string),
+    body_encoding:                d.Get("body_encoding").(string),
+    canonical_json:               d.Get("canonical_json").(bool),
+    preserve_key_order:           d.Get("preserve_key_order").(bool),
+    minimal_headers:              d.Get("minimal_headers").(bool),
+    null_fields:                  d.Get("null_fields").(string),
+    normalize_unicode:            d.Get("normalize_unicode").(bool),
+    body_form_field:              d.Get("body_form_field").(string),
+    aws_region:                   d.Get("aws_region").(string),
+    aws_region_from_host:         d.Get("aws_region_from_host").(bool),
+    aws_credential_chain:         aws_credential_chain,
+    aws_profile:                  d.Get("aws_profile").(string),
+    aws_sign:                     d.Get("aws_sign").(bool),
+    token_url:                    d.Get("token_url").(string),
+    token_request_body:           d.Get("token_request_body").(string),
+    token_response_path:          d.Get("token_response_path").(string),
+    token_expires_in_path:        d.Get("token_expires_in_path").(string),
+    token_refresh_skew:           d.Get("token_refresh_skew").(int),
+    token_header_prefix:          d.Get("token_header_prefix").(string),
+    token_exchange:               token_exchange,
+    timeout:                      d.Get("timeout").(int),
+    timeout_retry_factor:         d.Get("timeout_retry_factor").(float64),
+    timeout_max:                  d.Get("timeout_max").(int),
+    host_overrides:               host_overrides,
+    expect_continue_timeout:      d.Get("expect_continue_timeout").(int),
+    share_connections:            d.Get("share_connections").(bool),
+    max_conns_per_host:           d.Get("max_conns_per_host").(int),
+    id_attribute:                 d.Get("id_attribute").(string),
+    id_case:                      d.Get("id_case").(string),
+    id_fallback_attribute:        d.Get("id_fallback_attribute").(string),
+    id_body_field:                d.Get("id_body_field").(string),
+    id_from_location:             d.Get("id_from_location").(bool),
+    self_link_path:               d.Get("self_link_path").(string),
+    trailing_slash:               d.Get("trailing_slash").(string),
+    query_array_style:            d.Get("query_array_style").(string),
+    id_changed:                   d.Get("id_changed").(string),
+    gone_codes:                   gone_codes,
+    created_codes:                created_codes,
+    updated_codes:                updated_codes,
+    copy_keys:                    copy_keys,
+    copy_keys_array_strategy:     copy_keys_array_strategy,
+    copy_keys_empty_as_absent:    copy_keys_empty_as_absent,
+    computed_keys:                computed_keys,
+    sensitive_fields:             sensitive_fields,
+    write_returns_object:         d.Get("write_returns_object").(bool),
+    create_returns_object:        d.Get("create_returns_object").(bool),
+    retry_max_attempts:           d.Get("retry_max_attempts").(int),
+    retry_max_elapsed:            d.Get("retry_max_elapsed").(int),
+    retry_wait_min:               d.Get("retry_wait_min").(int),
+    retry_wait_max:               d.Get("retry_wait_max").(int),
+    retry_after_headers:          retry_after_headers,
+    retry_after_429_only:         d.Get("retry_after_429_only").(bool),
+    http2_retries:                d.Get("http2_retries").(int),
+    tls_handshake_retries:        d.Get("tls_handshake_retries").(int),
+    partial_json_retries:         d.Get("partial_json_retries").(int),
+    strict_content_length:        d.Get("strict_content_length").(bool),
+    cache_ttl:                    d.Get("cache_ttl").(int),
+    max_body_size:                d.Get("max_body_size").(int),
+    preflight:                    d.Get("preflight").(bool),
+    preflight_path:               d.Get("preflight_path").(string),
+    preflight_headers:            preflight_headers,
+    empty_response_retries:       d.Get("empty_response_retries").(int),
+    prior_state_header:           d.Get("prior_state_header").(string),
+    prior_state_field:            d.Get("prior_state_field").(string),
+    verify_create:                d.Get("verify_create").(string),
+    create_match_field:           d.Get("create_match_field").(string),
+    merge_server_defaults:        d.Get("merge_server_defaults").(bool),
+    duplicate_keys:               d.Get("duplicate_keys").(string),
+    response_content_type:        d.Get("response_content_type").(string),
+    error_message_path:           d.Get("error_message_path").(string),
+    success_expression:           d.Get("success_expression").(string),
+    envelope_status_path:         d.Get("envelope_status_path").(string),
+    envelope_success_value:       d.Get("envelope_success_value").(string),
+    envelope_data_path:           d.Get("envelope_data_path").(string),
+    envelope_error_path:          d.Get("envelope_error_path").(string),
+    object_unwrap_path:           d.Get("object_unwrap_path").(string),
+    list_unwrap_path:             d.Get("list_unwrap_path").(string),
+    cookie_jar:                   d.Get("cookie_jar").(bool),
+    expose_cookies:               d.Get("expose_cookies").(bool),
+    expose_rate_limit:            d.Get("expose_rate_limit").(bool),
+    log_error_bodies:             d.Get("log_error_bodies").(bool),
+    log_body_limit:               d.Get("log_body_limit").(int),
+    log_requests:                 d.Get("log_requests").(bool),
+    debug:                        d.Get("debug").(bool),
+  }
+
+  client := NewAPIClient(opt)
+  if d.Get("warm_connection").(bool) { client.warm_connection() }
+  return client, nil
+}
+
+func validate_copy_keys_array_strategy(v interface{}, k string) (ws []string, errs []error) {
+  for key, strategy := range v.(map[string]interface{}) {
+    switch s := strategy.(string); {
+    case s == "replace", s == "merge_by_index":
+    case strings.HasPrefix(s, "merge_by_key:") && len(s) > len("merge_by_key:"):
+    default:
+      errs = append(errs, errors.New(fmt.Sprintf("%s: The strategy for '%s' must be replace, merge_by_index or merge_by_key:<field> but is '%s'", k, key, s)))
+    }
+  }
+  return
+}
+
+func validate_gone_code(v interface{}, k string) (ws []string, errs []error) {
+  code := v.(int)
+  if code == 401 || code == 403 {
+    errs = append(errs, errors.New(fmt.Sprintf("%s: %d cannot be a gone code. It means access was refused, not that the object is gone, and treating it as gone would create the object again.", k, code)))
+  } else if code < 400 || code > 599 {
+    errs = append(errs, errors.New(fmt.Sprintf("%s: %d is not an error response code", k, code)))
+  }
+  return
+}
+
+func validate_retry_after_headers(v interface{}, k string) (ws []string, errs []error) {
+  for name, format := range v.(map[string]interface{}) {
+    valid := false
+    for _, f := range retry_after_formats { valid = valid || f == format.(string) }
+    if !valid {
+      errs = append(errs, errors.New(fmt.Sprintf("%s: The format of '%s' must be one of %s but is '%s'", k, name, strings.Join(retry_after_formats, ", "), format)))
+    }
+  }
+  return
+}
+
+func validate_success_expression(v interface{}, k string) (ws []string, errs []error) {
+  expression := v.(string)
+  if expression == "" { return }
+  if _, err := jmespath.Compile(expression); err != nil {
+    errs = append(errs, errors.New(fmt.Sprintf("%s: '%s' is not a valid JMESPath expression: %s", k, expression, err)))
+  }
+  return
 }
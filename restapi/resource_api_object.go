@@ -2,7 +2,9 @@ package restapi
 
 import (
   "github.com/hashicorp/terraform/helper/schema"
+  "encoding/json"
   "fmt"
+  "reflect"
   "strings"
   "errors"
   "log"
@@ -20,29 +22,289 @@ func resourceRestApi() *schema.Resource {
       State: resourceRestApiImport,
     },
 
+    CustomizeDiff: resourceRestApiCustomizeDiff,
+
 
     Schema: map[string]*schema.Schema{
       "path": &schema.Schema{
         Type:        schema.TypeString,
-        Description: "The API path on top of the base URL set in the provider that represents objects of this type on the API server.",
+        Description: "The API path on top of the base URL set in the provider that represents objects of this type on the API server. May contain {name} placeholders which are filled from the object's id ({id}) or keys in the object's data.",
         Required:    true,
       },
       "data": &schema.Schema{
         Type:        schema.TypeString,
-        Description: "Valid JSON data that this provider will manage with the API server.",
+        Description: "Valid JSON data that this provider will manage with the API server. It is sensitive, since it may hold the provider's sensitive_fields.",
         Required:    true,
+        Sensitive:   true,
       },
       "debug": &schema.Schema{
         Type:        schema.TypeBool,
         Description: "Whether to emit verbose debug output while working with the API object on the server.",
         Optional:    true,
       },
+      "ready_status_field": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to a status field in the object read from the API. When set, creation waits until this field equals ready_status_value.",
+        Optional:    true,
+      },
+      "ready_status_value": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The value of ready_status_field that means the object is ready to use.",
+        Optional:    true,
+      },
+      "failed_status_values": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Values of ready_status_field that mean the object will never become ready. Reaching one of these fails the creation.",
+        Optional:    true,
+      },
+      "operation_id_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "For APIs that answer a create with 202 Accepted and a reference to an operation in the body: the dotted path to the operation's id in that body.",
+        Optional:    true,
+      },
+      "operation_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The path to read the status of a create operation from, such as /operations/{operation_id}. When set, a 202 response to a create is followed until the operation is done.",
+        Optional:    true,
+      },
+      "operation_status_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to the status in the operation. Default is status.",
+        Optional:    true,
+        Default:     "status",
+      },
+      "operation_success_values": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Values of operation_status_path that mean the operation is done and the object created.",
+        Optional:    true,
+      },
+      "operation_failed_values": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Values of operation_status_path that mean the operation failed.",
+        Optional:    true,
+      },
+      "operation_result_id_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to the created object's id in the operation once it is done, when the id is not in data.",
+        Optional:    true,
+      },
+      "ready_timeout": &schema.Schema{
+        Type:        schema.TypeInt,
+        Description: "How long (in seconds) to wait for the object to be ready. Default is 0 which means wait forever.",
+        Optional:    true,
+      },
+      "ready_poll_interval": &schema.Schema{
+        Type:        schema.TypeInt,
+        Description: "How long (in seconds) to wait between reads while waiting for the object to be ready. Default is 5.",
+        Optional:    true,
+        Default:     5,
+      },
+      "api_schema": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Fields of the object read from the API to expose with their proper types. Each key is a dotted path into the object and each value is one of string, number, bool or json. The values are exposed in api_strings, api_numbers, api_bools and api_json, keyed by path.",
+        Optional:    true,
+      },
+      "preserve_unknown_fields": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "When api_schema is set, keep the top level fields it does not cover in api_other (as JSON strings) instead of dropping them.",
+        Optional:    true,
+      },
+      "update_defaults": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "Valid JSON object whose fields are added to the body of updates (PUT) where data does not set them. Useful for fields the API requires on every update.",
+        Optional:    true,
+      },
+      "update_copy_keys": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Keys to copy from the object as it was read just before an update into the body of the update, where data does not set them. Useful for fields such as an etag or version the API requires but the user does not manage.",
+        Optional:    true,
+      },
+      "preserve_fields": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Fields the server assigns, such as the ids of nested objects, to send back in every update. What the server last returned for each (top level keys, or JSON Pointers such as /items) is merged into the update: anything data does not set is added, even deep within objects and arrays, and anything data sets is kept.",
+        Optional:    true,
+      },
+      "coerce_fields": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Fields of the body sent to the API to convert to the type it expects, whatever type terraform gives them. Each key is a dotted path (or JSON Pointer) into the body and each value is one of string, number or bool. For example, {port = \"number\"} sends \"8080\" as 8080.",
+        Optional:    true,
+      },
+      "read_before_destroy": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "Read the object just before deleting it, so fields of the fresh read can fill placeholders in the path, destroy_data and destroy_headers.",
+        Optional:    true,
+      },
+      "destroy_data": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "A body to send with the DELETE request. {id} is replaced with the object's id and {data.<path>} with the JSON escaped value at that path in the object's data. Other braces are sent as they are.",
+        Optional:    true,
+      },
+      "destroy_headers": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Headers to send with the DELETE request. Values may contain {name} placeholders, filled like those in the path.",
+        Optional:    true,
+      },
+      "probe_method": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The HTTP method (such as HEAD) of a lightweight request used to check the object still exists on refresh, instead of reading all of it. The object is still read in full when it is created, imported or updated.",
+        Optional:    true,
+      },
+      "probe_query": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "A query string (such as fields=id) added to the lightweight request used to check the object still exists on refresh. The method is GET unless probe_method is set.",
+        Optional:    true,
+      },
+      "query_params": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Query parameters added to every request for the object. Values may contain {name} placeholders, filled like those in the path. A value that is just a placeholder for an array in data sends each element, as the provider's query_array_style says.",
+        Optional:    true,
+      },
+      "create_lookup_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "For APIs that do not say what the id of a created object is: after the create, objects are read from this path (which may contain {name} placeholders) and the id is taken from the one that matches what was sent. Defaults to the path objects are created at when create_lookup_query is set.",
+        Optional:    true,
+      },
+      "create_lookup_query": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Query parameters for finding a created object, such as { name = \"{name}\" }. Values may contain {name} placeholders, filled from the data sent.",
+        Optional:    true,
+      },
+      "create_lookup_results_key": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "When the response from create_lookup_path is not an array, the dotted path to the array of objects in it.",
+        Optional:    true,
+      },
+      "dedup_keys": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Keys of data that identify an object (such as a name). Before a failed create is retried, objects are read from create_lookup_path with create_lookup_query, and one with the same values for these keys is used rather than creating another.",
+        Optional:    true,
+      },
+      "read_list_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "For APIs with no way to GET one object: the object is read by listing this path (which may contain {name} placeholders) and picking the object whose read_list_id_path matches its id. If it is not in the list, it is treated as gone.",
+        Optional:    true,
+      },
+      "read_list_results_key": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "When the response from read_list_path is not an array, the dotted path to the array of objects in it. With read_paginated, the dotted path to the items in each page of the object.",
+        Optional:    true,
+      },
+      "read_list_id_path": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The dotted path to the id in each object listed from read_list_path. Defaults to the provider's id_attribute.",
+        Optional:    true,
+      },
+      "read_list_page_param": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The query parameter for the page number (starting at 1) when read_list_path (or with read_paginated, the object) is paged.",
+        Optional:    true,
+      },
+      "read_list_page_size_param": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The query parameter asking for read_list_page_size objects per page.",
+        Optional:    true,
+      },
+      "read_list_page_size": &schema.Schema{
+        Type:        schema.TypeInt,
+        Description: "How many objects to ask for per page. A shorter page is the last one.",
+        Optional:    true,
+      },
+      "read_paginated": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "For an object that is a collection whose items span pages, such as a group and its members: read every page of the object (using read_list_page_param, read_list_page_size_param and read_list_page_size) and put the items from all of them at read_list_results_key, so items on later pages are not seen as removed.",
+        Optional:    true,
+      },
+      "force_new_on_change": &schema.Schema{
+        Type:        schema.TypeBool,
+        Description: "For objects the API cannot update: any change to data replaces the object (destroy then create) instead of updating it.",
+        Optional:    true,
+      },
+      "force_new_fields": &schema.Schema{
+        Type:        schema.TypeList,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "Keys of data that cannot be updated. A change to one of these replaces the object, while changes to other keys are updates.",
+        Optional:    true,
+      },
       "api_data": &schema.Schema{
         Type:        schema.TypeMap,
 	Elem:        &schema.Schema{ Type: schema.TypeString },
         Description: "After data from the API server is read, this map will include k/v pairs usable in other terraform resources as readable objects. Currently the value is the golang fmt package's representation of the value (simple primitives are set as expected, but complex types like arrays and maps contain golang formatting).",
 	Computed:    true,
       },
+      "api_strings": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The api_schema fields of type string.",
+        Computed:    true,
+      },
+      "api_numbers": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeFloat },
+        Description: "The api_schema fields of type number.",
+        Computed:    true,
+      },
+      "api_bools": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeBool },
+        Description: "The api_schema fields of type bool.",
+        Computed:    true,
+      },
+      "api_json": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "The api_schema fields of type json, each encoded as a JSON string.",
+        Computed:    true,
+      },
+      "api_other": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "When preserve_unknown_fields is set, the top level fields not covered by api_schema, each encoded as a JSON string.",
+        Computed:    true,
+      },
+      "api_response": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "The body of the last response from the API server about this object as it was received, before it was parsed. If a response envelope is configured in the provider, this is the unwrapped data.",
+        Computed:    true,
+      },
+      "server_defaults": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "With the provider's merge_server_defaults, the keys the API filled in on the first read of the object that data does not set, as a JSON object, less the id, copy_keys, computed_keys and sensitive_fields. They are sent with every update where data does not set them.",
+        Computed:    true,
+      },
+      "write_result": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "What the API's response code to the last create or update says was done: created or updated, according to the provider's created_codes and updated_codes. Empty when the code is in neither.",
+        Computed:    true,
+      },
+      "self_link": &schema.Schema{
+        Type:        schema.TypeString,
+        Description: "When self_link_path is set in the provider, the link to this object from the API. The object is read, updated and deleted there.",
+        Computed:    true,
+      },
+      "cookies": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "When cookie_jar and expose_cookies are set in the provider, the cookies kept for the API, keyed by name.",
+        Computed:    true,
+        Sensitive:   true,
+      },
+      "rate_limit": &schema.Schema{
+        Type:        schema.TypeMap,
+        Elem:        &schema.Schema{ Type: schema.TypeString },
+        Description: "When expose_rate_limit is set in the provider, the most recent rate limit headers sent by the API, keyed by lower case header name.",
+        Computed:    true,
+      },
     }, /* End schema */
 
   }
@@ -54,13 +316,110 @@ func resourceRestApi() *schema.Resource {
    results in a new object created */
 func make_api_object(d *schema.ResourceData, m interface{}) (*api_object, error) {
   log.Printf("resource_api_object.go: make_api_object routine called for id '%s'\n", d.Id())
-  obj, err := NewAPIObject (
-    m.(*api_client),
-    d.Get("path").(string),
-    d.Id(),
-    d.Get("data").(string),
-    d.Get("debug").(bool),
-  )
+  failed_status_values := make([]string, 0)
+  for _, v := range d.Get("failed_status_values").([]interface{}) {
+    failed_status_values = append(failed_status_values, v.(string))
+  }
+
+  api_schema := make(map[string]string)
+  for k, v := range d.Get("api_schema").(map[string]interface{}) {
+    api_schema[k] = v.(string)
+  }
+
+  coerce_fields := make(map[string]string)
+  for k, v := range d.Get("coerce_fields").(map[string]interface{}) {
+    coerce_fields[k] = v.(string)
+  }
+
+  update_copy_keys := make([]string, 0)
+  for _, v := range d.Get("update_copy_keys").([]interface{}) {
+    update_copy_keys = append(update_copy_keys, v.(string))
+  }
+
+  preserve_fields := make([]string, 0)
+  for _, v := range d.Get("preserve_fields").([]interface{}) {
+    preserve_fields = append(preserve_fields, v.(string))
+  }
+
+  destroy_headers := make(map[string]string)
+  for k, v := range d.Get("destroy_headers").(map[string]interface{}) {
+    destroy_headers[k] = v.(string)
+  }
+
+  query_params := make(map[string]string)
+  for k, v := range d.Get("query_params").(map[string]interface{}) {
+    query_params[k] = v.(string)
+  }
+
+  create_lookup_query := make(map[string]string)
+  for k, v := range d.Get("create_lookup_query").(map[string]interface{}) {
+    create_lookup_query[k] = v.(string)
+  }
+
+  operation := async_operation{
+    id_path:        d.Get("operation_id_path").(string),
+    path:           d.Get("operation_path").(string),
+    status_path:    d.Get("operation_status_path").(string),
+    result_id_path: d.Get("operation_result_id_path").(string),
+  }
+  for _, v := range d.Get("operation_success_values").([]interface{}) {
+    operation.success_values = append(operation.success_values, v.(string))
+  }
+  for _, v := range d.Get("operation_failed_values").([]interface{}) {
+    operation.failed_values = append(operation.failed_values, v.(string))
+  }
+
+  dedup_keys := make([]string, 0)
+  for _, v := range d.Get("dedup_keys").([]interface{}) {
+    dedup_keys = append(dedup_keys, v.(string))
+  }
+
+  read_list := list_read{
+    path:        d.Get("read_list_path").(string),
+    results_key: d.Get("read_list_results_key").(string),
+    id_path:     d.Get("read_list_id_path").(string),
+    paging:      list_paging{
+      page_param:      d.Get("read_list_page_param").(string),
+      page_size_param: d.Get("read_list_page_size_param").(string),
+      page_size:       d.Get("read_list_page_size").(int),
+    },
+    paginated:   d.Get("read_paginated").(bool),
+  }
+
+  opt := &api_object_opt{
+    path:                 d.Get("path").(string),
+    id:                   d.Id(),
+    data:                 d.Get("data").(string),
+    debug:                d.Get("debug").(bool),
+    ready_status_field:   d.Get("ready_status_field").(string),
+    ready_status_value:   d.Get("ready_status_value").(string),
+    failed_status_values: failed_status_values,
+    ready_timeout:        d.Get("ready_timeout").(int),
+    ready_poll_interval:  d.Get("ready_poll_interval").(int),
+    api_schema:           api_schema,
+    preserve_unknown:     d.Get("preserve_unknown_fields").(bool),
+    update_defaults:      d.Get("update_defaults").(string),
+    server_defaults:      d.Get("server_defaults").(string),
+    update_copy_keys:     update_copy_keys,
+    preserve_fields:      preserve_fields,
+    coerce_fields:        coerce_fields,
+    prior_response:       d.Get("api_response").(string),
+    read_before_destroy:  d.Get("read_before_destroy").(bool),
+    destroy_data:         d.Get("destroy_data").(string),
+    destroy_headers:      destroy_headers,
+    probe_method:         d.Get("probe_method").(string),
+    probe_query:          d.Get("probe_query").(string),
+    query_params:         query_params,
+    create_lookup_path:   d.Get("create_lookup_path").(string),
+    create_lookup_query:  create_lookup_query,
+    create_lookup_key:    d.Get("create_lookup_results_key").(string),
+    operation:            operation,
+    self_link:            d.Get("self_link").(string),
+    list_read:            read_list,
+    dedup_keys:           dedup_keys,
+  }
+
+  obj, err := NewAPIObject(m.(*api_client), opt)
   return obj, err
 }
 
@@ -68,14 +427,58 @@ func make_api_object(d *schema.ResourceData, m interface{}) (*api_object, error)
    all the k,v pairs into the api_data map so users can
    consume the values elsewhere if they'd like */
 func set_resource_state(obj *api_object, d *schema.ResourceData) {
+  /* Keep sensitive_fields out of state */
   api_data := make(map[string]string)
-  for k, v := range obj.api_data {
+  for k, v := range obj.api_client.mask_value(obj.api_data).(map[string]interface{}) {
     api_data[k] = fmt.Sprintf("%v", v)
   }
   d.Set("api_data", api_data)
+  d.Set("api_response", obj.api_client.mask_body(obj.api_response))
+  d.Set("self_link", obj.self_link)
+
+  if len(obj.api_schema) > 0 {
+    d.Set("api_strings", obj.typed.strings)
+    d.Set("api_numbers", obj.typed.numbers)
+    d.Set("api_bools", obj.typed.bools)
+    d.Set("api_json", obj.typed.json)
+    d.Set("api_other", obj.typed.other)
+  }
+
+  if obj.api_client.expose_cookies {
+    d.Set("cookies", obj.api_client.get_cookies())
+  }
+
+  if obj.api_client.expose_rate_limit {
+    d.Set("rate_limit", obj.api_client.get_rate_limit())
+  }
 }
 
 
+/* Immutable objects (or fields) are replaced rather than
+   sent an update the API does not support */
+func resourceRestApiCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+  if d.Id() == "" || !d.HasChange("data") { return nil }
+
+  if d.Get("force_new_on_change").(bool) { return d.ForceNew("data") }
+
+  fields := d.Get("force_new_fields").([]interface{})
+  if len(fields) == 0 { return nil }
+
+  o, n := d.GetChange("data")
+  old_data := make(map[string]interface{})
+  new_data := make(map[string]interface{})
+  /* Let the invalid JSON be reported elsewhere */
+  if json.Unmarshal([]byte(o.(string)), &old_data) != nil || json.Unmarshal([]byte(n.(string)), &new_data) != nil { return nil }
+
+  for _, field := range fields {
+    if !reflect.DeepEqual(old_data[field.(string)], new_data[field.(string)]) {
+      log.Printf("resource_api_object.go: '%s' changed, so the object must be replaced\n", field)
+      return d.ForceNew("data")
+    }
+  }
+  return nil
+}
+
 /* Since there is nothing in the ResourceData structure other
    than the "id" passed on the command line, we have to use an opinionated
    view of the API paths to figure out how to read that object
@@ -88,8 +491,12 @@ func resourceRestApiImport(d *schema.ResourceData, meta interface{}) (imported [
   path := input[0:n]
   d.Set("path", path)
 
+  /* Only the id is known until the object is read */
   id := input[n+1:len(input)]
-  d.Set("data", fmt.Sprintf(`{ "id": "%s" }`, id))
+  placeholder_data := make(map[string]interface{})
+  set_key(placeholder_data, meta.(*api_client).id_attribute, id)
+  placeholder, _ := json.Marshal(placeholder_data)
+  d.Set("data", string(placeholder))
   d.SetId(id)
 
   /* Troubleshooting is hard enough. Emit log messages so TF_LOG
@@ -102,6 +509,7 @@ func resourceRestApiImport(d *schema.ResourceData, meta interface{}) (imported [
 
   err = obj.read_object()
   if err == nil {
+    d.Set("data", obj.imported_data())
     set_resource_state(obj, d)
     /* Data that we set in the state above must be passed along
        as an item in the stack of imported data */
@@ -116,11 +524,26 @@ func resourceRestApiCreate(d *schema.ResourceData, meta interface{}) error {
   if err != nil { return err }
   log.Printf("resource_api_object.go: Create routine called. Object built:\n%s\n", obj.toString())
 
+  /* Keep what is sent, since creating fills in data */
+  sent := obj.sent_data()
+
   err = obj.create_object()
   if err == nil {
     /* Setting terraform ID tells terraform the object was created or it exists */
     d.SetId(obj.id)
     set_resource_state(obj, d)
+    d.Set("write_result", obj.write_result)
+    if obj.write_result == "updated" {
+      log.Printf("resource_api_object.go: Object '%s' already existed, so the create updated it\n", obj.id)
+    }
+
+    /* With the id set, a failure here leaves the object tainted */
+    if err = obj.verify_created(sent); err != nil { return err }
+
+    /* The id is already set, so if the object never becomes
+       ready terraform will know to replace it */
+    err = obj.wait_for_ready()
+    if err == nil { set_resource_state(obj, d) }
   }
   return err
 }
@@ -130,14 +553,33 @@ func resourceRestApiRead(d *schema.ResourceData, meta interface{}) error {
   if err != nil { return err }
   log.Printf("resource_api_object.go: Read routine called. Object built:\n%s\n", obj.toString())
 
-  err = obj.read_object()
-  if err == nil {
-    /* Setting terraform ID tells terraform the object was created or it exists */
-    log.Printf("resource_api_object.go: Read resource. Returned id is '%s'\n", obj.id);
-    d.SetId(obj.id)
-    set_resource_state(obj, d)
+  /* Once the object has been read in full, a routine refresh
+     only checks it still exists and keeps what is in state */
+  probe := obj.has_probe() && d.Get("api_response").(string) != ""
+
+  exists, err := obj.exists(probe)
+  if err != nil { return err }
+  if !exists {
+    /* Gone, so terraform will plan to create it again */
+    log.Printf("resource_api_object.go: Object '%s' no longer exists. Removing it from state.\n", obj.id)
+    d.SetId("")
+    return nil
   }
-  return err
+  if probe { return nil }
+
+  /* Setting terraform ID tells terraform the object was created or it exists */
+  log.Printf("resource_api_object.go: Read resource. Returned id is '%s'\n", obj.id);
+  d.SetId(obj.id)
+  set_resource_state(obj, d)
+
+  /* Only the first read after the object is made, so the
+     server's defaults are settled once and kept */
+  if obj.api_client.merge_server_defaults && d.Get("server_defaults").(string) == "" {
+    defaults, err := json.Marshal(obj.find_server_defaults())
+    if err != nil { return err }
+    d.Set("server_defaults", string(defaults))
+  }
+  return nil
 }
 
 func resourceRestApiUpdate(d *schema.ResourceData, meta interface{}) error {
@@ -147,16 +589,29 @@ func resourceRestApiUpdate(d *schema.ResourceData, meta interface{}) error {
   /* If copy_keys is not empty, we have to grab the latest 
      data so we can copy anything needed before the update */
   client := meta.(*api_client)
-  if len(client.copy_keys) > 0 {
+  if len(client.copy_keys) > 0 || len(obj.update_copy_keys) > 0 {
     err = obj.read_object()
     if err != nil { return err }
   }
 
   log.Printf("resource_api_object.go: Update routine called. Object built:\n%s\n", obj.toString())
 
+  /* Keep what is sent, in case the update creates it */
+  sent := obj.sent_data()
+
   err = obj.update_object()
   if err == nil {
     set_resource_state(obj, d)
+    d.Set("write_result", obj.write_result)
+
+    /* An upsert PUT made the object again (it was gone), so
+       do what is done after a create */
+    if obj.write_result == "created" {
+      log.Printf("resource_api_object.go: Object '%s' did not exist, so the update created it\n", obj.id)
+      if err = obj.verify_created(sent); err != nil { return err }
+      err = obj.wait_for_ready()
+      if err == nil { set_resource_state(obj, d) }
+    }
   }
   return err
 }
@@ -177,16 +632,13 @@ func resourceRestApiDelete(d *schema.ResourceData, meta interface{}) error {
 }
 
 func resourceRestApiExists(d *schema.ResourceData, meta interface{}) (b bool, e error) {
-  exists := false
   obj, err := make_api_object(d, meta)
   if err != nil { return false, err }
   log.Printf("resource_api_object.go: Exists routine called. Object built: %s\n", obj.toString())
 
-  err = obj.read_object()
-  /* Assume all errors indicate the object just doesn't exist.
-     This may not be a good assumption... */
-  if err == nil {
-    exists = true
-  }
-  return exists, nil
+  /* Only a gone_codes response (or the object missing from
+     its list) means it does not exist. Anything else, such as
+     a 403 or the API being down, is an error rather than a
+     reason to create the object again */
+  return obj.exists(obj.has_probe())
 }
@@ -0,0 +1,82 @@
+package restapi
+
+import (
+  "encoding/json"
+  "fmt"
+  "strings"
+  "testing"
+  "github.com/hashicorp/terraform/config"
+  "github.com/hashicorp/terraform/terraform"
+)
+
+func diff_api_object(t *testing.T, old_data string, new_data string, settings map[string]interface{}) *terraform.InstanceDiff {
+  state := &terraform.InstanceState{
+    ID: "1",
+    Attributes: map[string]string{"id": "1", "path": "/api/things", "data": old_data},
+  }
+  raw := map[string]interface{}{"path": "/api/things", "data": new_data}
+  for k, v := range settings { raw[k] = v }
+  rc, err := config.NewRawConfig(raw)
+  if err != nil { t.Fatalf("resource_api_object_test.go: %s", err) }
+
+  diff, err := resourceRestApi().Diff(state, terraform.NewResourceConfig(rc), nil)
+  if err != nil { t.Fatalf("resource_api_object_test.go: %s", err) }
+  return diff
+}
+
+func TestResourceForceNew(t *testing.T) {
+  old_data := `{ "id": "1", "name": "a", "size": 1 }`
+
+  if diff := diff_api_object(t, old_data, `{ "id": "1", "name": "b", "size": 1 }`, nil); diff == nil || diff.RequiresNew() {
+    t.Fatalf("resource_api_object_test.go: Expected a change to data to be an update by default")
+  }
+  if diff := diff_api_object(t, old_data, `{ "id": "1", "name": "b", "size": 1 }`, map[string]interface{}{"force_new_on_change": true}); diff == nil || !diff.RequiresNew() {
+    t.Fatalf("resource_api_object_test.go: Expected force_new_on_change to replace the object")
+  }
+
+  fields := map[string]interface{}{"force_new_fields": []interface{}{"size"}}
+  if diff := diff_api_object(t, old_data, `{ "id": "1", "name": "b", "size": 1 }`, fields); diff == nil || diff.RequiresNew() {
+    t.Fatalf("resource_api_object_test.go: Expected a change to a field not in force_new_fields to be an update")
+  }
+  if diff := diff_api_object(t, old_data, `{ "id": "1", "name": "a", "size": 2 }`, fields); diff == nil || !diff.RequiresNew() {
+    t.Fatalf("resource_api_object_test.go: Expected a change to a field in force_new_fields to replace the object")
+  }
+}
+
+func TestResourceSensitiveFields(t *testing.T) {
+  if !resourceRestApi().Schema["data"].Sensitive {
+    t.Fatalf("resource_api_object_test.go: Expected data to be sensitive, since it may hold sensitive_fields")
+  }
+
+  client := NewAPIClient(&api_client_opt{
+    uri:              "http://127.0.0.1:8119/",
+    timeout:          2,
+    id_attribute:     "id",
+    sensitive_fields: []string{"password", "/keys/0", "token"},
+    debug:            api_client_debug,
+  })
+  o, _ := NewAPIObject(client, &api_object_opt{
+    path:       "/api/users",
+    data:       `{ "name": "bob", "password": "hunter2", "keys": ["k1"] }`,
+    api_schema: map[string]string{"password": "string", "keys": "json"},
+    debug:      api_object_debug,
+  })
+  if err := o.update_state(`{ "id": "1", "name": "bob", "password": "hunter2", "keys": ["k1"], "token": "s3cret" }`); err != nil {
+    t.Fatalf("resource_api_object_test.go: Failed to update state: %s", err)
+  }
+
+  d := resourceRestApi().Data(nil)
+  set_resource_state(o, d)
+  defaults, _ := json.Marshal(o.find_server_defaults())
+  d.Set("server_defaults", string(defaults))
+
+  for _, attr := range []string{"api_data", "api_response", "api_strings", "api_json", "server_defaults"} {
+    state := fmt.Sprintf("%v", d.Get(attr))
+    if strings.Contains(state, "hunter2") || strings.Contains(state, "k1") || strings.Contains(state, "s3cret") {
+      t.Fatalf("resource_api_object_test.go: Expected the sensitive_fields to be masked in %s but got %s", attr, state)
+    }
+  }
+  if password := d.Get("api_data").(map[string]interface{})["password"]; password != redacted {
+    t.Fatalf("resource_api_object_test.go: Expected the password in api_data to be '%s' but got '%v'", redacted, password)
+  }
+}